@@ -4,20 +4,27 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/SSRVodka/oh-packager/internal/common"
 	"github.com/SSRVodka/oh-packager/internal/pkgclient"
+	"github.com/SSRVodka/oh-packager/pkg/config"
 	"github.com/spf13/cobra"
 )
 
 func main() {
 	var rootURL, arch, channel, ohosSdkDir, ohosSdkDirAbs, pkgSrcRepoDir string
+	var mirrors []string
+	var mirrorSelection string
+	var allowUnsigned bool
+	var offline bool
 	root := &cobra.Command{
 		Use:           "ohla",
 		Short:         "Client for the package repo (list, install, uninstall, config)",
 		SilenceErrors: true,
 		SilenceUsage:  true,
 	}
+	root.PersistentFlags().BoolVar(&offline, "offline", false, "resolve against the last fetched indexes and install from the package cache only")
 
 	// CONFIG
 	cfgCmd := &cobra.Command{
@@ -32,10 +39,23 @@ func main() {
 			if rootURL == "" {
 				return fmt.Errorf("the repo root URL is required")
 			}
-			if !common.IsValidHttpUrl(rootURL) {
-				return fmt.Errorf("invalid http URL: '%s'", rootURL)
+			if c.RootURL, err = common.NormalizeRepoURL(rootURL); err != nil {
+				return err
+			}
+			if cmd.Flags().Changed("mirror") {
+				if c.Mirrors, err = pkgclient.NormalizeMirrors(mirrors); err != nil {
+					return err
+				}
+			}
+			if cmd.Flags().Changed("mirror-selection") {
+				if err := pkgclient.ValidateMirrorSelection(mirrorSelection); err != nil {
+					return err
+				}
+				c.MirrorSelection = mirrorSelection
+			}
+			if cmd.Flags().Changed("allow-unsigned") {
+				c.AllowUnsigned = allowUnsigned
 			}
-			c.RootURL = rootURL
 			if ohosSdkDir == "" {
 				return fmt.Errorf("the path for OHOS SDK is required")
 			}
@@ -68,17 +88,20 @@ func main() {
 		},
 	}
 
-	cfgCmd.Flags().StringVarP(&rootURL, "server-root", "s", "", "Set repository root URL (e.g. https://repo.example.com)")
+	cfgCmd.Flags().StringVarP(&rootURL, "server-root", "s", "", "Set repository root URL (e.g. https://repo.example.com, file:///srv/repo or a local repository directory)")
 	cfgCmd.Flags().StringVarP(&ohosSdkDir, "ohos-sdk", "d", "", "Set directory of local OHOS SDK (e.g. /home/xhw/ohos-robot-toolchain/linux)")
 	cfgCmd.Flags().StringVarP(&arch, "arch", "a", "", "Set default architecture (e.g. x86_64,arm,aarch64)")
 	cfgCmd.Flags().StringVarP(&channel, "channel", "c", "", "Set default channel (OPTIONAL, e.g. stable)")
 	cfgCmd.Flags().StringVar(&pkgSrcRepoDir, "pkg-src-repo", "", "Set the directory of the package source repository for cross compiling (OPTIONAL)")
+	cfgCmd.Flags().StringArrayVar(&mirrors, "mirror", nil, "Set a mirror of the repository, tried when it fails (OPTIONAL, repeatable; replaces the configured mirrors)")
+	cfgCmd.Flags().StringVar(&mirrorSelection, "mirror-selection", "", "Set the order mirrors are tried in: order (as configured) or latency (OPTIONAL)")
+	cfgCmd.Flags().BoolVar(&allowUnsigned, "allow-unsigned", false, "Don't verify the signatures of the repository (OPTIONAL, unsigned repositories only)")
 
 	// LIST
 	var archFlag string
 	listCmd := &cobra.Command{
 		Use:   "list",
-		Short: "List packages available for current arch",
+		Short: "List packages available for current arch (from the local indexes, see update)",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			cfgFile := common.DefaultConfigPath()
 			cfg, err := common.LoadConfig(cfgFile)
@@ -87,6 +110,7 @@ func main() {
 				return nil
 			}
 			cl := pkgclient.NewClient(cfg)
+			cl.Offline = offline
 			arch := archFlag
 			if arch == "" {
 				arch = common.DefaultArch()
@@ -96,6 +120,100 @@ func main() {
 	}
 	listCmd.Flags().StringVar(&archFlag, "arch", "", "architecture (default auto-detected)")
 
+	searchCmd := &cobra.Command{
+		Use:   "search <pattern>",
+		Short: "Search packages available for current arch by name",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfgFile := common.DefaultConfigPath()
+			cfg, err := common.LoadConfig(cfgFile)
+			if err != nil {
+				fmt.Printf("failed to load client config: %+v\n", err)
+				return nil
+			}
+			cl := pkgclient.NewClient(cfg)
+			cl.Offline = offline
+			arch := archFlag
+			if arch == "" {
+				arch = common.DefaultArch()
+			}
+			return cl.SearchPackages(args[0], arch)
+		},
+	}
+	searchCmd.Flags().StringVar(&archFlag, "arch", "", "architecture (default auto-detected)")
+
+	updateCmd := &cobra.Command{
+		Use:   "update",
+		Short: "Refresh the local copies of the repository indexes",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfgFile := common.DefaultConfigPath()
+			cfg, err := common.LoadConfig(cfgFile)
+			if err != nil {
+				fmt.Printf("failed to load client config: %+v\n", err)
+				return nil
+			}
+			cl := pkgclient.NewClient(cfg)
+			cl.Offline = offline
+			return cl.Update()
+		},
+	}
+
+	// QUERY
+	var queryPrefix string
+	infoCmd := &cobra.Command{
+		Use:   "info <package>",
+		Short: "Show package metadata and its installed state. Empty prefix indicates OHOS sdk",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfgFile := common.DefaultConfigPath()
+			cfg, err := common.LoadConfig(cfgFile)
+			if err != nil {
+				fmt.Printf("failed to load client config: %+v\n", err)
+				return nil
+			}
+			cl := pkgclient.NewClient(cfg)
+			cl.Offline = offline
+			return cl.Info(args[0], queryPrefix, archFlag)
+		},
+	}
+	infoCmd.Flags().StringVar(&queryPrefix, "prefix", "", "install prefix to query (default OHOS sdk)")
+	infoCmd.Flags().StringVar(&archFlag, "arch", "", "architecture (default installed arch or auto-detected)")
+
+	filesCmd := &cobra.Command{
+		Use:   "files <package>",
+		Short: "List files installed by a package. Empty prefix indicates OHOS sdk",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfgFile := common.DefaultConfigPath()
+			cfg, err := common.LoadConfig(cfgFile)
+			if err != nil {
+				fmt.Printf("failed to load client config: %+v\n", err)
+				return nil
+			}
+			cl := pkgclient.NewClient(cfg)
+			return cl.Files(args[0], queryPrefix)
+		},
+	}
+	filesCmd.Flags().StringVar(&queryPrefix, "prefix", "", "install prefix to query (default OHOS sdk)")
+
+	ownsCmd := &cobra.Command{
+		Use:   "owns <path>",
+		Short: "Show which installed package owns a file. Empty prefix indicates OHOS sdk",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfgFile := common.DefaultConfigPath()
+			cfg, err := common.LoadConfig(cfgFile)
+			if err != nil {
+				fmt.Printf("failed to load client config: %+v\n", err)
+				return nil
+			}
+			cl := pkgclient.NewClient(cfg)
+			return cl.Owns(args[0], queryPrefix)
+		},
+	}
+	ownsCmd.Flags().StringVar(&queryPrefix, "prefix", "", "install prefix to query (default OHOS sdk)")
+
 	var tgtPrefix, newPrefix string
 	patchCmd := &cobra.Command{
 		Use:   "patch <prefix> <new_prefix>",
@@ -151,11 +269,14 @@ func main() {
 
 	// INSTALL
 	var prefix string
-	var noConfirm, noResolve bool
+	var noConfirm, noResolve, dryRun, jsonPlan bool
+	var overwrite []string
+	var scriptPolicy string
 	installCmd := &cobra.Command{
-		Use:   "add <package> [package...]",
-		Short: "Install one or more packages to prefix (irreversible). Empty prefix indicates installing to OHOS sdk",
-		Args:  cobra.MinimumNArgs(1),
+		Use:     "add [package...]",
+		Aliases: []string{"install"},
+		Short:   "Install one or more packages to prefix. Empty prefix indicates installing to OHOS sdk. Without packages, installs the dependencies of the project file (" + pkgclient.ProjectFileName + ")",
+		Args:    cobra.ArbitraryArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			cfgFile := common.DefaultConfigPath()
 			cfg, err := common.LoadConfig(cfgFile)
@@ -163,7 +284,32 @@ func main() {
 				fmt.Printf("failed to load client config: %+v\n", err)
 				return nil
 			}
+			if err := pkgclient.ValidateScriptPolicy(scriptPolicy); err != nil {
+				return err
+			}
 			cl := pkgclient.NewClient(cfg)
+			cl.Overwrite = overwrite
+			cl.ScriptPolicy = scriptPolicy
+			cl.Offline = offline
+			cl.DryRun = dryRun
+			if jsonPlan {
+				if !dryRun {
+					return fmt.Errorf("--json needs --dry-run")
+				}
+				// keep stdout for the plan: progress messages go to stderr
+				cl.PlanJSON = os.Stdout
+				cl.Log = os.Stderr
+			}
+			if len(args) == 0 {
+				if prefix != "" || noResolve {
+					return fmt.Errorf("--prefix and --no-resolve need packages; the project file sets the prefix")
+				}
+				projectPath, findErr := pkgclient.FindProjectFile(".")
+				if findErr != nil {
+					return findErr
+				}
+				return cl.InstallProject(projectPath, noConfirm)
+			}
 			if prefix == "" {
 				return cl.InstallToSdk(args, noConfirm, noResolve)
 			}
@@ -178,12 +324,53 @@ func main() {
 	installCmd.Flags().BoolVarP(&noConfirm, "yes", "y", false, "install without interaction/prompt")
 	installCmd.Flags().BoolVar(&noResolve, "no-resolve", false, "install without resolving dependencies. WARN: this will break the dependencies!!! And ONLY local file will be accepted in this mode")
 	installCmd.Flags().StringVar(&prefix, "prefix", "", "target install prefix (required for non OHOS sdk installation)")
+	installCmd.Flags().StringArrayVar(&overwrite, "overwrite", nil, "overwrite conflicting files matching this glob (relative to prefix, repeatable)")
+	installCmd.Flags().BoolVar(&dryRun, "dry-run", false, "only show what would be installed, without touching the prefix")
+	installCmd.Flags().BoolVar(&jsonPlan, "json", false, "print the --dry-run plan as JSON")
+	installCmd.Flags().StringVar(&scriptPolicy, "scripts", pkgclient.ScriptsAsk, "package scripts: never, ask (show untrusted scripts and confirm) or trusted")
 
 	// UNINSTALL
+	var force, cascade bool
 	uninstallCmd := &cobra.Command{
-		Use:   "del <package>",
-		Short: "Uninstall a package from prefix (WARN: may break dependencies)",
-		Args:  cobra.ExactArgs(1),
+		Use:   "del <package> [package...]",
+		Short: "Uninstall packages from prefix. Empty prefix indicates uninstalling from OHOS sdk",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfgFile := common.DefaultConfigPath()
+			cfg, err := common.LoadConfig(cfgFile)
+			if err != nil {
+				fmt.Printf("failed to load client config: %+v\n", err)
+				return nil
+			}
+			if force && cascade {
+				return fmt.Errorf("--force and --cascade are mutually exclusive")
+			}
+			if err := pkgclient.ValidateScriptPolicy(scriptPolicy); err != nil {
+				return err
+			}
+			cl := pkgclient.NewClient(cfg)
+			cl.ScriptPolicy = scriptPolicy
+			if prefix == "" {
+				return cl.UninstallFromSdk(args, force, cascade)
+			}
+			var prefixErr error
+			prefix, prefixErr = common.GetAbsolutePath(prefix)
+			if prefixErr != nil {
+				return prefixErr
+			}
+			return cl.Uninstall(args, prefix, force, cascade)
+		},
+	}
+	uninstallCmd.Flags().StringVar(&prefix, "prefix", "", "target install prefix (required for non OHOS sdk uninstallation)")
+	uninstallCmd.Flags().BoolVar(&force, "force", false, "remove even if other installed packages depend on it (WARN: breaks them)")
+	uninstallCmd.Flags().BoolVar(&cascade, "cascade", false, "also remove installed packages that depend on it")
+	uninstallCmd.Flags().StringVar(&scriptPolicy, "scripts", pkgclient.ScriptsAsk, "package scripts: never, ask (show untrusted scripts and confirm) or trusted")
+
+	// UPGRADE
+	upgradeCmd := &cobra.Command{
+		Use:   "upgrade [package...]",
+		Short: "Upgrade installed packages (all of them if none given). Empty prefix indicates upgrading OHOS sdk",
+		Args:  cobra.ArbitraryArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			cfgFile := common.DefaultConfigPath()
 			cfg, err := common.LoadConfig(cfgFile)
@@ -191,20 +378,160 @@ func main() {
 				fmt.Printf("failed to load client config: %+v\n", err)
 				return nil
 			}
+			if err := pkgclient.ValidateScriptPolicy(scriptPolicy); err != nil {
+				return err
+			}
 			cl := pkgclient.NewClient(cfg)
-			pkg := args[0]
+			cl.Overwrite = overwrite
+			cl.ScriptPolicy = scriptPolicy
+			cl.Offline = offline
 			if prefix == "" {
-				return fmt.Errorf("--prefix required")
+				return cl.UpgradeSdk(args, noConfirm)
 			}
 			var prefixErr error
 			prefix, prefixErr = common.GetAbsolutePath(prefix)
 			if prefixErr != nil {
 				return prefixErr
 			}
-			return cl.Uninstall(pkg, prefix)
+			return cl.Upgrade(args, prefix, noConfirm)
 		},
 	}
-	uninstallCmd.Flags().StringVar(&prefix, "prefix", "", "target install prefix (required)")
+	upgradeCmd.Flags().BoolVarP(&noConfirm, "yes", "y", false, "upgrade without interaction/prompt")
+	upgradeCmd.Flags().StringVar(&prefix, "prefix", "", "target install prefix (required for non OHOS sdk upgrade)")
+	upgradeCmd.Flags().StringArrayVar(&overwrite, "overwrite", nil, "overwrite conflicting files matching this glob (relative to prefix, repeatable)")
+	upgradeCmd.Flags().StringVar(&scriptPolicy, "scripts", pkgclient.ScriptsAsk, "package scripts: never, ask (show untrusted scripts and confirm) or trusted")
+
+	// LOCK & SYNC
+	var lockPath, lockArch string
+	var prune bool
+	lockCmd := &cobra.Command{
+		Use:   "lock <package> [package...]",
+		Short: "Resolve packages and pin the exact result in a lock file",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfgFile := common.DefaultConfigPath()
+			cfg, err := common.LoadConfig(cfgFile)
+			if err != nil {
+				fmt.Printf("failed to load client config: %+v\n", err)
+				return nil
+			}
+			cl := pkgclient.NewClient(cfg)
+			cl.Offline = offline
+			arch := lockArch
+			if arch == "" {
+				arch = common.DefaultArch()
+			}
+			return cl.Lock(args, arch, lockPath)
+		},
+	}
+	lockCmd.Flags().StringVar(&lockPath, "lockfile", pkgclient.DefaultLockFile, "lock file to write")
+	lockCmd.Flags().StringVar(&lockArch, "arch", "", "target architecture (default from config)")
+
+	syncCmd := &cobra.Command{
+		Use:   "sync",
+		Short: "Install the exact packages of a lock file into prefix. Empty prefix indicates OHOS sdk",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfgFile := common.DefaultConfigPath()
+			cfg, err := common.LoadConfig(cfgFile)
+			if err != nil {
+				fmt.Printf("failed to load client config: %+v\n", err)
+				return nil
+			}
+			if err := pkgclient.ValidateScriptPolicy(scriptPolicy); err != nil {
+				return err
+			}
+			cl := pkgclient.NewClient(cfg)
+			cl.Overwrite = overwrite
+			cl.ScriptPolicy = scriptPolicy
+			cl.Offline = offline
+			if prefix == "" {
+				return cl.SyncSdk(lockPath, noConfirm, prune)
+			}
+			var prefixErr error
+			prefix, prefixErr = common.GetAbsolutePath(prefix)
+			if prefixErr != nil {
+				return prefixErr
+			}
+			return cl.Sync(lockPath, prefix, noConfirm, prune)
+		},
+	}
+	syncCmd.Flags().StringVar(&lockPath, "lockfile", pkgclient.DefaultLockFile, "lock file to install from")
+	syncCmd.Flags().StringVar(&prefix, "prefix", "", "target install prefix (required for non OHOS sdk installation)")
+	syncCmd.Flags().BoolVarP(&noConfirm, "yes", "y", false, "sync without interaction/prompt")
+	syncCmd.Flags().BoolVar(&prune, "prune", false, "also remove installed packages the lock file doesn't list")
+	syncCmd.Flags().StringArrayVar(&overwrite, "overwrite", nil, "overwrite conflicting files matching this glob (relative to prefix, repeatable)")
+	syncCmd.Flags().StringVar(&scriptPolicy, "scripts", pkgclient.ScriptsAsk, "package scripts: never, ask (show untrusted scripts and confirm) or trusted")
+
+	// SDK SNAPSHOTS
+	sdkCmd := &cobra.Command{
+		Use:   "sdk",
+		Short: "Snapshot and restore the OHOS sdk sysroot (native/sysroot/usr)",
+	}
+	sdkSnapshotCmd := &cobra.Command{
+		Use:   "snapshot",
+		Short: "Record the current state of the sdk sysroot",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfgFile := common.DefaultConfigPath()
+			cfg, err := common.LoadConfig(cfgFile)
+			if err != nil {
+				fmt.Printf("failed to load client config: %+v\n", err)
+				return nil
+			}
+			cl := pkgclient.NewClient(cfg)
+			_, err = cl.SdkSnapshot()
+			return err
+		},
+	}
+	sdkListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the snapshots of the sdk sysroot",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfgFile := common.DefaultConfigPath()
+			cfg, err := common.LoadConfig(cfgFile)
+			if err != nil {
+				fmt.Printf("failed to load client config: %+v\n", err)
+				return nil
+			}
+			cl := pkgclient.NewClient(cfg)
+			return cl.SdkSnapshots()
+		},
+	}
+	sdkRestoreCmd := &cobra.Command{
+		Use:   "restore <snapshot-id>",
+		Short: "Restore the sdk sysroot and its installed packages to a snapshot",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfgFile := common.DefaultConfigPath()
+			cfg, err := common.LoadConfig(cfgFile)
+			if err != nil {
+				fmt.Printf("failed to load client config: %+v\n", err)
+				return nil
+			}
+			cl := pkgclient.NewClient(cfg)
+			return cl.SdkRestore(args[0], noConfirm)
+		},
+	}
+	sdkRestoreCmd.Flags().BoolVarP(&noConfirm, "yes", "y", false, "restore without interaction/prompt")
+	sdkResetCmd := &cobra.Command{
+		Use:   "reset",
+		Short: "Restore the sdk sysroot to its state before the first ohla installation",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfgFile := common.DefaultConfigPath()
+			cfg, err := common.LoadConfig(cfgFile)
+			if err != nil {
+				fmt.Printf("failed to load client config: %+v\n", err)
+				return nil
+			}
+			cl := pkgclient.NewClient(cfg)
+			return cl.SdkReset(noConfirm)
+		},
+	}
+	sdkResetCmd.Flags().BoolVarP(&noConfirm, "yes", "y", false, "reset without interaction/prompt")
+	sdkCmd.AddCommand(sdkSnapshotCmd, sdkListCmd, sdkRestoreCmd, sdkResetCmd)
 
 	// XCOMPILE
 	var xcompileArch string
@@ -233,9 +560,266 @@ func main() {
 	xcompileCmd.Flags().IntVarP(&xcompileJobs, "jobs", "j", 1, "number of build jobs")
 	xcompileCmd.Flags().BoolVar(&xcompileKeepGoing, "keep-going", false, "continue building independent packages after a failure")
 
-	// uninstall not supported for now
-	// root.AddCommand(cfgCmd, listCmd, installCmd, uninstallCmd)
-	root.AddCommand(cfgCmd, listCmd, installCmd, patchCmd, xcompileCmd)
+	// REPOSITORIES
+	repoCmd := &cobra.Command{
+		Use:   "repo",
+		Short: "Manage the package repositories used in addition to the configured one",
+	}
+	repoListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List repositories (highest priority first) and package pins",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := common.LoadConfig(common.DefaultConfigPath())
+			if err != nil {
+				fmt.Printf("failed to load client config: %+v\n", err)
+				return nil
+			}
+			pkgclient.NewClient(cfg).PrintRepos()
+			return nil
+		},
+	}
+	var repoPriority int
+	var repoChannel string
+	var repoMirrors []string
+	var repoAllowUnsigned bool
+	repoAddCmd := &cobra.Command{
+		Use:   "add <name> <url>",
+		Short: "Add a repository. For the same package, higher priority repositories are preferred",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfgFile := common.DefaultConfigPath()
+			cfg, err := common.LoadConfig(cfgFile)
+			if err != nil {
+				fmt.Printf("failed to load client config: %+v\n", err)
+				return nil
+			}
+			repo := config.RepoConfig{Name: args[0], URL: args[1], Channel: repoChannel, Priority: repoPriority, Mirrors: repoMirrors, AllowUnsigned: repoAllowUnsigned}
+			if repo, err = pkgclient.ValidateRepo(cfg, repo); err != nil {
+				return err
+			}
+			cfg.Repos = append(cfg.Repos, repo)
+			if err := common.SaveConfig(cfgFile, cfg); err != nil {
+				return err
+			}
+			fmt.Printf("repository '%s' added\n", repo.Name)
+			return nil
+		},
+	}
+	repoAddCmd.Flags().IntVar(&repoPriority, "priority", 0, "priority of the repository (the configured repository 'default' has priority 0)")
+	repoAddCmd.Flags().StringVarP(&repoChannel, "channel", "c", "", "channel of the repository (default: the configured channel)")
+	repoAddCmd.Flags().StringArrayVar(&repoMirrors, "mirror", nil, "mirror of the repository, tried when it fails (repeatable)")
+	repoAddCmd.Flags().BoolVar(&repoAllowUnsigned, "allow-unsigned", false, "don't verify the signatures of the repository (unsigned repositories only)")
+	repoRemoveCmd := &cobra.Command{
+		Use:   "remove <name>",
+		Short: "Remove a repository, the pins to it and the keys trusted for it",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfgFile := common.DefaultConfigPath()
+			cfg, err := common.LoadConfig(cfgFile)
+			if err != nil {
+				fmt.Printf("failed to load client config: %+v\n", err)
+				return nil
+			}
+			repos := cfg.Repos[:0]
+			for _, r := range cfg.Repos {
+				if r.Name != args[0] {
+					repos = append(repos, r)
+				}
+			}
+			if len(repos) == len(cfg.Repos) {
+				return fmt.Errorf("no repository named '%s' (the default repository is set with 'ohla config -s')", args[0])
+			}
+			cfg.Repos = repos
+			for name, repo := range cfg.Pins {
+				if repo == args[0] {
+					delete(cfg.Pins, name)
+				}
+			}
+			pkgclient.ForgetRepoKeys(cfg, args[0])
+			if err := common.SaveConfig(cfgFile, cfg); err != nil {
+				return err
+			}
+			fmt.Printf("repository '%s' removed\n", args[0])
+			return nil
+		},
+	}
+	repoPinCmd := &cobra.Command{
+		Use:   "pin <package> <repo>",
+		Short: "Only install a package from the given repository",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfgFile := common.DefaultConfigPath()
+			cfg, err := common.LoadConfig(cfgFile)
+			if err != nil {
+				fmt.Printf("failed to load client config: %+v\n", err)
+				return nil
+			}
+			known := args[1] == pkgclient.DefaultRepoName && cfg.RootURL != ""
+			for _, r := range cfg.Repos {
+				known = known || r.Name == args[1]
+			}
+			if !known {
+				return fmt.Errorf("no repository named '%s'", args[1])
+			}
+			if cfg.Pins == nil {
+				cfg.Pins = map[string]string{}
+			}
+			cfg.Pins[args[0]] = args[1]
+			if err := common.SaveConfig(cfgFile, cfg); err != nil {
+				return err
+			}
+			fmt.Printf("%s pinned to repository '%s'\n", args[0], args[1])
+			return nil
+		},
+	}
+	repoUnpinCmd := &cobra.Command{
+		Use:   "unpin <package>",
+		Short: "Install a package from any repository again",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfgFile := common.DefaultConfigPath()
+			cfg, err := common.LoadConfig(cfgFile)
+			if err != nil {
+				fmt.Printf("failed to load client config: %+v\n", err)
+				return nil
+			}
+			if _, ok := cfg.Pins[args[0]]; !ok {
+				return fmt.Errorf("%s is not pinned", args[0])
+			}
+			delete(cfg.Pins, args[0])
+			if err := common.SaveConfig(cfgFile, cfg); err != nil {
+				return err
+			}
+			fmt.Printf("%s unpinned\n", args[0])
+			return nil
+		},
+	}
+	repoCmd.AddCommand(repoListCmd, repoAddCmd, repoRemoveCmd, repoPinCmd, repoUnpinCmd)
+
+	// CACHE
+	cacheCmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Inspect and clean the package download cache",
+	}
+	cacheListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List cached packages",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := common.LoadConfig(common.DefaultConfigPath())
+			if err != nil {
+				fmt.Printf("failed to load client config: %+v\n", err)
+				return nil
+			}
+			return pkgclient.NewClient(cfg).CacheList()
+		},
+	}
+	cacheCleanCmd := &cobra.Command{
+		Use:   "clean",
+		Short: "Remove every cached package",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := common.LoadConfig(common.DefaultConfigPath())
+			if err != nil {
+				fmt.Printf("failed to load client config: %+v\n", err)
+				return nil
+			}
+			return pkgclient.NewClient(cfg).CacheClean()
+		},
+	}
+	var keepLatest int
+	var olderThan string
+	cachePruneCmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove old cached packages (with both options, only packages matching both are removed)",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := common.LoadConfig(common.DefaultConfigPath())
+			if err != nil {
+				fmt.Printf("failed to load client config: %+v\n", err)
+				return nil
+			}
+			var age time.Duration
+			if olderThan != "" {
+				if age, err = pkgclient.ParseAge(olderThan); err != nil {
+					return err
+				}
+			}
+			return pkgclient.NewClient(cfg).CachePrune(keepLatest, age)
+		},
+	}
+	cachePruneCmd.Flags().IntVar(&keepLatest, "keep-latest", 0, "keep the N latest cached versions of each package")
+	cachePruneCmd.Flags().StringVar(&olderThan, "older-than", "", "remove packages not used for this long (e.g. 30d, 12h)")
+	cacheCmd.AddCommand(cacheListCmd, cacheCleanCmd, cachePruneCmd)
+
+	// SIGNING KEYS
+	keyCmd := &cobra.Command{
+		Use:   "key",
+		Short: "Manage the public keys trusted to sign repositories",
+	}
+	var keyRepo string
+	keyAddCmd := &cobra.Command{
+		Use:   "add <public-key-file>",
+		Short: "Trust a repository signing key (public_keys/<id>.pub of the repository) for one repository",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfgFile := common.DefaultConfigPath()
+			cfg, err := common.LoadConfig(cfgFile)
+			if err != nil {
+				fmt.Printf("failed to load client config: %+v\n", err)
+				return nil
+			}
+			id, err := pkgclient.AddTrustedKey(cfg, args[0], keyRepo)
+			if err != nil {
+				return err
+			}
+			if err := common.SaveConfig(cfgFile, cfg); err != nil {
+				return err
+			}
+			fmt.Printf("key %s trusted for repository '%s'\n", id, keyRepo)
+			return nil
+		},
+	}
+	keyAddCmd.Flags().StringVar(&keyRepo, "repo", pkgclient.DefaultRepoName, "repository the key signs")
+	keyListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the trusted keys",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := common.LoadConfig(common.DefaultConfigPath())
+			if err != nil {
+				fmt.Printf("failed to load client config: %+v\n", err)
+				return nil
+			}
+			pkgclient.PrintTrustedKeys(cfg)
+			return nil
+		},
+	}
+	keyRemoveCmd := &cobra.Command{
+		Use:   "remove <key-id>",
+		Short: "Stop trusting a key: indexes signed by it are rejected, run 'ohla update' after a key rotation",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfgFile := common.DefaultConfigPath()
+			cfg, err := common.LoadConfig(cfgFile)
+			if err != nil {
+				fmt.Printf("failed to load client config: %+v\n", err)
+				return nil
+			}
+			if err := pkgclient.RemoveTrustedKey(cfg, args[0]); err != nil {
+				return err
+			}
+			if err := common.SaveConfig(cfgFile, cfg); err != nil {
+				return err
+			}
+			fmt.Printf("key %s removed\n", args[0])
+			return nil
+		},
+	}
+	keyCmd.AddCommand(keyAddCmd, keyListCmd, keyRemoveCmd)
+
+	root.AddCommand(cfgCmd, repoCmd, keyCmd, cacheCmd, updateCmd, listCmd, searchCmd, infoCmd, filesCmd, ownsCmd, installCmd, uninstallCmd, upgradeCmd, lockCmd, syncCmd, sdkCmd, patchCmd, xcompileCmd)
 
 	if err := root.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"os"
 
@@ -36,6 +37,66 @@ func main() {
 		},
 	}
 
+	var keyPath string
+	loadKey := func() (ed25519.PrivateKey, error) {
+		if keyPath == "" {
+			return nil, nil
+		}
+		return common.LoadSigningKey(keyPath)
+	}
+
+	keygenCmd := &cobra.Command{
+		Use:   "keygen <private-key-file>",
+		Short: "Generate an ed25519 signing key and publish its public key in the repository (public_keys/)",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			repoAbs, err := common.GetAbsolutePath(basePath)
+			if err != nil {
+				return err
+			}
+			keyAbs, err := common.GetAbsolutePath(args[0])
+			if err != nil {
+				return err
+			}
+			if common.IsWithinDir(repoAbs, keyAbs) {
+				return fmt.Errorf("the private key must not be stored in the repository, which is served to clients")
+			}
+			pub, err := common.GenerateSigningKey(args[0])
+			if err != nil {
+				return err
+			}
+			pubPath, err := common.AddRepoPublicKey(basePath, pub)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Private key written to %s (keep it secret, outside of the repository)\n", args[0])
+			fmt.Printf("Public key %s published as %s\n", common.KeyID(pub), pubPath)
+			fmt.Printf("Clients trust it with: ohla key add %s [--repo <name of the repository in their config>]\n", pubPath)
+			return nil
+		},
+	}
+
+	signCmd := &cobra.Command{
+		Use:   "sign",
+		Short: "Sign every index.json and manifest of the repository (e.g. after keygen)",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			key, err := loadKey()
+			if err != nil {
+				return err
+			}
+			if key == nil {
+				return fmt.Errorf("--key is required")
+			}
+			n, err := common.SignRepo(basePath, key)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Signed %d files\n", n)
+			return nil
+		},
+	}
+
 	var channel string
 	deployCmd := &cobra.Command{
 		Use:   "deploy <pkg-file> <manifest-file>",
@@ -47,7 +108,11 @@ func main() {
 			if channel == "" {
 				return fmt.Errorf("--channel is required")
 			}
-			if err := common.DeployPackage(basePath, channel, pkgFile, manifestFile); err != nil {
+			key, err := loadKey()
+			if err != nil {
+				return err
+			}
+			if err := common.DeployPackage(basePath, channel, pkgFile, manifestFile, key); err != nil {
 				return err
 			}
 			fmt.Printf("Deployed %s + %s to channel %s\n", pkgFile, manifestFile, channel)
@@ -56,7 +121,9 @@ func main() {
 	}
 	deployCmd.Flags().StringVar(&channel, "channel", "stable", "channel to deploy to (default: stable)")
 
-	root.AddCommand(initCmd, deployCmd)
+	root.PersistentFlags().StringVar(&keyPath, "key", os.Getenv("OHLA_SIGNING_KEY"), "ed25519 private key signing index.json and manifests (default $OHLA_SIGNING_KEY)")
+
+	root.AddCommand(initCmd, keygenCmd, signCmd, deployCmd)
 
 	if err := root.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
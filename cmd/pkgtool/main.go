@@ -95,9 +95,10 @@ func buildPackage(payloadDir, outDir, name, version, arch, ohosAPI string, deps
 	}
 
 	// check script attachment
-	_, found := common.GetPostInstScriptPath(payloadDir)
-	if found {
-		fmt.Println("NOTE: post-installation script detected")
+	for _, script := range common.GetPkgScripts() {
+		if _, found := common.GetPkgScriptPath(payloadDir, script); found {
+			fmt.Printf("NOTE: %s script detected\n", script)
+		}
 	}
 
 	// create tar.gz without libexec
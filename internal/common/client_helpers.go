@@ -1,22 +1,31 @@
 package common
 
 import (
+	"archive/tar"
 	"bufio"
+	"compress/gzip"
+	"context"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"net"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/SSRVodka/oh-packager/pkg/config"
 	"github.com/SSRVodka/oh-packager/pkg/meta"
 	"github.com/blang/semver/v4"
-	"github.com/mholt/archiver/v3"
 )
 
 const DEFAULT_CONFIG_DIR string = "oh_pkgmgr"
@@ -173,7 +182,11 @@ func SaveConfig(path string, c *config.Config) error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, b, 0o644)
+	// the config may hold repository credentials
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0o600)
 }
 
 // small json helpers to avoid import cycles
@@ -192,30 +205,140 @@ func FetchURL(client *http.Client, url string) ([]byte, error) {
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode >= 400 {
-		return nil, fmt.Errorf("HTTP %d fetching %s", resp.StatusCode, url)
+		return nil, fmt.Errorf("HTTP %d fetching %s", resp.StatusCode, RedactURL(url))
 	}
 	return io.ReadAll(resp.Body)
 }
 
-func DownloadToFile(client *http.Client, url, dest string) error {
-	resp, err := client.Get(url)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 400 {
-		return fmt.Errorf("HTTP %d fetching %s", resp.StatusCode, url)
-	}
+// attempts and first retry delay of downloads; the delay doubles after each failed attempt
+var (
+	downloadAttempts = 5
+	downloadBackoff  = 500 * time.Millisecond
+)
+
+// DownloadToFile downloads url to dest. See DownloadToFileSHA256.
+func DownloadToFile(ctx context.Context, client *http.Client, url, dest string) error {
+	return DownloadToFileSHA256(ctx, client, url, dest, "")
+}
+
+// DownloadToFileSHA256 downloads url to dest, computing the SHA256 of the content while it streams.
+//
+// The content is written to dest.part first: interrupted downloads are resumed with a Range request,
+// transient failures (network errors, HTTP 429 and 5xx) are retried with exponential backoff, and dest
+// only appears once the download is complete and its checksum matches expected (if not empty).
+func DownloadToFileSHA256(ctx context.Context, client *http.Client, url, dest, expected string) error {
 	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
 		return err
 	}
-	out, err := os.Create(dest)
+	part := dest + ".part"
+	h := sha256.New()
+	delay := downloadBackoff
+	restarted := false
+	for attempt := 1; ; attempt++ {
+		resumed, retry, err := downloadPart(ctx, client, url, part, h)
+		if err == nil {
+			sum := hex.EncodeToString(h.Sum(nil))
+			if expected == "" || strings.EqualFold(sum, expected) {
+				return os.Rename(part, dest)
+			}
+			_ = os.Remove(part)
+			err = fmt.Errorf("checksum mismatch for %s: got %s, expected %s", RedactURL(url), sum, expected)
+			// the resumed part may come from an older file: start over once
+			if !resumed || restarted {
+				return err
+			}
+			restarted, retry = true, true
+		}
+		if !retry || attempt >= downloadAttempts || ctx.Err() != nil {
+			return err
+		}
+		// stderr: stdout may carry machine-readable output (e.g. `ohla add --dry-run --json`)
+		fmt.Fprintf(os.Stderr, " - WARN: %v, retrying in %v\n", err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// downloadPart downloads url into part, resuming after the bytes part already holds.
+// h is reset and fed with the whole content of part.
+//
+// @return (whether an existing part was resumed, whether the error is transient, error)
+func downloadPart(ctx context.Context, client *http.Client, url, part string, h hash.Hash) (bool, bool, error) {
+	out, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0o644)
 	if err != nil {
-		return err
+		return false, false, err
 	}
 	defer out.Close()
-	_, err = io.Copy(out, resp.Body)
-	return err
+	h.Reset()
+	offset, err := io.Copy(h, out)
+	if err != nil {
+		return false, false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, false, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, isTransientError(err), err
+	}
+	defer resp.Body.Close()
+
+	resumed := false
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)):
+		resumed = true
+	case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent:
+		// the server sends everything (again)
+		if _, err := out.Seek(0, io.SeekStart); err != nil {
+			return false, false, err
+		}
+		if err := out.Truncate(0); err != nil {
+			return false, false, err
+		}
+		h.Reset()
+		if resp.StatusCode == http.StatusPartialContent {
+			return false, true, fmt.Errorf("unexpected range %q fetching %s", resp.Header.Get("Content-Range"), RedactURL(url))
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		_ = out.Truncate(0)
+		return false, true, fmt.Errorf("HTTP %d fetching %s: restarting the download", resp.StatusCode, RedactURL(url))
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return false, true, fmt.Errorf("HTTP %d fetching %s", resp.StatusCode, RedactURL(url))
+	default:
+		return false, false, fmt.Errorf("HTTP %d fetching %s", resp.StatusCode, RedactURL(url))
+	}
+
+	if _, err := io.Copy(io.MultiWriter(out, h), resp.Body); err != nil {
+		return resumed, ctx.Err() == nil, fmt.Errorf("download of %s interrupted: %v", RedactURL(url), err)
+	}
+	return resumed, false, out.Sync()
+}
+
+// isTransientError reports whether a failed request may succeed when retried: network errors do,
+// certificate or configuration errors don't.
+func isTransientError(err error) bool {
+	var certErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	if errors.As(err, &certErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) {
+		return false
+	}
+	// *url.Error is a net.Error itself: look at what it wraps
+	var urlErr *neturl.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
 }
 
 func VerifyFileSHA256(path, expected string) (bool, error) {
@@ -234,34 +357,276 @@ func VerifyFileSHA256(path, expected string) (bool, error) {
 
 // ExtractTarGz extracts tar.gz into destDir.
 func ExtractTarGz(archive, destDir string) error {
-	// Generate path for temporary .tar.gz file
-	dir := filepath.Dir(archive)
-	baseName := filepath.Base(archive)
-	ext := filepath.Ext(baseName)
-	nameWithoutExt := strings.TrimSuffix(baseName, ext)
-	newTarGzName := nameWithoutExt + ".tar.gz"
-	newTarGzPath := filepath.Join(dir, newTarGzName)
-
-	// Copy original archive to temporary .tar.gz file using the extracted function
-	if err := copyFile(archive, newTarGzPath); err != nil {
-		return fmt.Errorf("failed to prepare .tar.gz file: %w", err)
-	}
-
-	// Clean up temporary file after extraction (success or failure)
-	defer func() {
-		if err := os.Remove(newTarGzPath); err != nil {
-			fmt.Printf("warning: could not remove temporary file %s: %v", newTarGzPath, err)
+	_, err := ExtractTarGzSHA256(archive, destDir, "")
+	return err
+}
+
+// ExtractTarGzSHA256 extracts tar.gz into destDir in a single streaming pass,
+// computing the SHA256 of the archive while it is read.
+//
+// @param[in] expected checksum of the archive, not checked if empty. destDir is removed on mismatch
+// @return (SHA256 of the archive, error)
+func ExtractTarGzSHA256(archive, destDir, expected string) (string, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	in := bufio.NewReaderSize(io.TeeReader(f, h), 1<<20)
+
+	if err := extractTarGzStream(in, destDir); err != nil {
+		return "", fmt.Errorf("extraction of %s failed: %w", archive, err)
+	}
+	// hash what follows the end of the tar stream as well
+	if _, err := io.Copy(io.Discard, in); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if expected != "" && !strings.EqualFold(sum, expected) {
+		_ = os.RemoveAll(destDir)
+		return "", fmt.Errorf("checksum mismatch for %s: got %s, expected %s", archive, sum, expected)
+	}
+	return sum, nil
+}
+
+func extractTarGzStream(r io.Reader, destDir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	if err := os.MkdirAll(destDir, 0o755); err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	symlinks := []*tar.Header{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			// a symlink extracted later may change where an earlier one resolves
+			for _, hdr := range symlinks {
+				target := filepath.Join(destDir, filepath.FromSlash(hdr.Name))
+				if err := CheckSymlinkTarget(destDir, target, hdr.Linkname); err != nil {
+					return fmt.Errorf("unsafe entry '%s': %v", hdr.Name, err)
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			return err
 		}
-	}()
+		target := filepath.Join(destDir, filepath.FromSlash(hdr.Name))
+		if err := checkTarEntry(destDir, target, hdr); err != nil {
+			return fmt.Errorf("unsafe entry '%s': %v", hdr.Name, err)
+		}
+		if hdr.Typeflag != tar.TypeDir {
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			// never write through a symlink extracted before
+			if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				if err := os.Remove(target); err != nil {
+					return err
+				}
+			}
+		}
+		mode := hdr.FileInfo().Mode()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, mode.Perm()|0o700)
+		case tar.TypeReg:
+			err = writeTarFile(tr, target, mode.Perm())
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, target)
+			symlinks = append(symlinks, hdr)
+		case tar.TypeLink:
+			err = os.Link(filepath.Join(destDir, filepath.FromSlash(hdr.Linkname)), target)
+		case tar.TypeXGlobalHeader:
+		default:
+			err = fmt.Errorf("unknown type flag %q", hdr.Typeflag)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+}
 
-	// Extract the .tar.gz file
-	if err := archiver.Unarchive(newTarGzPath, destDir); err != nil {
-		return fmt.Errorf("extraction failed: %w", err)
+// checkTarEntry rejects the entries of untrusted archives that could reach outside of root once extracted
+// to target: absolute or escaping paths, symlinks and hard links resolving outside of root, device nodes
+// and setuid/setgid files.
+func checkTarEntry(root, target string, hdr *tar.Header) error {
+	name := filepath.FromSlash(hdr.Name)
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return fmt.Errorf("absolute path")
+	}
+	if !IsWithinDir(root, target) {
+		return fmt.Errorf("path escapes the extraction root")
+	}
+	if err := checkParentWithinDir(root, target); err != nil {
+		return err
 	}
+	mode := hdr.FileInfo().Mode()
+	if mode&(os.ModeSetuid|os.ModeSetgid) != 0 {
+		return fmt.Errorf("setuid/setgid bit set (mode %o)", hdr.Mode)
+	}
+	switch hdr.Typeflag {
+	case tar.TypeChar, tar.TypeBlock:
+		return fmt.Errorf("device node")
+	case tar.TypeFifo:
+		return fmt.Errorf("named pipe")
+	case tar.TypeSymlink:
+		return CheckSymlinkTarget(root, target, hdr.Linkname)
+	case tar.TypeLink:
+		linked := filepath.Join(root, filepath.FromSlash(hdr.Linkname))
+		if filepath.IsAbs(filepath.FromSlash(hdr.Linkname)) || !IsWithinDir(root, linked) {
+			return fmt.Errorf("hard link to '%s' outside of the extraction root", hdr.Linkname)
+		}
+		return checkParentWithinDir(root, linked)
+	}
+	return nil
+}
 
+// IsWithinDir reports whether path is root or lies below root, without resolving symlinks.
+func IsWithinDir(root, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(root), filepath.Clean(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// resolvePath resolves the symlinks of the existing leading part of path.
+func resolvePath(path string) (string, error) {
+	existing, rest := filepath.Clean(path), ""
+	for {
+		real, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			return filepath.Join(real, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return filepath.Clean(path), nil
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+}
+
+// checkParentWithinDir makes sure the parent directory of path, symlinks resolved, lies within root.
+func checkParentWithinDir(root, path string) error {
+	return CheckResolvedWithinDir(root, filepath.Dir(path))
+}
+
+// CheckResolvedWithinDir makes sure path, the symlinks of its existing part resolved, lies within root.
+func CheckResolvedWithinDir(root, path string) error {
+	realRoot, err := resolvePath(root)
+	if err != nil {
+		return err
+	}
+	real, err := resolvePath(path)
+	if err != nil {
+		return err
+	}
+	if !IsWithinDir(realRoot, real) {
+		return fmt.Errorf("'%s' resolves outside of '%s'", path, root)
+	}
 	return nil
 }
 
+// CheckSymlinkTarget makes sure a symlink at link pointing to target resolves within root:
+// target must be relative and is resolved from the link's directory one component at a time,
+// following the existing symlinks (see resolveWithinDir).
+func CheckSymlinkTarget(root, link, target string) error {
+	if filepath.IsAbs(target) {
+		return fmt.Errorf("symlink to absolute path '%s'", target)
+	}
+	realRoot, err := resolvePath(root)
+	if err != nil {
+		return err
+	}
+	parent, err := resolvePath(filepath.Dir(link))
+	if err != nil {
+		return err
+	}
+	if !IsWithinDir(realRoot, parent) {
+		return fmt.Errorf("'%s' resolves outside of '%s'", filepath.Dir(link), root)
+	}
+	hops := 0
+	if _, err := resolveWithinDir(realRoot, parent, target, &hops); err != nil {
+		if errors.Is(err, errOutsideRoot) {
+			return fmt.Errorf("symlink target '%s' resolves outside of '%s'", target, root)
+		}
+		return fmt.Errorf("symlink target '%s': %v", target, err)
+	}
+	return nil
+}
+
+var errOutsideRoot = errors.New("outside of the root")
+
+// maximum number of symlinks followed while resolving a path, as on Linux
+const maxSymlinkHops = 40
+
+// resolveWithinDir resolves the relative path rel from dir (a path without symlinks) like the kernel
+// does, one component at a time: existing symlinks are followed, missing components are taken as they are.
+// It fails with errOutsideRoot as soon as a step leaves realRoot.
+func resolveWithinDir(realRoot, dir, rel string, hops *int) (string, error) {
+	cur := dir
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			cur = filepath.Dir(cur)
+		default:
+			next := filepath.Join(cur, name)
+			info, err := os.Lstat(next)
+			if err != nil && !os.IsNotExist(err) {
+				return "", err
+			}
+			if err == nil && info.Mode()&os.ModeSymlink != 0 {
+				if *hops++; *hops > maxSymlinkHops {
+					return "", fmt.Errorf("too many levels of symbolic links")
+				}
+				target, err := os.Readlink(next)
+				if err != nil {
+					return "", err
+				}
+				if filepath.IsAbs(target) {
+					next, err = resolvePath(target)
+				} else {
+					next, err = resolveWithinDir(realRoot, cur, target, hops)
+				}
+				if err != nil {
+					return "", err
+				}
+			}
+			cur = next
+		}
+		if !IsWithinDir(realRoot, cur) {
+			return "", errOutsideRoot
+		}
+	}
+	return cur, nil
+}
+
+func writeTarFile(r io.Reader, path string, perm os.FileMode) error {
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	// the umask must not change the recorded mode
+	if err := out.Chmod(perm); err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
 // list files (with dir) in a directory
 func ListDir(dir string) ([]string, error) {
 	entries, err := os.ReadDir(dir)
@@ -301,10 +666,12 @@ func CopyDirContents(srcDir, dstDir string) error {
 
 	// Use a visited map to track real paths and prevent infinite recursion
 	visited := make(map[string]bool)
-	return copyDirContentsRecursive(srcDir, dstDir, visited)
+	return copyDirContentsRecursive(srcDir, dstDir, dstDir, visited)
 }
 
-func copyDirContentsRecursive(srcDir, dstDir string, visited map[string]bool) error {
+// copyDirContentsRecursive copies srcDir into dstDir. Symlinks must resolve inside dstRoot,
+// device nodes and setuid/setgid files are refused.
+func copyDirContentsRecursive(srcDir, dstDir, dstRoot string, visited map[string]bool) error {
 	// Resolve the real path to detect symlink cycles
 	realSrc, err := filepath.EvalSymlinks(srcDir)
 	if err != nil {
@@ -344,6 +711,9 @@ func copyDirContentsRecursive(srcDir, dstDir string, visited map[string]bool) er
 			if err != nil {
 				return fmt.Errorf("failed to read symlink %s: %w", srcPath, err)
 			}
+			if err := CheckSymlinkTarget(dstRoot, dstPath, linkTarget); err != nil {
+				return fmt.Errorf("refusing to copy symlink %s: %w", srcPath, err)
+			}
 
 			// Remove existing symlink/file if present
 			os.Remove(dstPath)
@@ -357,12 +727,16 @@ func copyDirContentsRecursive(srcDir, dstDir string, visited map[string]bool) er
 
 		// Handle directories
 		if info.IsDir() {
-			if err := copyDirContentsRecursive(srcPath, dstPath, visited); err != nil {
+			if err := copyDirContentsRecursive(srcPath, dstPath, dstRoot, visited); err != nil {
 				return err
 			}
+		} else if !info.Mode().IsRegular() {
+			return fmt.Errorf("refusing to copy %s: not a regular file (%v)", srcPath, info.Mode().Type())
+		} else if info.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 {
+			return fmt.Errorf("refusing to copy %s: setuid/setgid bit set", srcPath)
 		} else {
 			// Copy regular file
-			if err := copyFile(srcPath, dstPath); err != nil {
+			if err := CopyFile(srcPath, dstPath); err != nil {
 				return fmt.Errorf("failed to copy file %s: %w", srcPath, err)
 			}
 		}
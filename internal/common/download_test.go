@@ -0,0 +1,84 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDownloadResumesInterruptedTransfers(t *testing.T) {
+	downloadBackoff = time.Millisecond
+	defer func() { downloadBackoff = 500 * time.Millisecond }()
+
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	sum := sha256.Sum256(content)
+	var requests, ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		ranges = append(ranges, r.Header.Get("Range"))
+		switch len(requests) {
+		case 1:
+			// drop the connection halfway
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		case 2:
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, r, "pkg", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	dest := filepath.Join(t.TempDir(), "foo.pkg")
+	if err := DownloadToFileSHA256(context.Background(), srv.Client(), srv.URL+"/foo.pkg", dest, hex.EncodeToString(sum[:])); err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	got, err := os.ReadFile(dest)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("downloaded content differs (%d bytes, %v)", len(got), err)
+	}
+	if _, err := os.Stat(dest + ".part"); !os.IsNotExist(err) {
+		t.Fatalf(".part file left behind")
+	}
+	if len(ranges) != 3 || ranges[0] != "" || ranges[1] == "" || ranges[2] != ranges[1] {
+		t.Fatalf("unexpected Range headers %q", ranges)
+	}
+}
+
+func TestDownloadRestartsStalePartFiles(t *testing.T) {
+	content := []byte("the current package")
+	sum := sha256.Sum256(content)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "pkg", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	dest := filepath.Join(t.TempDir(), "foo.pkg")
+	// left over from an older version of the package
+	if err := os.WriteFile(dest+".part", []byte("an old pack"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := DownloadToFileSHA256(context.Background(), srv.Client(), srv.URL+"/foo.pkg", dest, hex.EncodeToString(sum[:])); err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	if got, _ := os.ReadFile(dest); !bytes.Equal(got, content) {
+		t.Fatalf("downloaded %q, want %q", got, content)
+	}
+
+	if err := DownloadToFileSHA256(context.Background(), srv.Client(), srv.URL+"/foo.pkg", dest+"2", "0000"); err == nil {
+		t.Fatalf("checksum mismatch not detected")
+	}
+	if _, err := os.Stat(dest + "2"); !os.IsNotExist(err) {
+		t.Fatalf("corrupt download kept")
+	}
+}
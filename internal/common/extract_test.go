@@ -0,0 +1,194 @@
+package common
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mholt/archiver/v3"
+)
+
+type tarEntry struct {
+	hdr     tar.Header
+	content string
+}
+
+func writeTarGz(t testing.TB, path string, entries []tarEntry) string {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		hdr := e.hdr
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(e.content))
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+func TestExtractTarGzSHA256(t *testing.T) {
+	pkg := filepath.Join(t.TempDir(), "foo.pkg")
+	sum := writeTarGz(t, pkg, []tarEntry{
+		{hdr: tar.Header{Name: "lib/", Typeflag: tar.TypeDir, Mode: 0o755}},
+		{hdr: tar.Header{Name: "lib/libfoo.so.1", Typeflag: tar.TypeReg, Mode: 0o755}, content: "elf"},
+		{hdr: tar.Header{Name: "lib/libfoo.so", Typeflag: tar.TypeSymlink, Linkname: "libfoo.so.1"}},
+		{hdr: tar.Header{Name: "include/foo.h", Typeflag: tar.TypeReg, Mode: 0o644}, content: "int foo();"},
+	})
+
+	dest := filepath.Join(t.TempDir(), "stage")
+	got, err := ExtractTarGzSHA256(pkg, dest, strings.ToUpper(sum))
+	if err != nil {
+		t.Fatalf("extraction failed: %v", err)
+	}
+	if got != sum {
+		t.Fatalf("sha256 = %s, want %s", got, sum)
+	}
+	if b, err := os.ReadFile(filepath.Join(dest, "include/foo.h")); err != nil || string(b) != "int foo();" {
+		t.Fatalf("include/foo.h = %q, %v", b, err)
+	}
+	if info, err := os.Stat(filepath.Join(dest, "lib/libfoo.so.1")); err != nil || info.Mode().Perm() != 0o755 {
+		t.Fatalf("lib/libfoo.so.1 mode: %v, %v", info, err)
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "lib/libfoo.so")); err != nil || target != "libfoo.so.1" {
+		t.Fatalf("lib/libfoo.so -> %q, %v", target, err)
+	}
+
+	dest = filepath.Join(t.TempDir(), "stage")
+	if _, err := ExtractTarGzSHA256(pkg, dest, "0000"); err == nil {
+		t.Fatalf("checksum mismatch not detected")
+	}
+	if IsDirExists(dest) {
+		t.Fatalf("staging directory kept after a checksum mismatch")
+	}
+}
+
+// packages of the size of a Qt or OpenJDK build
+func makeBenchPackage(b *testing.B) string {
+	rng := rand.New(rand.NewSource(1))
+	entries := []tarEntry{}
+	for i := 0; i < 64; i++ {
+		// half random, half compressible
+		content := make([]byte, 1<<20)
+		rng.Read(content[:len(content)/2])
+		entries = append(entries, tarEntry{
+			hdr:     tar.Header{Name: fmt.Sprintf("lib/libbench%02d.so", i), Typeflag: tar.TypeReg, Mode: 0o644},
+			content: string(content),
+		})
+	}
+	pkg := filepath.Join(b.TempDir(), "bench.pkg")
+	writeTarGz(b, pkg, entries)
+	return pkg
+}
+
+func BenchmarkExtractTarGz(b *testing.B) {
+	pkg := makeBenchPackage(b)
+	sum, err := ComputeSHA256(pkg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	info, err := os.Stat(pkg)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("streaming", func(b *testing.B) {
+		b.SetBytes(info.Size())
+		for i := 0; i < b.N; i++ {
+			dest := filepath.Join(b.TempDir(), "stage")
+			if _, err := ExtractTarGzSHA256(pkg, dest, sum); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	// verify, copy to .tar.gz, unarchive and copy into the prefix, as before
+	b.Run("copy-unarchive", func(b *testing.B) {
+		b.SetBytes(info.Size())
+		for i := 0; i < b.N; i++ {
+			dir := b.TempDir()
+			if ok, err := VerifyFileSHA256(pkg, sum); err != nil || !ok {
+				b.Fatal(err)
+			}
+			tarGz := filepath.Join(dir, "bench.tar.gz")
+			if err := CopyFile(pkg, tarGz); err != nil {
+				b.Fatal(err)
+			}
+			if err := archiver.Unarchive(tarGz, filepath.Join(dir, "tmp")); err != nil {
+				b.Fatal(err)
+			}
+			if err := os.Remove(tarGz); err != nil {
+				b.Fatal(err)
+			}
+			if err := CopyDirContents(filepath.Join(dir, "tmp"), filepath.Join(dir, "stage")); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestExtractTarGzRejectsUnsafeEntries(t *testing.T) {
+	reg := func(name string) tarEntry {
+		return tarEntry{hdr: tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644}, content: "x"}
+	}
+	link := func(name, target string) tarEntry {
+		return tarEntry{hdr: tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target}}
+	}
+	for _, tc := range []struct {
+		name    string
+		entries []tarEntry
+		bad     string
+	}{
+		{"traversal", []tarEntry{reg("lib/../../evil")}, "lib/../../evil"},
+		{"absolute path", []tarEntry{reg("/etc/evil")}, "/etc/evil"},
+		{"absolute symlink", []tarEntry{link("lib/libc.so", "/usr/lib/libc.so")}, "lib/libc.so"},
+		{"escaping symlink", []tarEntry{link("lib/up", "../../..")}, "lib/up"},
+		{"symlink through symlink", []tarEntry{link("here", "."), link("here/up", "..")}, "here/up"},
+		{"chained symlinks", []tarEntry{link("include/sub/l", ".."), link("include/m", "sub/l/../..")}, "include/m"},
+		{"chained symlinks in reverse order", []tarEntry{link("include/m", "sub/l/../.."), link("include/sub/l", "..")}, "include/m"},
+		{"write through symlink", []tarEntry{link("lib/x", "../lib"), link("lib/out", "../.."), reg("lib/x/out/evil")}, "lib/out"},
+		{"hard link", []tarEntry{{hdr: tar.Header{Name: "lib/passwd", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"}}}, "lib/passwd"},
+		{"device node", []tarEntry{{hdr: tar.Header{Name: "lib/sda", Typeflag: tar.TypeBlock, Mode: 0o600}}}, "lib/sda"},
+		{"setuid", []tarEntry{{hdr: tar.Header{Name: "bin/su", Typeflag: tar.TypeReg, Mode: 0o4755}, content: "x"}}, "bin/su"},
+	} {
+		pkg := filepath.Join(t.TempDir(), "evil.pkg")
+		writeTarGz(t, pkg, append([]tarEntry{reg("include/ok.h")}, tc.entries...))
+		dest := filepath.Join(t.TempDir(), "stage")
+		_, err := ExtractTarGzSHA256(pkg, dest, "")
+		if err == nil || !strings.Contains(err.Error(), "unsafe entry '"+tc.bad+"'") {
+			t.Fatalf("%s: unexpected result %v", tc.name, err)
+		}
+		if _, err := os.Lstat(filepath.Join(filepath.Dir(dest), "evil")); !os.IsNotExist(err) {
+			t.Fatalf("%s: file written outside of the extraction root", tc.name)
+		}
+	}
+
+	// symlinks within the root are fine
+	pkg := filepath.Join(t.TempDir(), "ok.pkg")
+	writeTarGz(t, pkg, []tarEntry{reg("lib/libfoo.so.1"), link("lib/libfoo.so", "libfoo.so.1"), link("lib64", "lib"), reg("lib64/libbar.so")})
+	if _, err := ExtractTarGzSHA256(pkg, filepath.Join(t.TempDir(), "stage"), ""); err != nil {
+		t.Fatalf("extraction failed: %v", err)
+	}
+}
@@ -1,6 +1,8 @@
 package common
 
 import (
+	"context"
+	"crypto/ed25519"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -75,10 +77,32 @@ func GetDepsSepCharsInStr() string {
 	return ",;&|"
 }
 
+// package lifecycle scripts, shipped at the top level of a package
+const (
+	ScriptPreInst  = "preinst"
+	ScriptPostInst = "postinst"
+	ScriptPreRm    = "prerm"
+	ScriptPostRm   = "postrm"
+)
+
+// accepted file names of each lifecycle script
+var pkgScriptFileNames = map[string][]string{
+	ScriptPreInst:  {"preinst", "PREINST", "PreInst"},
+	ScriptPostInst: {"postinst", "POSTINST", "PostInst"},
+	ScriptPreRm:    {"prerm", "PRERM", "PreRm"},
+	ScriptPostRm:   {"postrm", "POSTRM", "PostRm"},
+}
+
+// GetPkgScripts returns the lifecycle scripts in execution order of an installation.
+func GetPkgScripts() []string {
+	return []string{ScriptPreInst, ScriptPostInst, ScriptPreRm, ScriptPostRm}
+}
+
+// @param[in] script one of GetPkgScripts()
 // @return (script full path, isFound)
-func GetPostInstScriptPath(scriptDir string) (string, bool) {
+func GetPkgScriptPath(scriptDir, script string) (string, bool) {
 	if IsDirExists(scriptDir) {
-		for _, name := range []string{"postinst", "POSTINST", "PostInst"} {
+		for _, name := range pkgScriptFileNames[script] {
 			path := filepath.Join(scriptDir, name)
 			if IsFileExists(path) {
 				return path, true
@@ -88,6 +112,11 @@ func GetPostInstScriptPath(scriptDir string) (string, bool) {
 	return "", false
 }
 
+// @return (script full path, isFound)
+func GetPostInstScriptPath(scriptDir string) (string, bool) {
+	return GetPkgScriptPath(scriptDir, ScriptPostInst)
+}
+
 func IsArchDepLibInArchIndepDir(payloadDir string) (bool, error) {
 	archIndepLibDir := filepath.Join(payloadDir, "lib")
 	if IsDirExists(archIndepLibDir) {
@@ -142,6 +171,37 @@ func IsValidHttpUrl(urlStr string) bool {
 	return isHttpOrHttps && hasValidHost
 }
 
+// FileURL returns the file:// URL of the local path (made absolute).
+func FileURL(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}).String(), nil
+}
+
+// NormalizeRepoURL checks the root URL of a repository: an http(s) URL, a file:// URL
+// or a plain path of a local repository directory, which is turned into a file:// URL.
+func NormalizeRepoURL(repoURL string) (string, error) {
+	if IsValidHttpUrl(repoURL) {
+		return repoURL, nil
+	}
+	dir := repoURL
+	if strings.HasPrefix(repoURL, "file://") {
+		u, err := url.Parse(repoURL)
+		if err != nil || (u.Host != "" && u.Host != "localhost") || !strings.HasPrefix(u.Path, "/") {
+			return "", fmt.Errorf("invalid file URL: '%s' (use file:///absolute/path)", repoURL)
+		}
+		dir = filepath.FromSlash(u.Path)
+	} else if strings.Contains(repoURL, "://") {
+		return "", fmt.Errorf("invalid repository URL: '%s' (use http(s)://, file:// or a directory)", RedactURL(repoURL))
+	}
+	if !IsDirExists(dir) {
+		return "", fmt.Errorf("the repository directory '%s' doesn't exist", dir)
+	}
+	return FileURL(dir)
+}
+
 func IsArchDependentLib(path string) bool {
 	basename := filepath.Base(path)
 	return strings.HasSuffix(basename, ".so") || strings.HasSuffix(basename, ".a")
@@ -173,6 +233,56 @@ func ExecuteShell(scriptPath string, args ...string) (string, error) {
 	return string(output), nil
 }
 
+// ScriptOptions controls how ExecuteScript runs a script.
+type ScriptOptions struct {
+	// extra "KEY=value" environment variables
+	Env []string
+	// start from a minimal environment (PATH, HOME, LANG, TMPDIR, TERM) instead of the current one
+	CleanEnv bool
+	// kill the script (and its children) after this long; 0 means no limit
+	Timeout time.Duration
+}
+
+// variables kept by ScriptOptions.CleanEnv
+var cleanEnvKeys = []string{"PATH", "HOME", "LANG", "TMPDIR", "TERM"}
+
+// ExecuteScript is ExecuteShell with an environment and a timeout.
+// The combined output is returned even if the script fails.
+func ExecuteScript(scriptPath string, opts ScriptOptions, args ...string) (string, error) {
+	ctx := context.Background()
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, scriptPath, args...)
+	env := os.Environ()
+	if opts.CleanEnv {
+		env = []string{}
+		for _, key := range cleanEnvKeys {
+			if v, ok := os.LookupEnv(key); ok {
+				env = append(env, key+"="+v)
+			}
+		}
+	}
+	cmd.Env = append(env, opts.Env...)
+	// run in its own process group so that a timeout kills the whole script
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = time.Second
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return string(output), fmt.Errorf("shell '%s' timed out after %v, output: %s", scriptPath, opts.Timeout, string(output))
+	}
+	if err != nil {
+		return string(output), fmt.Errorf("error while executing shell '%s': %v, output: %s", scriptPath, err, string(output))
+	}
+
+	return string(output), nil
+}
+
 func ExecuteShellRealTime(scriptPath string, args ...string) error {
 	cmd := exec.Command(scriptPath, args...)
 	cmd.Stdout = os.Stdout
@@ -385,6 +495,15 @@ func ParseDependencySpec(spec string) (string, []Constraint, error) {
 	return name, constraints, nil
 }
 
+// RedactURL hides the password of URLs with user info, for messages and logs.
+func RedactURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	return parsed.Redacted()
+}
+
 func JoinURL(base, rel string) string {
 	base = strings.TrimRight(base, "/")
 	rel = strings.TrimLeft(rel, "/")
@@ -520,10 +639,15 @@ func EnsureChannelDirs(basePath, channel string) (string, error) {
 
 // TODO: use different channel for difference arch
 // DeployPackage copies .pkg and .json manifest into channel pkgs and regenerates index.
-func DeployPackage(basePath, channel, pkgFile, manifestFile string) error {
+// The manifest and the index are signed with key, which is required for repositories
+// with public keys (nil: unsigned repository).
+func DeployPackage(basePath, channel, pkgFile, manifestFile string, key ed25519.PrivateKey) error {
 	if pkgFile == "" || manifestFile == "" {
 		return errors.New("pkgFile and manifestFile are required")
 	}
+	if err := repoSigningKey(basePath, key); err != nil {
+		return err
+	}
 	chPath, err := EnsureChannelDirs(basePath, channel)
 	if err != nil {
 		return err
@@ -549,7 +673,7 @@ func DeployPackage(basePath, channel, pkgFile, manifestFile string) error {
 	dstManifest := filepath.Join(pkgsDir, manifestBase)
 
 	// copy files
-	if err := copyFile(pkgFile, dstPkg); err != nil {
+	if err := CopyFile(pkgFile, dstPkg); err != nil {
 		return err
 	}
 	// recompute size and sha256 from file to be robust
@@ -573,7 +697,13 @@ func DeployPackage(basePath, channel, pkgFile, manifestFile string) error {
 	if err := regenerateIndex(basePath, channel); err != nil {
 		return err
 	}
-	return nil
+	if key == nil {
+		return nil
+	}
+	if err := SignFile(basePath, fmt.Sprintf("channels/%s/pkgs/%s", channel, manifestBase), key); err != nil {
+		return err
+	}
+	return SignFile(basePath, fmt.Sprintf("channels/%s/index.json", channel), key)
 }
 
 func regenerateIndex(basePath, channel string) error {
@@ -616,10 +746,15 @@ func regenerateIndex(basePath, channel string) error {
 	if err != nil {
 		return err
 	}
+	mirrors, err := ReadRepoMirrors(basePath)
+	if err != nil {
+		return err
+	}
 	idx := meta.Index{
 		Repo:      filepath.Base(basePath),
 		Channel:   channel,
 		Generated: time.Now().UTC(),
+		Mirrors:   mirrors,
 		Packages:  entries,
 	}
 	out, err := json.MarshalIndent(idx, "", "  ")
@@ -630,8 +765,36 @@ func regenerateIndex(basePath, channel string) error {
 	return os.WriteFile(indexPath, out, 0o644)
 }
 
-// copyFile copies src to dst (overwrites).
-func copyFile(src, dst string) error {
+// RepoMirrorsFile lists, one per line, the base URLs of the mirrors of a repository.
+// They are advertised in the index.json of every channel.
+const RepoMirrorsFile = "mirrors"
+
+// ReadRepoMirrors returns the mirrors listed in basePath/RepoMirrorsFile (none if it doesn't exist).
+// Empty lines and lines starting with '#' are ignored.
+func ReadRepoMirrors(basePath string) ([]string, error) {
+	b, err := os.ReadFile(filepath.Join(basePath, RepoMirrorsFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	mirrors := []string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !IsValidHttpUrl(line) {
+			return nil, fmt.Errorf("invalid mirror URL in %s: '%s'", RepoMirrorsFile, line)
+		}
+		mirrors = append(mirrors, line)
+	}
+	return mirrors, nil
+}
+
+// CopyFile copies src to dst (overwrites), preserving the permission bits.
+func CopyFile(src, dst string) error {
 	in, err := os.Open(src)
 	if err != nil {
 		return err
@@ -0,0 +1,94 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// NetrcPath returns the netrc file used for repository credentials: $NETRC or ~/.netrc.
+func NetrcPath() string {
+	if p := os.Getenv("NETRC"); p != "" {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// LookupNetrc returns the login and password of host in the netrc file at path,
+// falling back to its `default` entry.
+//
+// @return (login, password, whether an entry was found)
+func LookupNetrc(path, host string) (string, string, bool) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", false
+	}
+	type entry struct {
+		login, password string
+	}
+	var (
+		found, fallback *entry
+		cur             *entry
+	)
+	// tokens of the file, without macro definitions (which run until the next empty line)
+	fields := []string{}
+	inMacdef := false
+	for _, line := range strings.Split(string(b), "\n") {
+		if inMacdef {
+			inMacdef = strings.TrimSpace(line) != ""
+			continue
+		}
+		lineFields := strings.Fields(line)
+		for i, f := range lineFields {
+			if f == "macdef" {
+				lineFields, inMacdef = lineFields[:i], true
+				break
+			}
+		}
+		fields = append(fields, lineFields...)
+	}
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "machine":
+			cur = nil
+			if i+1 < len(fields) {
+				i++
+				if fields[i] == host && found == nil {
+					found = &entry{}
+					cur = found
+				}
+			}
+		case "default":
+			cur = nil
+			if fallback == nil {
+				fallback = &entry{}
+				cur = fallback
+			}
+		case "login", "password", "account":
+			if i+1 >= len(fields) {
+				break
+			}
+			i++
+			if cur == nil {
+				continue
+			}
+			switch fields[i-1] {
+			case "login":
+				cur.login = fields[i]
+			case "password":
+				cur.password = fields[i]
+			}
+		}
+	}
+	if found == nil {
+		found = fallback
+	}
+	if found == nil {
+		return "", "", false
+	}
+	return found.login, found.password, true
+}
@@ -0,0 +1,219 @@
+package common
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/SSRVodka/oh-packager/pkg/meta"
+)
+
+// KeyID identifies an ed25519 public key: the first 16 hex digits of its sha256.
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// EncodePublicKey returns the PEM ("PUBLIC KEY") encoding of pub.
+func EncodePublicKey(pub ed25519.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// ParsePublicKey parses a PEM encoded ed25519 public key.
+func ParsePublicKey(b []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("no PEM public key found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("not an ed25519 public key")
+	}
+	return pub, nil
+}
+
+// GenerateSigningKey creates an ed25519 key pair and writes the private key to keyPath (PEM, 0600).
+// Existing files are never overwritten.
+func GenerateSigningKey(keyPath string) (ed25519.PublicKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		return nil, err
+	}
+	return pub, f.Close()
+}
+
+// LoadSigningKey reads a PEM encoded ed25519 private key.
+func LoadSigningKey(keyPath string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("no PEM private key found in %s", keyPath)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 private key", keyPath)
+	}
+	return priv, nil
+}
+
+// SignatureRelPath returns where the signature of the repository file rel (relative to the
+// repository root, with forward slashes) is stored.
+func SignatureRelPath(rel string) string {
+	return path.Join("signatures", rel) + ".sig"
+}
+
+// SignFile signs the repository file rel of basePath and writes its signature (see SignatureRelPath).
+func SignFile(basePath, rel string, priv ed25519.PrivateKey) error {
+	data, err := os.ReadFile(filepath.Join(basePath, filepath.FromSlash(rel)))
+	if err != nil {
+		return err
+	}
+	sig := meta.Signature{
+		KeyID:     KeyID(priv.Public().(ed25519.PublicKey)),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(priv, data)),
+	}
+	b, err := json.MarshalIndent(sig, "", "  ")
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(basePath, filepath.FromSlash(SignatureRelPath(rel)))
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(dst, b, 0o644)
+}
+
+// VerifySignature checks that sigJSON (a meta.Signature) is a valid signature of data by one of keys
+// (key ID -> public key).
+func VerifySignature(keys map[string]ed25519.PublicKey, data, sigJSON []byte) error {
+	var sig meta.Signature
+	if err := json.Unmarshal(sigJSON, &sig); err != nil {
+		return fmt.Errorf("invalid signature file: %v", err)
+	}
+	pub, ok := keys[sig.KeyID]
+	if !ok {
+		return fmt.Errorf("signed by the untrusted key %s", sig.KeyID)
+	}
+	raw, err := base64.StdEncoding.DecodeString(sig.Signature)
+	if err != nil || !ed25519.Verify(pub, data, raw) {
+		return fmt.Errorf("bad signature by key %s", sig.KeyID)
+	}
+	return nil
+}
+
+// RepoPublicKeys returns the public keys of the repository at basePath (public_keys/*.pub).
+func RepoPublicKeys(basePath string) (map[string]ed25519.PublicKey, error) {
+	files, err := filepath.Glob(filepath.Join(basePath, "public_keys", "*.pub"))
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]ed25519.PublicKey{}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		pub, err := ParsePublicKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		keys[KeyID(pub)] = pub
+	}
+	return keys, nil
+}
+
+// AddRepoPublicKey publishes pub in the repository at basePath (public_keys/<key ID>.pub).
+func AddRepoPublicKey(basePath string, pub ed25519.PublicKey) (string, error) {
+	b, err := EncodePublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	dst := filepath.Join(basePath, "public_keys", KeyID(pub)+".pub")
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return "", err
+	}
+	return dst, os.WriteFile(dst, b, 0o644)
+}
+
+// repoSigningKey checks the signing key of a deployment to the repository at basePath:
+// repositories with public keys must be signed, by one of these keys.
+func repoSigningKey(basePath string, priv ed25519.PrivateKey) error {
+	keys, err := RepoPublicKeys(basePath)
+	if err != nil {
+		return err
+	}
+	if priv == nil {
+		if len(keys) > 0 {
+			return fmt.Errorf("the repository %s is signed: a signing key is required", basePath)
+		}
+		return nil
+	}
+	if id := KeyID(priv.Public().(ed25519.PublicKey)); keys[id] == nil {
+		return fmt.Errorf("the key %s is not a key of the repository %s (see keygen)", id, basePath)
+	}
+	return nil
+}
+
+// SignRepo signs every index.json and manifest of the repository at basePath.
+func SignRepo(basePath string, priv ed25519.PrivateKey) (int, error) {
+	if err := repoSigningKey(basePath, priv); err != nil {
+		return 0, err
+	}
+	signed := 0
+	root := filepath.Join(basePath, "channels")
+	err := filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || filepath.Ext(p) != ".json" {
+			return nil
+		}
+		rel, err := filepath.Rel(basePath, p)
+		if err != nil {
+			return err
+		}
+		signed++
+		return SignFile(basePath, filepath.ToSlash(rel), priv)
+	})
+	return signed, err
+}
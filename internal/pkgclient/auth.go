@@ -0,0 +1,95 @@
+package pkgclient
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/SSRVodka/oh-packager/internal/common"
+	"github.com/SSRVodka/oh-packager/pkg/config"
+)
+
+// environment variables overriding the credentials of the configured repository (root_url)
+const (
+	envRepoToken    = "OHLA_REPO_TOKEN"
+	envRepoUsername = "OHLA_REPO_USERNAME"
+	envRepoPassword = "OHLA_REPO_PASSWORD"
+)
+
+// authTransport adds repository credentials to the requests it sends.
+// Requests outside of the configured repositories (e.g. redirects to a CDN) are sent as they are.
+type authTransport struct {
+	cfg  *config.Config
+	base http.RoundTripper
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") != "" || req.URL.User != nil || req.URL.Scheme == "file" {
+		return t.base.RoundTrip(req)
+	}
+	auth, ok := repoAuth(t.cfg, req.URL.String(), req.URL.Hostname())
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	// RoundTrippers must not modify the request they are given
+	req = req.Clone(req.Context())
+	if auth.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+auth.Token)
+	} else {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// repoAuth returns the credentials for url on host, in order of precedence:
+//  1. the OHLA_REPO_* environment variables, for URLs below root_url
+//  2. the `auth` entry of the config with the longest URL prefix of url
+//  3. the ~/.netrc (or $NETRC) entry of host, for URLs below a configured repository or mirror
+//     (mirrors advertised by index.json files never get credentials from the netrc)
+func repoAuth(cfg *config.Config, url, host string) (config.RepoAuth, bool) {
+	if cfg == nil {
+		return config.RepoAuth{}, false
+	}
+	inRepo := false
+	for _, repo := range (&Client{Config: cfg}).repositories() {
+		inRepo = inRepo || urlHasPrefix(url, repo.URL)
+		for _, mirror := range repo.Mirrors {
+			inRepo = inRepo || urlHasPrefix(url, mirror)
+		}
+	}
+	if cfg.RootURL != "" && urlHasPrefix(url, cfg.RootURL) {
+		env := config.RepoAuth{
+			Token:    os.Getenv(envRepoToken),
+			Username: os.Getenv(envRepoUsername),
+			Password: os.Getenv(envRepoPassword),
+		}
+		if env.Token != "" || env.Username != "" {
+			return env, true
+		}
+	}
+	best := ""
+	for prefix := range cfg.Auth {
+		if urlHasPrefix(url, prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	if best != "" {
+		auth := cfg.Auth[best]
+		if auth.Token != "" || auth.Username != "" {
+			return auth, true
+		}
+	}
+	if !inRepo {
+		return config.RepoAuth{}, false
+	}
+	if login, password, ok := common.LookupNetrc(common.NetrcPath(), host); ok && login != "" {
+		return config.RepoAuth{Username: login, Password: password}, true
+	}
+	return config.RepoAuth{}, false
+}
+
+// urlHasPrefix reports whether url is prefix or lies below it.
+func urlHasPrefix(url, prefix string) bool {
+	prefix = strings.TrimRight(prefix, "/")
+	return url == prefix || strings.HasPrefix(url, prefix+"/")
+}
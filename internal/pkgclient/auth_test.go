@@ -0,0 +1,82 @@
+package pkgclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SSRVodka/oh-packager/internal/common"
+	"github.com/SSRVodka/oh-packager/pkg/config"
+)
+
+func TestRepoCredentials(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Authorization")
+	}))
+	defer srv.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Authorization")
+	}))
+	defer other.Close()
+
+	netrc := filepath.Join(t.TempDir(), "netrc")
+	mustDo(t, os.WriteFile(netrc, []byte("macdef init\n  login nobody\n\nmachine 127.0.0.1 login alice password s3cret\n"), 0o600))
+	t.Setenv("NETRC", netrc)
+	t.Setenv(envRepoToken, "")
+	t.Setenv(envRepoUsername, "")
+	t.Setenv(envRepoPassword, "")
+
+	cfg := &config.Config{RootURL: srv.URL + "/repo"}
+	c := &Client{Config: cfg, HTTP: newHTTPClient(cfg)}
+	fetch := func(url string) string {
+		t.Helper()
+		got = ""
+		if _, err := common.FetchURL(c.HTTP, url); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	// netrc
+	if auth := fetch(srv.URL + "/repo/channels/stable/index.json"); auth != "Basic YWxpY2U6czNjcmV0" {
+		t.Fatalf("netrc credentials not sent: %q", auth)
+	}
+	// config entries take precedence, the longest prefix wins
+	cfg.Auth = map[string]config.RepoAuth{
+		srv.URL:                  {Username: "bob", Password: "pw"},
+		srv.URL + "/repo/":       {Token: "repo-token"},
+		other.URL + "/elsewhere": {Token: "other-token"},
+	}
+	if auth := fetch(srv.URL + "/repo/packages/foo.pkg"); auth != "Bearer repo-token" {
+		t.Fatalf("repo token not sent: %q", auth)
+	}
+	if auth := fetch(srv.URL + "/repository"); auth != "Basic Ym9iOnB3" {
+		t.Fatalf("prefix credentials not sent: %q", auth)
+	}
+	// environment overrides for the configured repo only
+	t.Setenv(envRepoToken, "env-token")
+	if auth := fetch(srv.URL + "/repo/packages/foo.pkg"); auth != "Bearer env-token" {
+		t.Fatalf("environment token not sent: %q", auth)
+	}
+	if auth := fetch(other.URL + "/elsewhere/foo.pkg"); auth != "Bearer other-token" {
+		t.Fatalf("credentials of other repo not sent: %q", auth)
+	}
+	// nothing leaks to other hosts
+	if auth := fetch(other.URL + "/foo.pkg"); auth != "" {
+		t.Fatalf("credentials sent to another host: %q", auth)
+	}
+}
+
+func TestLookupNetrc(t *testing.T) {
+	netrc := filepath.Join(t.TempDir(), "netrc")
+	mustDo(t, os.WriteFile(netrc, []byte("machine a.example.com login a password pa\ndefault login anon password guest\n"), 0o600))
+	if login, password, ok := common.LookupNetrc(netrc, "a.example.com"); !ok || login != "a" || password != "pa" {
+		t.Fatalf("a.example.com: %s %s %v", login, password, ok)
+	}
+	if login, _, ok := common.LookupNetrc(netrc, "b.example.com"); !ok || login != "anon" {
+		t.Fatalf("default entry not used: %s %v", login, ok)
+	}
+}
@@ -0,0 +1,254 @@
+package pkgclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SSRVodka/oh-packager/internal/common"
+	"github.com/SSRVodka/oh-packager/pkg/meta"
+	"github.com/blang/semver/v4"
+)
+
+// Packages are cached by content: Cache/sha256/<sha256>.pkg, described by Cache/sha256/<sha256>.json.
+// The same package served by several repositories is stored once.
+const cacheObjectsDir = "sha256"
+
+// cachedPackage describes a package file of the cache.
+type cachedPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Arch    string `json:"arch"`
+	SHA256  string `json:"sha256"`
+	Size    int64  `json:"size"`
+	// repository and URL (relative to it) of the index entry the package was cached for
+	Repo string `json:"repo,omitempty"`
+	URL  string `json:"url,omitempty"`
+	// URL the package was downloaded from
+	Source string    `json:"source,omitempty"`
+	Added  time.Time `json:"added"`
+	Used   time.Time `json:"used"`
+
+	// package file
+	path string
+}
+
+// cachePath returns where the package of e is cached. Entries without a checksum
+// can't be addressed by content and use the file name of their URL.
+func (c *Client) cachePath(e meta.IndexEntry) string {
+	if e.SHA256 == "" {
+		return filepath.Join(c.Cache, filepath.Base(e.URL))
+	}
+	return filepath.Join(c.Cache, cacheObjectsDir, strings.ToLower(e.SHA256)+".pkg")
+}
+
+// adoptLegacyCache moves a package cached under the file name of its URL (by older clients)
+// to its content-addressed path, if the checksum matches.
+func (c *Client) adoptLegacyCache(e meta.IndexEntry, pkgPath string) {
+	legacy := filepath.Join(c.Cache, filepath.Base(e.URL))
+	if legacy == pkgPath {
+		return
+	}
+	if ok, err := common.VerifyFileSHA256(legacy, e.SHA256); err != nil || !ok {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(pkgPath), 0o755); err != nil {
+		return
+	}
+	_ = os.Rename(legacy, pkgPath)
+}
+
+// touchCached records that the package of e, cached at pkgPath, was used.
+// source is the URL it was just downloaded from (empty for cache hits).
+func (c *Client) touchCached(e meta.IndexEntry, pkgPath, source string) {
+	if e.SHA256 == "" {
+		return
+	}
+	metaPath := strings.TrimSuffix(pkgPath, ".pkg") + ".json"
+	now := time.Now().UTC()
+	var p cachedPackage
+	if b, err := os.ReadFile(metaPath); err != nil || json.Unmarshal(b, &p) != nil {
+		p = cachedPackage{Added: now}
+	}
+	p.Name, p.Version, p.Arch, p.SHA256, p.Repo, p.URL = e.Name, e.Version, e.Arch, strings.ToLower(e.SHA256), e.Repo, e.URL
+	if info, err := os.Stat(pkgPath); err == nil {
+		p.Size = info.Size()
+	}
+	if source != "" {
+		p.Source = common.RedactURL(source)
+	}
+	p.Used = now
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(metaPath, b)
+	}
+	if err != nil {
+		c.logf(" - WARN: failed to record cached package '%s': %v\n", e.Name, err)
+	}
+}
+
+// cachedPackages lists the content-addressed packages of the cache. Packages without
+// a description (e.g. interrupted while caching) only have their checksum, size and dates.
+func (c *Client) cachedPackages() ([]cachedPackage, error) {
+	dir := filepath.Join(c.Cache, cacheObjectsDir)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	list := []cachedPackage{}
+	for _, de := range entries {
+		if de.IsDir() || filepath.Ext(de.Name()) != ".pkg" {
+			continue
+		}
+		pkgPath := filepath.Join(dir, de.Name())
+		info, err := de.Info()
+		if err != nil {
+			return nil, err
+		}
+		p := cachedPackage{SHA256: strings.TrimSuffix(de.Name(), ".pkg"), Added: info.ModTime(), Used: info.ModTime()}
+		if b, err := os.ReadFile(strings.TrimSuffix(pkgPath, ".pkg") + ".json"); err == nil {
+			if err := json.Unmarshal(b, &p); err != nil {
+				return nil, fmt.Errorf("invalid description of cached package %s: %v", de.Name(), err)
+			}
+		}
+		p.Size, p.path = info.Size(), pkgPath
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		if list[i].Arch != list[j].Arch {
+			return list[i].Arch < list[j].Arch
+		}
+		vi, _ := semver.ParseTolerant(list[i].Version)
+		vj, _ := semver.ParseTolerant(list[j].Version)
+		return vi.GT(vj)
+	})
+	return list, nil
+}
+
+// removeCached removes a cached package and its description.
+func removeCached(p cachedPackage) error {
+	if err := os.Remove(p.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(strings.TrimSuffix(p.path, ".pkg") + ".json"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// CacheList prints the cached packages and the size of the cache.
+func (c *Client) CacheList() error {
+	list, err := c.cachedPackages()
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		fmt.Println("the package cache is empty")
+		return nil
+	}
+	var total int64
+	for _, p := range list {
+		name := p.Name
+		if name == "" {
+			name = "(unknown)"
+		}
+		fmt.Printf("%s\t%s\t%s\t%d bytes\tsha256:%.12s\tused %s\n", name, p.Version, p.Arch, p.Size, p.SHA256, p.Used.Local().Format("2006-01-02 15:04"))
+		total += p.Size
+	}
+	fmt.Printf("%d packages, %d bytes in %s\n", len(list), total, c.Cache)
+	return nil
+}
+
+// CacheClean removes every cached package, including partial downloads.
+func (c *Client) CacheClean() error {
+	entries, err := os.ReadDir(c.Cache)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, de := range entries {
+		if err := os.RemoveAll(filepath.Join(c.Cache, de.Name())); err != nil {
+			return err
+		}
+	}
+	fmt.Println("package cache cleaned:", c.Cache)
+	return nil
+}
+
+// CachePrune removes cached packages beyond the keepLatest latest versions of each package
+// (0: no limit) and/or not used for olderThan (0: no limit). With both limits, only packages
+// exceeding both are removed. Partial downloads older than olderThan are removed too.
+func (c *Client) CachePrune(keepLatest int, olderThan time.Duration) error {
+	if keepLatest <= 0 && olderThan <= 0 {
+		return errors.New("use --keep-latest and/or --older-than (or `ohla cache clean`)")
+	}
+	list, err := c.cachedPackages()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	seen := map[string]int{}
+	removed := 0
+	var freed int64
+	for _, p := range list {
+		// list is sorted by name and arch, latest versions first
+		key := p.Name + "/" + p.Arch
+		seen[key]++
+		remove := keepLatest <= 0 || (p.Name != "" && seen[key] > keepLatest)
+		if olderThan > 0 {
+			remove = remove && now.Sub(p.Used) > olderThan
+		}
+		if !remove {
+			continue
+		}
+		if err := removeCached(p); err != nil {
+			return err
+		}
+		fmt.Printf(" - removed %s %s (%s)\n", p.Name, p.Version, p.Arch)
+		removed++
+		freed += p.Size
+	}
+	if olderThan > 0 {
+		parts, _ := filepath.Glob(filepath.Join(c.Cache, cacheObjectsDir, "*.part"))
+		for _, part := range parts {
+			if info, err := os.Stat(part); err == nil && now.Sub(info.ModTime()) > olderThan {
+				if err := os.Remove(part); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	fmt.Printf("%d cached packages removed, %d bytes freed\n", removed, freed)
+	return nil
+}
+
+// ParseAge parses durations like time.ParseDuration, with days ("30d") in addition.
+func ParseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration '%s'", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration '%s' (e.g. 30d, 12h)", s)
+	}
+	return d, nil
+}
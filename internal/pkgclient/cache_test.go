@@ -0,0 +1,124 @@
+package pkgclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SSRVodka/oh-packager/pkg/config"
+	"github.com/SSRVodka/oh-packager/pkg/meta"
+)
+
+func cacheEntry(name, version, content string) meta.IndexEntry {
+	sum := sha256.Sum256([]byte(content))
+	return meta.IndexEntry{Name: name, Version: version, Arch: "aarch64", OhosApi: "12",
+		URL: "packages/" + name + "-" + version + ".pkg", SHA256: hex.EncodeToString(sum[:])}
+}
+
+func TestOfflineInstallsFromCache(t *testing.T) {
+	zlib, curl := cacheEntry("zlib", "1.3.1", "zlib content"), cacheEntry("curl", "8.9.0", "curl content")
+	public := serveIndex(t, "stable", zlib, curl)
+	// the same package file served by another repository
+	team := serveIndex(t, "stable", zlib)
+	for _, srv := range []*http.Server{public.Config, team.Config} {
+		mux := srv.Handler.(*http.ServeMux)
+		mux.HandleFunc("/packages/zlib-1.3.1.pkg", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("zlib content")) })
+	}
+
+	cfg := &config.Config{RootURL: public.URL, Channel: "stable", AllowUnsigned: true,
+		Repos: []config.RepoConfig{{Name: "team", URL: team.URL, Priority: 10, AllowUnsigned: true}}}
+	c := &Client{Config: cfg, Cache: t.TempDir(), IndexDir: t.TempDir(), HTTP: public.Client()}
+	idx, err := c.loadIndex()
+	if err != nil {
+		t.Fatalf("loadIndex failed: %v", err)
+	}
+	paths := map[string]bool{}
+	for _, e := range idx.Packages {
+		if e.Name != "zlib" {
+			continue
+		}
+		pkgPath, _, err := c.download(context.Background(), e)
+		if err != nil {
+			t.Fatalf("download from %s failed: %v", e.Repo, err)
+		}
+		paths[pkgPath] = true
+	}
+	if len(paths) != 1 {
+		t.Fatalf("identical packages cached %d times", len(paths))
+	}
+
+	public.Close()
+	team.Close()
+	c.Offline = true
+	idx, err = c.loadIndex()
+	if err != nil || len(idx.Packages) != 3 {
+		t.Fatalf("offline index: %v", err)
+	}
+	chosen, _, err := resolveWithPins(idx, []string{"zlib"}, "aarch64", "12", nil)
+	if err != nil {
+		t.Fatalf("offline resolution failed: %v", err)
+	}
+	if _, _, err := c.download(context.Background(), chosen["zlib"]); err != nil {
+		t.Fatalf("cached package not used offline: %v", err)
+	}
+	if _, _, err := c.download(context.Background(), curl); err == nil {
+		t.Fatalf("package downloaded offline")
+	}
+
+	// indexes fetched from another URL are not used
+	cfg.RootURL = "http://elsewhere.invalid"
+	if _, err := c.loadIndex(); err == nil {
+		t.Fatalf("index of another repository used offline")
+	}
+}
+
+func TestCachePrune(t *testing.T) {
+	c := &Client{Cache: t.TempDir()}
+	cache := func(e meta.IndexEntry) {
+		t.Helper()
+		pkgPath := c.cachePath(e)
+		mustDo(t, os.MkdirAll(filepath.Dir(pkgPath), 0o755))
+		mustDo(t, os.WriteFile(pkgPath, []byte(e.Name+e.Version), 0o644))
+		c.touchCached(e, pkgPath, "")
+	}
+	for _, v := range []string{"1.2.0", "1.10.0", "1.11.0"} {
+		cache(cacheEntry("zlib", v, "zlib "+v))
+	}
+	cache(cacheEntry("curl", "8.9.0", "curl 8.9.0"))
+	versions := func() []string {
+		t.Helper()
+		list, err := c.cachedPackages()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, p := range list {
+			got = append(got, p.Name+" "+p.Version)
+		}
+		return got
+	}
+
+	mustDo(t, c.CachePrune(2, 0))
+	if got := versions(); len(got) != 3 || got[1] != "zlib 1.11.0" || got[2] != "zlib 1.10.0" {
+		t.Fatalf("after --keep-latest 2: %v", got)
+	}
+	mustDo(t, c.CachePrune(0, time.Hour))
+	if got := versions(); len(got) != 3 {
+		t.Fatalf("recently used packages pruned: %v", got)
+	}
+	mustDo(t, c.CachePrune(1, time.Nanosecond))
+	if got := versions(); len(got) != 2 {
+		t.Fatalf("after --keep-latest 1 --older-than 1ns: %v", got)
+	}
+	if err := c.CachePrune(0, 0); err == nil {
+		t.Fatalf("prune without limits accepted")
+	}
+	if d, err := ParseAge("30d"); err != nil || d != 30*24*time.Hour {
+		t.Fatalf("30d parsed as %v, %v", d, err)
+	}
+}
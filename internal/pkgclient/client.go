@@ -1,20 +1,22 @@
 package pkgclient
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/SSRVodka/oh-packager/internal/common"
 	"github.com/SSRVodka/oh-packager/pkg/config"
 	"github.com/SSRVodka/oh-packager/pkg/meta"
-	"github.com/blang/semver/v4"
 )
 
 // Client holds runtime info.
@@ -23,6 +25,26 @@ type Client struct {
 	Cache  string
 	DBPath string
 	HTTP   *http.Client
+	// local copies of the repository indexes (see Update)
+	IndexDir string
+
+	// globs of prefix-relative paths that installations may overwrite despite file conflicts
+	Overwrite []string
+	// whether package lifecycle scripts run (ScriptsAsk, ScriptsNever or ScriptsTrusted)
+	ScriptPolicy string
+	// installations only show their InstallPlan
+	DryRun bool
+	// when set, dry-run plans are written to it as JSON instead of being printed
+	PlanJSON io.Writer
+	// progress and warning messages of installations (os.Stdout if nil)
+	Log io.Writer
+	// resolve against the last fetched indexes and install from the cache only
+	Offline bool
+
+	// repository name -> mirrors advertised by its index; mirror base URL -> measured latency
+	mirrorMu   sync.Mutex
+	advertised map[string][]string
+	latency    map[string]time.Duration
 }
 
 // NewClient constructs client with default cache/db paths under config dir.
@@ -32,43 +54,46 @@ func NewClient(cfg *config.Config) *Client {
 	db := filepath.Join(cfgDir, "installed.db")
 	_ = os.MkdirAll(cache, 0o755)
 	return &Client{
-		Config: cfg,
-		Cache:  cache,
-		DBPath: db,
-		HTTP:   &http.Client{},
+		Config:   cfg,
+		Cache:    cache,
+		DBPath:   db,
+		HTTP:     newHTTPClient(cfg),
+		IndexDir: filepath.Join(cfgDir, "indexes"),
+
+		ScriptPolicy: ScriptsAsk,
 	}
 }
 
-// ListPackages fetches index.json and prints packages for arch.
-func (c *Client) ListPackages(arch string) error {
-	if c.Config.RootURL == "" {
-		return errors.New("repo URL not configured (use --help for more info)")
-	}
-	// Some deployments put channels directly under root; try both patterns.
-	// Try root/channels/<channel>/index.json
-	tryURLs := []string{
-		fmt.Sprintf("%s/channels/%s/index.json", strings.TrimRight(c.Config.RootURL, "/"), c.Config.Channel),
-		fmt.Sprintf("%s/%s/channels/%s/index.json", strings.TrimRight(c.Config.RootURL, "/"), "repo", c.Config.Channel),
-	}
-	var idxBytes []byte
-	var err error
-	for _, u := range tryURLs {
-		idxBytes, err = common.FetchURL(c.HTTP, u)
-		if err == nil {
-			break
-		}
-	}
-	if err != nil {
-		return fmt.Errorf("failed fetching index.json: %w", err)
+// logf writes a progress or warning message to c.Log.
+func (c *Client) logf(format string, args ...any) {
+	w := c.Log
+	if w == nil {
+		w = os.Stdout
 	}
+	fmt.Fprintf(w, format, args...)
+}
 
-	var idx meta.Index
-	if err := json.Unmarshal(idxBytes, &idx); err != nil {
+// ListPackages prints the preferred version of each package for arch, from the local indexes.
+func (c *Client) ListPackages(arch string) error {
+	return c.printPackages(arch, func(string) bool { return true })
+}
+
+// SearchPackages prints the preferred version of each package for arch whose name contains
+// pattern (case-insensitive), from the local indexes.
+func (c *Client) SearchPackages(pattern, arch string) error {
+	pattern = strings.ToLower(pattern)
+	return c.printPackages(arch, func(name string) bool { return strings.Contains(strings.ToLower(name), pattern) })
+}
+
+// printPackages prints the preferred version of each package for arch whose name matches.
+func (c *Client) printPackages(arch string, match func(name string) bool) error {
+	idx, err := c.loadIndex()
+	if err != nil {
 		return err
 	}
 	entries := []meta.IndexEntry{}
 	for _, e := range idx.Packages {
-		if e.Arch == arch {
+		if e.Arch == arch && match(e.Name) {
 			entries = append(entries, e)
 		}
 	}
@@ -76,7 +101,7 @@ func (c *Client) ListPackages(arch string) error {
 		fmt.Println("no packages for", arch)
 		return nil
 	}
-	// Group by name and list latest version first
+	// Group by name and list the preferred (highest priority, then latest) version first
 	byName := map[string][]meta.IndexEntry{}
 	for _, e := range entries {
 		byName[e.Name] = append(byName[e.Name], e)
@@ -86,102 +111,119 @@ func (c *Client) ListPackages(arch string) error {
 		names = append(names, n)
 	}
 	sort.Strings(names)
+	rank := repoRanks(idx)
+	multiRepo := len(c.repositories()) > 1
 	for _, n := range names {
 		list := byName[n]
-		// sort by semver desc
-		sort.Slice(list, func(i, j int) bool {
-			vi, _ := semver.ParseTolerant(list[i].Version)
-			vj, _ := semver.ParseTolerant(list[j].Version)
-			return vi.GT(vj)
-		})
+		sortCandidates(list, rank)
 		latest := list[0]
-		fmt.Printf("%s\t%s\tAPI: %s\t%s\n", latest.Name, latest.Version, latest.OhosApi, latest.URL)
+		if multiRepo {
+			fmt.Printf("%s\t%s\tAPI: %s\t[%s] %s\n", latest.Name, latest.Version, latest.OhosApi, latest.Repo, latest.URL)
+		} else {
+			fmt.Printf("%s\t%s\tAPI: %s\t%s\n", latest.Name, latest.Version, latest.OhosApi, latest.URL)
+		}
 	}
 	return nil
 }
 
-/** @return (pkgFilePath, pkgVersion, error) */
-func (c *Client) download(choice meta.IndexEntry) (string, string, error) {
+/** @return (pkgFilePath, URL the package was downloaded from (empty if cached), error) */
+func (c *Client) download(ctx context.Context, choice meta.IndexEntry) (string, string, error) {
 	// download package
-	pkgURL := common.JoinURL(c.Config.RootURL, choice.URL)
-	pkgPath := filepath.Join(c.Cache, filepath.Base(choice.URL))
+	pkgPath := c.cachePath(choice)
+	if _, err := os.Stat(pkgPath); err != nil {
+		c.adoptLegacyCache(choice, pkgPath)
+	}
 
-	_, err := os.Stat(pkgPath)
-	shouldDownload := os.IsNotExist(err)
-	if !shouldDownload {
+	if _, err := os.Stat(pkgPath); err == nil {
 		// check checksum of downloaded packages
 		ok, err := common.VerifyFileSHA256(pkgPath, choice.SHA256)
 		if err != nil {
 			return "", "", err
 		}
-		if !ok {
-			// download to refresh
-			fmt.Printf("the checksum of package '%s' in cache missmatch: download it\n", choice.Name)
-			rmErr := os.Remove(pkgPath)
-			if rmErr != nil {
-				fmt.Printf("WARN: failed to remove outdated package '%s': %v\n", pkgPath, rmErr)
-			}
-			shouldDownload = true
+		if ok {
+			c.touchCached(choice, pkgPath, "")
+			return pkgPath, "", nil
 		}
+		// download to refresh
+		c.logf("the checksum of package '%s' in cache missmatch: download it\n", choice.Name)
+		if rmErr := os.Remove(pkgPath); rmErr != nil {
+			c.logf("WARN: failed to remove outdated package '%s': %v\n", pkgPath, rmErr)
+		}
+	}
+
+	if c.Offline {
+		return "", "", fmt.Errorf("package '%s' %s is not in the cache (offline mode)", choice.Name, choice.Version)
 	}
 
-	if shouldDownload {
-		fmt.Println(" - downloading", pkgURL)
-		if err := common.DownloadToFile(c.HTTP, pkgURL, pkgPath); err != nil {
+	// try the repository, then its mirrors: the checksum is verified while downloading,
+	// so whatever mirror serves the package, it is the one of the index
+	bases := c.mirrorBases(c.findRepo(choice.Repo))
+	var lastErr error
+	for _, base := range bases {
+		pkgURL := common.JoinURL(base, choice.URL)
+		c.logf(" - downloading %s\n", common.RedactURL(pkgURL))
+		err := common.DownloadToFileSHA256(ctx, c.HTTP, pkgURL, pkgPath, choice.SHA256)
+		if err == nil {
+			c.touchCached(choice, pkgPath, pkgURL)
+			return pkgPath, pkgURL, nil
+		}
+		if ctx.Err() != nil || len(bases) == 1 {
 			return "", "", err
 		}
+		c.logf(" - WARN: %v\n", err)
+		lastErr = err
 	}
-	// verify checksum
-	ok, err := common.VerifyFileSHA256(pkgPath, choice.SHA256)
-	if err != nil {
-		return "", "", err
-	}
-	if !ok {
-		return "", "", fmt.Errorf("checksum mismatch for %s", pkgPath)
-	}
-	return pkgPath, choice.Version, nil
+	return "", "", fmt.Errorf("no mirror could serve package '%s' (%d tried), last error: %v", choice.Name, len(bases), lastErr)
 }
 
-// extract components (`common.GetInstallComponents()`) to `prefix`
-//
-// @return (extraction temp dir, error)
-func (c *Client) extract(pkgPath, pkgName, pkgVersion, prefix string) (string, error) {
-	// extract to prefix/<name>-<version>.tmp
-	tmpDir := filepath.Join(prefix, fmt.Sprintf(".%s-%s.tmp", pkgName, pkgVersion))
-
-	if err := os.MkdirAll(prefix, 0o755); err != nil {
-		return tmpDir, err
-	}
-	// cleanup any previous tmp
-	_ = os.RemoveAll(tmpDir)
-	if err := common.ExtractTarGz(pkgPath, tmpDir); err != nil {
-		return tmpDir, err
-	}
-	// copy components
-	for _, component := range common.GetInstallComponents() {
-		srcDir := filepath.Join(tmpDir, component)
-		dstDir := filepath.Join(prefix, component)
-		if !common.IsDirExists(srcDir) {
-			if !common.IsOptionalInstallComponent(component) {
-				fmt.Printf(" - WARN: package '%s' doesn't have component '%s'\n", pkgName, component)
+// downloadResult is the outcome of one download started by startDownloads.
+type downloadResult struct {
+	pkgPath string
+	// URL the package was downloaded from (empty if cached)
+	source string
+	err    error
+}
+
+// defaultDownloadJobs is the number of concurrent downloads when config.Config.DownloadJobs is unset.
+const defaultDownloadJobs = 4
+
+// startDownloads downloads entries concurrently, at most DownloadJobs at a time.
+// The i-th channel receives the result of entries[i]; wait blocks until every download has ended.
+func (c *Client) startDownloads(ctx context.Context, entries []meta.IndexEntry) (results []<-chan downloadResult, wait func()) {
+	jobs := defaultDownloadJobs
+	if c.Config != nil && c.Config.DownloadJobs > 0 {
+		jobs = c.Config.DownloadJobs
+	}
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for _, e := range entries {
+		ch := make(chan downloadResult, 1)
+		results = append(results, ch)
+		wg.Add(1)
+		go func(e meta.IndexEntry) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				ch <- downloadResult{err: ctx.Err()}
+				return
 			}
-			continue
-		}
-		fmt.Printf(" - copying %s -> %s\n", srcDir, dstDir)
-		if err := common.CopyDirContents(srcDir, dstDir); err != nil {
-			return tmpDir, fmt.Errorf("failed to extract component '%s': %v", component, err)
-		}
+			defer func() { <-sem }()
+			pkgPath, source, err := c.download(ctx, e)
+			ch <- downloadResult{pkgPath: pkgPath, source: source, err: err}
+		}(e)
 	}
-	return tmpDir, nil
+	return results, wg.Wait
 }
 
 // @param[in] prefix only valid when toSdk == false
+// @param[in] serverArch arch of packages installed from server (empty for the configured arch)
 //
 // @return (finalDir, error)
 //
 // @note prefix must be an absolute path
 // @note noResolve == true will disable network. You can only use local file in this mode
-func (c *Client) install(pkgNameOrLocalFileList []string, prefix string, noConfirm bool, noResolve bool) error {
+func (c *Client) install(pkgNameOrLocalFileList []string, serverArch string, prefix string, noConfirm bool, noResolve bool) error {
 
 	var localSdkInfo *meta.OhosSdkInfo
 	var loadSdkErr error
@@ -189,13 +231,16 @@ func (c *Client) install(pkgNameOrLocalFileList []string, prefix string, noConfi
 		return loadSdkErr
 	}
 
-	if c.Config.RootURL == "" {
-		return fmt.Errorf("repo URL not configured (use --help for more info)")
+	if err := c.checkRepos(); err != nil {
+		return err
 	}
 
 	if len(pkgNameOrLocalFileList) == 0 {
 		return fmt.Errorf("empty install list")
 	}
+	if err := validateOverwriteGlobs(c.Overwrite); err != nil {
+		return err
+	}
 
 	lastArch := ""
 	name2pkgPath := map[string]string{}
@@ -233,7 +278,10 @@ func (c *Client) install(pkgNameOrLocalFileList []string, prefix string, noConfi
 		} else {
 			// install from server using pkgName
 			pkgName = pkgNameOrLocalFile
-			arch = common.DefaultArch()
+			arch = serverArch
+			if arch == "" {
+				arch = common.DefaultArch()
+			}
 		}
 
 		// check arch consistency
@@ -264,7 +312,7 @@ func (c *Client) install(pkgNameOrLocalFileList []string, prefix string, noConfi
 	} else {
 		// Resolve dependencies (returns chosen versions map)
 		// assert lastArch != ""
-		fmt.Printf("Resolving dependencies...\n")
+		c.logf("Resolving dependencies...\n")
 		var resolveErr error
 		chosen, resolveErr = c.ResolveDependencies(pkgs, lastArch)
 		if resolveErr != nil {
@@ -272,17 +320,30 @@ func (c *Client) install(pkgNameOrLocalFileList []string, prefix string, noConfi
 		}
 	}
 
+	if c.DryRun {
+		plan, planErr := c.planInstall(chosen, name2pkgPath, pkgs, lastArch, localSdkInfo.ApiVersion, prefix)
+		if planErr != nil {
+			return planErr
+		}
+		if c.PlanJSON != nil {
+			return plan.WriteJSON(c.PlanJSON)
+		}
+		plan.Print()
+		return nil
+	}
+
 	// ask for confirmation
 	if !noConfirm {
+		order := c.installOrder(chosen)
 		fmt.Printf("We are going to install (%s, API %s): \n", lastArch, localSdkInfo.ApiVersion)
-		for name, e := range chosen {
-			fmt.Printf(" - %s (%s)\n", name, e.Version)
+		for _, name := range order {
+			fmt.Printf(" - %s (%s)\n", name, chosen[name].Version)
 		}
 		fmt.Printf("--------------------------\n")
 		fmt.Printf("Install Prefix: %s\n", prefix)
 		fmt.Printf("--------------------------\n")
 		ok, confirmErr := common.ConfirmAction(
-			"Installation is irrevisible. Make sure to check your prefix before you proceed. (Y/[n]) ")
+			"Make sure to check your prefix before you proceed. (Y/[n]) ")
 		if confirmErr != nil {
 			return confirmErr
 		}
@@ -292,115 +353,7 @@ func (c *Client) install(pkgNameOrLocalFileList []string, prefix string, noConfi
 		}
 	}
 
-	// // open DB once
-	// db, err := OpenDB(c.DBPath)
-	// if err != nil {
-	// 	return err
-	// }
-	// defer db.Close()
-
-	for name, entry := range chosen {
-		fmt.Printf("Preparing %s %s\n", name, entry.Version)
-
-		// // check installed
-		// installed, err := db.GetInstalled(name, prefix)
-		// if err != nil {
-		// 	return err
-		// }
-		// if installed != nil && installed.Version == entry.Version {
-		// 	fmt.Printf(" - %s already installed at same version %s, skipping\n", name, entry.Version)
-		// 	continue
-		// }
-		// if installed != nil && installed.Version != entry.Version {
-		// 	// uninstall previous
-		// 	if err := c.uninstallDB(db, name, prefix); err != nil {
-		// 		return err
-		// 	}
-		// 	fmt.Printf(" - removed previous version %s\n", installed.Version)
-		// }
-
-		var curPkgPath, curPkgVer string
-		if f, ok := name2pkgPath[name]; !ok {
-			var derr error
-			curPkgPath, curPkgVer, derr = c.download(entry)
-			if derr != nil {
-				return derr
-			}
-			name2pkgPath[name] = curPkgPath
-		} else {
-			curPkgPath = f
-			curPkgVer = entry.Version
-			fmt.Printf(" - using local file: %s\n", curPkgPath)
-		}
-
-		fmt.Printf("Extracting %s %s\n", name, curPkgVer)
-		tmpDir, exErr := c.extract(curPkgPath, name, curPkgVer, prefix)
-		if exErr != nil {
-			return exErr
-		}
-
-		// patch libraries for development
-		archDepRelPath, archErr := common.GetOhosArchDepLibDirRelPath(entry.Arch)
-		if archErr != nil {
-			return archErr
-		}
-		dstArchLibDir := filepath.Join(prefix, archDepRelPath)
-		fmt.Printf("Patching libraries of package '%s'\n", name)
-		c.patchLibFilesForCurrentInstallation(dstArchLibDir, prefix)
-		// patch shared files like xorg libraries
-		shareDir := filepath.Join(prefix, common.GetOhosSharedDirRelPath())
-		if common.IsDirExists(shareDir) {
-			// try to patch
-			c.patchLibFilesForCurrentInstallation(shareDir, prefix)
-		}
-		// patch arch-dependent libs under arch-independent dir
-		irregular, readErr := common.IsArchDepLibInArchIndepDir(prefix)
-		if readErr != nil {
-			return readErr
-		}
-		if irregular {
-			fmt.Println(
-				"WARN: current libraries install architecture-dependent library under architecture-independent directory, " +
-					"and it may break your SDK env if you use different architectures. Take care of it")
-			dstArchIndepLibDir := filepath.Join(prefix, common.GetOhosArchIndepLibDirRelPath())
-			c.patchLibFilesForCurrentInstallation(dstArchIndepLibDir, prefix)
-		}
-
-		// executing script attachments
-		if common.IsDirExists(tmpDir) {
-			postInstScriptPath, found := common.GetPostInstScriptPath(tmpDir)
-			if found {
-				// execute it with install prefix
-				fmt.Printf("Executing post-installation script...\n")
-				outStr, exeErr := common.ExecuteShell(postInstScriptPath, prefix)
-				if exeErr != nil {
-					return exeErr
-				}
-				fmt.Println("##################################")
-				if strings.TrimSpace(outStr) == "" {
-					fmt.Print("(empty output)")
-				} else {
-					fmt.Print(outStr)
-				}
-				fmt.Println("\n##################################")
-			}
-			// clean up temporary directory
-			fmt.Println("Cleaning temporary files...")
-			// ignore errors
-			os.RemoveAll(tmpDir)
-		}
-
-		// // record in DB
-		// if err := db.InsertInstalled(name, curPkgVer, entry.Arch, prefix, finalDir); err != nil {
-		// 	return err
-		// }
-
-		fmt.Printf("Installed %s %s -> %s\n\n", name, curPkgVer, prefix)
-	}
-
-	fmt.Printf("\nFinish installation: %d packages installed\n\n", len(chosen))
-
-	return nil
+	return c.installChosen(chosen, name2pkgPath, nil, prefix)
 }
 
 // for normal installation: use tgtLibdir == installLibdir
@@ -416,7 +369,7 @@ func (c *Client) patchLibFilesForCurrentInstallation(libdir, installPrefix strin
 // NOTE: libdir and installPrefix must be absolute paths
 func (c *Client) PatchLibFiles(tgtLibdir, installLibdir, installPrefix string) error {
 	if !common.IsDirExists(tgtLibdir) {
-		fmt.Printf(" - WARN: specific directory '%s' not exists while patching libraries. Skipped\n", tgtLibdir)
+		c.logf(" - WARN: specific directory '%s' not exists while patching libraries. Skipped\n", tgtLibdir)
 		return nil
 	}
 
@@ -438,11 +391,11 @@ func (c *Client) PatchLibFiles(tgtLibdir, installLibdir, installPrefix string) e
 			continue
 		}
 		if !info.Mode().IsRegular() {
-			fmt.Printf(" - skip irregular file '%s'", info.Name())
+			c.logf(" - skip irregular file '%s'\n", info.Name())
 			continue
 		}
 
-		fmt.Printf(" - patching library archive file generated by libtool: %s\n", la)
+		c.logf(" - patching library archive file generated by libtool: %s\n", la)
 
 		content, readErr := os.ReadFile(la)
 		if readErr != nil {
@@ -480,11 +433,11 @@ func (c *Client) PatchLibFiles(tgtLibdir, installLibdir, installPrefix string) e
 			continue
 		}
 		if !info.Mode().IsRegular() {
-			fmt.Printf(" - skip irregular file '%s'", info.Name())
+			c.logf(" - skip irregular file '%s'\n", info.Name())
 			continue
 		}
 
-		fmt.Printf(" - patching pkg-config file generated by Makefile: %s\n", pc)
+		c.logf(" - patching pkg-config file generated by Makefile: %s\n", pc)
 
 		contentBytes, readErr := os.ReadFile(pc)
 		if readErr != nil {
@@ -522,12 +475,36 @@ func (c *Client) ResolveDependencies(requested []string, arch string) (map[strin
 	if err != nil {
 		return nil, err
 	}
+	return c.resolveDependencies(idx, requested, arch, nil)
+}
+
+// resolveDependencies resolves requested against idx. For names in preferred, the preferred
+// version is picked when it satisfies the constraints instead of the latest one. A preferred
+// version that turns out to conflict with a package resolved later is dropped and resolution restarts.
+func (c *Client) resolveDependencies(idx *meta.Index, requested []string, arch string, preferred map[string]string) (map[string]meta.IndexEntry, error) {
 	// load local sdk info
 	sdkInfo, err := common.LoadLocalSdkInfo(c.Config.OhosSdk)
 	if err != nil {
 		return nil, err
 	}
+	pins := make(map[string]string, len(preferred))
+	for name, version := range preferred {
+		pins[name] = version
+	}
+	for {
+		chosen, conflicting, err := resolveWithPins(idx, requested, arch, sdkInfo.ApiVersion, pins)
+		if _, pinned := pins[conflicting]; err != nil && pinned {
+			delete(pins, conflicting)
+			continue
+		}
+		return chosen, err
+	}
+}
 
+// resolveWithPins is one resolution pass of resolveDependencies.
+//
+// @return (chosen entries, name of the already chosen package a constraint conflicted with, error)
+func resolveWithPins(idx *meta.Index, requested []string, arch, sdkApi string, preferred map[string]string) (map[string]meta.IndexEntry, string, error) {
 	// build entries-by-name map from index
 	byName := map[string][]meta.IndexEntry{}
 	for _, e := range idx.Packages {
@@ -536,13 +513,10 @@ func (c *Client) ResolveDependencies(requested []string, arch string) (map[strin
 		}
 		byName[e.Name] = append(byName[e.Name], e)
 	}
-	// sort each list by semver descending
+	// sort each list by repository priority, then by semver descending
+	rank := repoRanks(idx)
 	for _, list := range byName {
-		sort.SliceStable(list, func(i, j int) bool {
-			vi, _ := semver.ParseTolerant(list[i].Version)
-			vj, _ := semver.ParseTolerant(list[j].Version)
-			return vi.GT(vj)
-		})
+		sortCandidates(list, rank)
 	}
 
 	// constraints map: name -> []Constraint
@@ -558,13 +532,13 @@ func (c *Client) ResolveDependencies(requested []string, arch string) (map[strin
 		}
 		depName, depConstraints, depErr := parseDependencySpec(r)
 		if depErr != nil {
-			return nil, fmt.Errorf("error while resolving dependencies for '%s': %+v", r, depErr)
+			return nil, "", fmt.Errorf("error while resolving dependencies for '%s': %+v", r, depErr)
 		}
 		oldConstraints, hasConstraints := constraints[depName]
 		constraints[depName] = append(oldConstraints, depConstraints...)
 		if hasConstraints {
 			if chosenEntry, ok := chosen[depName]; ok && !common.SatisfiesConstraints(chosenEntry.Version, constraints[depName]) {
-				return nil, fmt.Errorf("resolved package %s %s conflicts with requested constraints %s", depName, chosenEntry.Version, formatRequirements(depName, requirementsFromConstraints(constraints[depName], "install request")))
+				return nil, depName, fmt.Errorf("resolved package %s %s conflicts with requested constraints %s", depName, chosenEntry.Version, formatRequirements(depName, requirementsFromConstraints(constraints[depName], "install request")))
 			}
 		} else {
 			// first time check for depName: add to queue
@@ -586,22 +560,32 @@ func (c *Client) ResolveDependencies(requested []string, arch string) (map[strin
 		// find candidates for this name
 		candList := byName[name]
 		if len(candList) == 0 {
-			return nil, fmt.Errorf("dependency %q not found in index", name)
+			return nil, "", fmt.Errorf("dependency %q not found in index", name)
 		}
-		// pick first (latest) candidate satisfying constraints[name]
+		// pick first (highest priority, latest) candidate satisfying constraints[name]
 		curConstraints := constraints[name]
 		var chosenEntry *meta.IndexEntry
 		for _, e := range candList {
-			if common.SatisfiesConstraints(e.Version, curConstraints) && e.OhosApi == sdkInfo.ApiVersion {
+			if common.SatisfiesConstraints(e.Version, curConstraints) && e.OhosApi == sdkApi {
 				tmp := e
 				chosenEntry = &tmp
 				break
 			}
 		}
+		// keep the preferred version if it is still acceptable
+		if pref, ok := preferred[name]; ok && chosenEntry != nil && chosenEntry.Version != pref {
+			for _, e := range candList {
+				if e.Version == pref && common.SatisfiesConstraints(e.Version, curConstraints) && e.OhosApi == sdkApi {
+					tmp := e
+					chosenEntry = &tmp
+					break
+				}
+			}
+		}
 		if chosenEntry == nil {
 			// no candidate found
-			return nil, fmt.Errorf("no version of %s satisfies constraints %+v and OHOS API %s",
-				name, curConstraints, sdkInfo.ApiVersion)
+			return nil, "", fmt.Errorf("no version of %s satisfies constraints %+v and OHOS API %s",
+				name, curConstraints, sdkApi)
 		}
 
 		// select it
@@ -613,7 +597,7 @@ func (c *Client) ResolveDependencies(requested []string, arch string) (map[strin
 		for _, dep := range curDeps {
 			depName, depConstraints, parseErr := parseDependencySpec(dep)
 			if parseErr != nil {
-				return nil, fmt.Errorf("error while resolving dependencies for '%s': %+v", dep, parseErr)
+				return nil, "", fmt.Errorf("error while resolving dependencies for '%s': %+v", dep, parseErr)
 			}
 			// append constraint
 			cur := constraints[depName]
@@ -623,88 +607,129 @@ func (c *Client) ResolveDependencies(requested []string, arch string) (map[strin
 			}
 			constraints[depName] = append(cur, depConstraints...)
 			if selectedEntry, ok := chosen[depName]; ok && !common.SatisfiesConstraints(selectedEntry.Version, constraints[depName]) {
-				return nil, fmt.Errorf("resolved package %s %s conflicts with dependency constraints %s", depName, selectedEntry.Version, formatRequirements(depName, requirementsFromConstraints(constraints[depName], "install dependency")))
+				return nil, depName, fmt.Errorf("resolved package %s %s conflicts with dependency constraints %s", depName, selectedEntry.Version, formatRequirements(depName, requirementsFromConstraints(constraints[depName], "install dependency")))
 			}
 		}
 	}
 
-	return chosen, nil
+	return chosen, "", nil
 }
 
-// Install downloads and installs the named package into OHOS sdk
-func (c *Client) InstallToSdk(pkgNameOrLocalFileList []string, noConfirm bool, noResolve bool) error {
+// sdkPrefix returns the install prefix inside the configured OHOS sdk
+func (c *Client) sdkPrefix() (string, error) {
 	if c.Config.OhosSdk == "" {
-		return errors.New("OHOS SDK path not configured (use --help for more info)")
+		return "", errors.New("OHOS SDK path not configured (use --help for more info)")
 	}
 	prefix := filepath.Join(c.Config.OhosSdk, "native", "sysroot", "usr")
 	if !common.IsDirExists(prefix) {
-		return fmt.Errorf("invalid OHOS sdk directory tree: directory '%s' not exists", prefix)
+		return "", fmt.Errorf("invalid OHOS sdk directory tree: directory '%s' not exists", prefix)
+	}
+	return prefix, nil
+}
+
+// Install downloads and installs the named package into OHOS sdk
+func (c *Client) InstallToSdk(pkgNameOrLocalFileList []string, noConfirm bool, noResolve bool) error {
+	prefix, err := c.sdkPrefix()
+	if err != nil {
+		return err
 	}
-	return c.install(pkgNameOrLocalFileList, prefix, noConfirm, noResolve)
+	return c.install(pkgNameOrLocalFileList, "", prefix, noConfirm, noResolve)
 }
 
 // Install downloads and installs the named package into prefix.
 // @note prefix must be an absolute path
 func (c *Client) Install(pkgNameOrLocalFileList []string, prefix string, noConfirm bool, noResolve bool) error {
 
-	return c.install(pkgNameOrLocalFileList, prefix, noConfirm, noResolve)
+	return c.install(pkgNameOrLocalFileList, "", prefix, noConfirm, noResolve)
 }
 
-// Uninstall removes installed package from prefix.
-func (c *Client) Uninstall(pkgName, prefix string) error {
+// UninstallFromSdk removes installed packages from OHOS sdk.
+func (c *Client) UninstallFromSdk(pkgNames []string, force, cascade bool) error {
+	prefix, err := c.sdkPrefix()
+	if err != nil {
+		return err
+	}
+	return c.Uninstall(pkgNames, prefix, force, cascade)
+}
+
+// Uninstall removes installed packages from prefix.
+//
+// Removing a package still required by other installed packages is refused
+// unless force (remove anyway) or cascade (remove the dependents too) is set.
+func (c *Client) Uninstall(pkgNames []string, prefix string, force, cascade bool) error {
 	db, err := OpenDB(c.DBPath)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
-	return c.uninstallDB(db, pkgName, prefix)
-}
 
-func (c *Client) uninstallDB(db *DB, pkgName, prefix string) error {
-	inst, err := db.GetInstalled(pkgName, prefix)
+	installed, err := db.ListInstalled(prefix)
 	if err != nil {
 		return err
 	}
-	if inst == nil {
-		return fmt.Errorf("%s not installed in %s", pkgName, prefix)
+	installedNames := map[string]bool{}
+	for _, inst := range installed {
+		installedNames[inst.Name] = true
 	}
-	link := filepath.Join(prefix, pkgName)
-	// remove symlink if points to installed path
-	if ltarget, err := os.Readlink(link); err == nil {
-		if ltarget == inst.Path {
-			_ = os.Remove(link)
+	for _, name := range pkgNames {
+		if !installedNames[name] {
+			return fmt.Errorf("%s not installed in %s", name, prefix)
 		}
 	}
-	// remove installed dir
-	if err := os.RemoveAll(inst.Path); err != nil {
-		return err
+
+	removal := append([]string(nil), pkgNames...)
+	rdeps := reverseDependencies(installed, pkgNames)
+	if len(rdeps) > 0 {
+		switch {
+		case cascade:
+			fmt.Printf("The following installed packages depend on %s and will be removed too:\n%s\n",
+				strings.Join(pkgNames, ", "), formatReverseDeps(rdeps))
+			cascaded := make([]string, 0, len(rdeps)+len(removal))
+			for _, r := range rdeps {
+				cascaded = append(cascaded, r.Name)
+			}
+			removal = append(cascaded, removal...)
+		case force:
+			fmt.Printf("WARN: removing %s breaks the following installed packages:\n%s\n",
+				strings.Join(pkgNames, ", "), formatReverseDeps(rdeps))
+		default:
+			return fmt.Errorf("cannot remove %s: still required by installed packages:\n%s\n"+
+				"use --cascade to remove them as well, or --force to remove anyway",
+				strings.Join(pkgNames, ", "), formatReverseDeps(rdeps))
+		}
 	}
-	if err := db.DeleteInstalled(pkgName, prefix); err != nil {
+
+	txn, err := beginTransaction(prefix)
+	if err != nil {
 		return err
 	}
-	fmt.Printf("uninstalled %s from %s\n", pkgName, prefix)
-	return nil
-}
-
-// Helpers
-
-func (c *Client) loadIndex() (*meta.Index, error) {
-	try := []string{
-		fmt.Sprintf("%s/channels/%s/index.json", strings.TrimRight(c.Config.RootURL, "/"), c.Config.Channel),
-		fmt.Sprintf("%s/%s/channels/%s/index.json", strings.TrimRight(c.Config.RootURL, "/"), "repo", c.Config.Channel),
+	removing := map[string]bool{}
+	for _, name := range removal {
+		removing[name] = true
 	}
-	var lastErr error
-	for _, u := range try {
-		b, err := common.FetchURL(c.HTTP, u)
+	for _, name := range removal {
+		inst, err := db.GetInstalled(name, prefix)
+		if err == nil {
+			err = c.removePackage(db, txn, inst, removing)
+		}
 		if err != nil {
-			lastErr = err
-			continue
+			if rbErr := txn.rollback(); rbErr != nil {
+				return fmt.Errorf("%v\n%v", err, rbErr)
+			}
+			return fmt.Errorf("failed to remove %s, prefix restored: %w", name, err)
 		}
-		var idx meta.Index
-		if err := json.Unmarshal(b, &idx); err != nil {
-			return nil, err
+	}
+	if err := txn.applyDBChanges(db, removal, nil, nil); err != nil {
+		if rbErr := txn.rollback(); rbErr != nil {
+			return fmt.Errorf("%v\n%v", err, rbErr)
 		}
-		return &idx, nil
+		return err
 	}
-	return nil, fmt.Errorf("failed to fetch index.json: %v", lastErr)
+	if err := txn.commit(); err != nil {
+		return err
+	}
+	for _, name := range removal {
+		fmt.Printf("uninstalled %s from %s\n", name, prefix)
+	}
+	return nil
 }
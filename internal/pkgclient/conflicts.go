@@ -0,0 +1,122 @@
+package pkgclient
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// fileConflict is a payload path that already belongs to someone else.
+type fileConflict struct {
+	Path    string // relative to the prefix
+	Package string // package installing Path
+	Owner   string // owning package, or ownerSdk
+}
+
+// owner name used for paths shipped by the OHOS sdk itself
+const ownerSdk = "the OHOS SDK"
+
+func (c fileConflict) String() string {
+	owner := c.Owner
+	if owner != ownerSdk {
+		owner = "package '" + owner + "'"
+	}
+	return fmt.Sprintf("%s (from '%s') is already owned by %s", c.Path, c.Package, owner)
+}
+
+// validateOverwriteGlobs checks the --overwrite patterns before anything is done.
+func validateOverwriteGlobs(globs []string) error {
+	for _, g := range globs {
+		if _, err := path.Match(g, ""); err != nil {
+			return fmt.Errorf("invalid --overwrite pattern '%s': %v", g, err)
+		}
+	}
+	return nil
+}
+
+// matchesOverwrite reports whether relPath (or one of its parent directories) matches one of globs.
+func matchesOverwrite(globs []string, relPath string) bool {
+	for _, g := range globs {
+		for p := relPath; p != "." && p != "/"; p = path.Dir(p) {
+			if ok, _ := path.Match(g, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// findFileConflicts finds the staged payload paths of steps that are owned by another installed
+// package, by the sdk baseline, or by another package of the same transaction. Directories never conflict,
+// neither do files of packages being removed in the same transaction nor files the package already owns.
+func findFileConflicts(db *DB, prefix string, steps []*installStep, baseline *sdkSnapshot, removing map[string]bool) ([]fileConflict, error) {
+	claimed := map[string]string{}
+	conflicts := []fileConflict{}
+	for _, step := range steps {
+		name := step.entry.Name
+		for _, rel := range step.relPaths {
+			info, err := os.Lstat(filepath.Join(step.stageDir, filepath.FromSlash(rel)))
+			if err != nil {
+				return nil, err
+			}
+			if info.IsDir() {
+				continue
+			}
+
+			owners := []string{}
+			if other, ok := claimed[rel]; ok {
+				owners = append(owners, other)
+			}
+			claimed[rel] = name
+			dbOwners, err := db.FileOwners(prefix, rel)
+			if err != nil {
+				return nil, err
+			}
+			ownedBySelf := false
+			for _, o := range dbOwners {
+				if o == name {
+					ownedBySelf = true
+				} else if !removing[o] {
+					owners = append(owners, o)
+				}
+			}
+			// a package that already replaced an sdk file (its original is in the snapshot) may replace it again
+			if e, ok := baseline.lookup(rel); ok && e.Type != FileTypeDir && !ownedBySelf {
+				owners = append(owners, ownerSdk)
+			}
+			for _, o := range owners {
+				conflicts = append(conflicts, fileConflict{Path: rel, Package: name, Owner: o})
+			}
+		}
+	}
+	return conflicts, nil
+}
+
+// checkFileConflicts fails on the conflicts found by findFileConflicts.
+// Conflicts matching overwrite are reported and allowed.
+func (c *Client) checkFileConflicts(db *DB, prefix string, steps []*installStep, baseline *sdkSnapshot, removing map[string]bool, overwrite []string) error {
+	found, err := findFileConflicts(db, prefix, steps, baseline, removing)
+	if err != nil {
+		return err
+	}
+	conflicts := []fileConflict{}
+	for _, conflict := range found {
+		if matchesOverwrite(overwrite, conflict.Path) {
+			c.logf(" - WARN: overwriting %s\n", conflict)
+			continue
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Path < conflicts[j].Path })
+	lines := make([]string, 0, len(conflicts))
+	for _, conflict := range conflicts {
+		lines = append(lines, "  "+conflict.String())
+	}
+	return fmt.Errorf("file conflicts detected (use --overwrite <glob> to replace them anyway):\n%s", strings.Join(lines, "\n"))
+}
@@ -0,0 +1,159 @@
+package pkgclient
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/SSRVodka/oh-packager/pkg/config"
+	"github.com/SSRVodka/oh-packager/pkg/meta"
+)
+
+func TestCheckFileConflicts(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	prefix := t.TempDir()
+	db, err := OpenDB(filepath.Join(t.TempDir(), "installed.db"))
+	if err != nil {
+		t.Fatalf("OpenDB failed: %v", err)
+	}
+	defer db.Close()
+
+	// pristine sdk content
+	writeTestFile(t, prefix, "include/stdio.h", "sdk")
+	// installed package
+	writeTestFile(t, prefix, "lib/libbar.so", "bar")
+	barFiles, err := collectInstalledFiles(prefix, []string{"lib", "lib/libbar.so"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.InsertInstalled(Installed{Name: "bar", Version: "1.0.0", Arch: "aarch64", Prefix: prefix}, barFiles); err != nil {
+		t.Fatal(err)
+	}
+	baseline, err := captureSdkBaseline(db, prefix)
+	if err != nil {
+		t.Fatalf("captureSdkBaseline failed: %v", err)
+	}
+	if _, ok := baseline.lookup("lib/libbar.so"); ok {
+		t.Fatalf("baseline must not contain files owned by packages")
+	}
+
+	stage := func(name string, files ...string) *installStep {
+		dir := filepath.Join(t.TempDir(), name)
+		for _, f := range files {
+			writeTestFile(t, dir, f, name)
+		}
+		return &installStep{entry: meta.IndexEntry{Name: name}, stageDir: dir, relPaths: append([]string{"lib"}, files...)}
+	}
+	foo := stage("foo", "include/stdio.h", "lib/libbar.so", "lib/libfoo.so")
+	baz := stage("baz", "lib/libfoo.so")
+	bar := stage("bar", "lib/libbar.so")
+
+	err = (&Client{}).checkFileConflicts(db, prefix, []*installStep{foo, baz}, baseline, nil, nil)
+	if err == nil {
+		t.Fatalf("expected conflicts")
+	}
+	for _, want := range []string{
+		"include/stdio.h (from 'foo') is already owned by the OHOS SDK",
+		"lib/libbar.so (from 'foo') is already owned by package 'bar'",
+		"lib/libfoo.so (from 'baz') is already owned by package 'foo'",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("conflict %q not reported:\n%v", want, err)
+		}
+	}
+
+	if err := (&Client{}).checkFileConflicts(db, prefix, []*installStep{foo}, baseline, nil, []string{"include/*", "lib/libbar*"}); err != nil {
+		t.Fatalf("conflicts matching --overwrite must be allowed: %v", err)
+	}
+	if err := (&Client{}).checkFileConflicts(db, prefix, []*installStep{foo}, baseline, nil, []string{"include"}); err == nil {
+		t.Fatalf("lib/libbar.so doesn't match --overwrite, expected a conflict")
+	}
+	// upgrading a package over its own files is fine
+	if err := (&Client{}).checkFileConflicts(db, prefix, []*installStep{bar}, baseline, nil, nil); err != nil {
+		t.Fatalf("package conflicts with itself: %v", err)
+	}
+}
+
+func TestRemovingPackageRestoresOverwrittenSdkFiles(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	sdk := t.TempDir()
+	prefix := filepath.Join(sdk, "native", "sysroot", "usr")
+	dbPath := filepath.Join(t.TempDir(), "installed.db")
+	c := &Client{Config: &config.Config{OhosSdk: sdk}, DBPath: dbPath}
+	db, err := OpenDB(dbPath)
+	if err != nil {
+		t.Fatalf("OpenDB failed: %v", err)
+	}
+	defer db.Close()
+
+	writeTestFile(t, prefix, "include/stdio.h", "sdk stdio")
+	stage := t.TempDir()
+	writeTestFile(t, stage, "include/stdio.h", "foo stdio")
+	writeTestFile(t, stage, "lib/libfoo.so", "foo")
+
+	// add --overwrite 'include/*'
+	txn, err := beginTransaction(prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseline, err := c.ensureSdkBaseline(db, prefix)
+	if err != nil || baseline == nil {
+		t.Fatalf("ensureSdkBaseline failed: %v", err)
+	}
+	step := &installStep{entry: meta.IndexEntry{Name: "foo"}, stageDir: stage, relPaths: []string{"include/stdio.h", "lib", "lib/libfoo.so"}}
+	mustDo(t, c.checkFileConflicts(db, prefix, []*installStep{step}, baseline, nil, []string{"include/*"}))
+	mustDo(t, txn.installEntry(filepath.Join(stage, "include/stdio.h"), filepath.Join(prefix, "include/stdio.h")))
+	mustDo(t, txn.mkdirAll(filepath.Join(prefix, "lib")))
+	mustDo(t, txn.installEntry(filepath.Join(stage, "lib/libfoo.so"), filepath.Join(prefix, "lib/libfoo.so")))
+	files, err := collectInstalledFiles(prefix, step.relPaths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustDo(t, db.ApplyChanges(prefix, nil, []Installed{{Name: "foo", Version: "1.0.0", Arch: "aarch64"}}, map[string][]InstalledFile{"foo": files}))
+	mustDo(t, txn.commit())
+	assertFileContent(t, prefix, "include/stdio.h", "foo stdio")
+
+	// del foo
+	if err := c.Uninstall([]string{"foo"}, prefix, false, false); err != nil {
+		t.Fatalf("Uninstall failed: %v", err)
+	}
+	assertFileContent(t, prefix, "include/stdio.h", "sdk stdio")
+	if _, err := os.Lstat(filepath.Join(prefix, "lib")); !os.IsNotExist(err) {
+		t.Fatalf("lib still exists after uninstall")
+	}
+}
+
+func TestUpgradeOverOverwrittenSdkFilesNeedsNoOverwrite(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	sdk := t.TempDir()
+	prefix := filepath.Join(sdk, "native", "sysroot", "usr")
+	pkgDir := t.TempDir()
+	c := &Client{Config: &config.Config{OhosSdk: sdk}, DBPath: filepath.Join(t.TempDir(), "installed.db"), ScriptPolicy: ScriptsNever}
+	writeTestFile(t, prefix, "include/stdio.h", "sdk stdio")
+
+	fooV1 := filepath.Join(pkgDir, "foo-1.0.0.pkg")
+	writeTestPkg(t, fooV1, map[string]string{"include/stdio.h": "foo 1 stdio"})
+	install := func(version, pkgPath string) error {
+		return c.installChosen(map[string]meta.IndexEntry{"foo": testEntry("foo", version)}, map[string]string{"foo": pkgPath}, nil, prefix)
+	}
+	if err := install("1.0.0", fooV1); err == nil {
+		t.Fatalf("sdk file overwritten without --overwrite")
+	}
+	c.Overwrite = []string{"include/*"}
+	mustDo(t, install("1.0.0", fooV1))
+
+	// foo owns include/stdio.h now: upgrading it replaces its own file
+	c.Overwrite = nil
+	fooV2 := filepath.Join(pkgDir, "foo-2.0.0.pkg")
+	writeTestPkg(t, fooV2, map[string]string{"include/stdio.h": "foo 2 stdio"})
+	if err := install("2.0.0", fooV2); err != nil {
+		t.Fatalf("upgrade of foo failed: %v", err)
+	}
+	assertFileContent(t, prefix, "include/stdio.h", "foo 2 stdio")
+
+	if err := c.Uninstall([]string{"foo"}, prefix, false, false); err != nil {
+		t.Fatalf("Uninstall failed: %v", err)
+	}
+	assertFileContent(t, prefix, "include/stdio.h", "sdk stdio")
+}
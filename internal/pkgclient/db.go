@@ -2,8 +2,11 @@ package pkgclient
 
 import (
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -12,6 +15,8 @@ import (
 // DB wrapper
 type DB struct {
 	*sql.DB
+	// database file, recorded in transaction journals (see transaction.applyDBChanges)
+	path string
 }
 
 // Installed row
@@ -20,8 +25,35 @@ type Installed struct {
 	Version string
 	Arch    string
 	Prefix  string
-	Path    string
-	When    time.Time
+	// package file the installation came from
+	Path string
+	When time.Time
+	// declared dependencies (dependency specs as in meta.Manifest.Depends)
+	Depends []string
+	// sha256 of the package file
+	SHA256 string
+	// URL (repository or mirror) the package file was downloaded from; empty for cached and local packages
+	Source string
+	// name of the repository the package was resolved from; empty for packages installed without resolution
+	Repo string
+	// lifecycle script name -> content, recorded by ApplyChanges (see GetInstalledScripts)
+	Scripts map[string]string
+}
+
+// file types recorded for installed files
+const (
+	FileTypeFile    = "file"
+	FileTypeSymlink = "symlink"
+	FileTypeDir     = "dir"
+)
+
+// InstalledFile is one filesystem entry written by an installed package.
+// Path is relative to the install prefix (slash separated).
+type InstalledFile struct {
+	Path   string
+	Type   string
+	SHA256 string // regular files only
+	Mode   os.FileMode
 }
 
 // OpenDB opens/creates database and ensures schema.
@@ -33,7 +65,7 @@ func OpenDB(path string) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	db := &DB{dbconn}
+	db := &DB{DB: dbconn, path: path}
 	if err := db.ensureSchema(); err != nil {
 		db.Close()
 		return nil, err
@@ -42,7 +74,7 @@ func OpenDB(path string) (*DB, error) {
 }
 
 func (db *DB) ensureSchema() error {
-	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS installed (
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS installed (
 		name TEXT NOT NULL,
 		version TEXT NOT NULL,
 		arch TEXT,
@@ -50,32 +82,280 @@ func (db *DB) ensureSchema() error {
 		path TEXT NOT NULL,
 		installed_at DATETIME,
 		PRIMARY KEY (name, prefix)
-	)`)
+	)`); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS files (
+		name TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		path TEXT NOT NULL,
+		type TEXT NOT NULL,
+		sha256 TEXT,
+		mode INTEGER,
+		PRIMARY KEY (name, prefix, path)
+	)`); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS files_by_path ON files(prefix, path)`); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS scripts (
+		name TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		script TEXT NOT NULL,
+		content TEXT NOT NULL,
+		PRIMARY KEY (name, prefix, script)
+	)`); err != nil {
+		return err
+	}
+	// columns added after the first schema version
+	if err := db.addColumnIfMissing("installed", "depends", "TEXT"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("installed", "sha256", "TEXT"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("installed", "source", "TEXT"); err != nil {
+		return err
+	}
+	return db.addColumnIfMissing("installed", "repo", "TEXT")
+}
+
+// addColumnIfMissing upgrades tables created by older clients.
+func (db *DB) addColumnIfMissing(table, column, decl string) error {
+	rows, err := db.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, decl))
 	return err
 }
 
-func (db *DB) InsertInstalled(name, version, arch, prefix, path string) error {
-	_, err := db.Exec(`INSERT OR REPLACE INTO installed(name,version,arch,prefix,path,installed_at) VALUES (?,?,?,?,?,?)`,
-		name, version, arch, prefix, path, time.Now().UTC())
+// InsertInstalled records (or replaces) an installed package together with its file list.
+func (db *DB) InsertInstalled(inst Installed, files []InstalledFile) error {
+	return db.ApplyChanges(inst.Prefix, nil, []Installed{inst}, map[string][]InstalledFile{inst.Name: files})
+}
+
+// ApplyChanges removes and (re)inserts installed packages of prefix in a single DB transaction.
+// files maps package names in added to their file lists.
+func (db *DB) ApplyChanges(prefix string, removed []string, added []Installed, files map[string][]InstalledFile) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, name := range removed {
+		if err := deleteInstalledTx(tx, name, prefix); err != nil {
+			return err
+		}
+	}
+	for _, inst := range added {
+		inst.Prefix = prefix
+		if err := insertInstalledTx(tx, inst, files[inst.Name]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func insertInstalledTx(tx *sql.Tx, inst Installed, files []InstalledFile) error {
+	deps, err := json.Marshal(inst.Depends)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO installed(name,version,arch,prefix,path,installed_at,depends,sha256,source,repo) VALUES (?,?,?,?,?,?,?,?,?,?)`,
+		inst.Name, inst.Version, inst.Arch, inst.Prefix, inst.Path, time.Now().UTC(), string(deps), inst.SHA256, inst.Source, inst.Repo); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM files WHERE name=? AND prefix=?`, inst.Name, inst.Prefix); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO files(name,prefix,path,type,sha256,mode) VALUES (?,?,?,?,?,?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, f := range files {
+		if _, err := stmt.Exec(inst.Name, inst.Prefix, f.Path, f.Type, f.SHA256, uint32(f.Mode)); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM scripts WHERE name=? AND prefix=?`, inst.Name, inst.Prefix); err != nil {
+		return err
+	}
+	for script, content := range inst.Scripts {
+		if _, err := tx.Exec(`INSERT INTO scripts(name,prefix,script,content) VALUES (?,?,?,?)`,
+			inst.Name, inst.Prefix, script, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteInstalledTx(tx *sql.Tx, name, prefix string) error {
+	if _, err := tx.Exec(`DELETE FROM files WHERE name=? AND prefix=?`, name, prefix); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM scripts WHERE name=? AND prefix=?`, name, prefix); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`DELETE FROM installed WHERE name=? AND prefix=?`, name, prefix)
 	return err
 }
 
-func (db *DB) GetInstalled(name, prefix string) (*Installed, error) {
-	row := db.QueryRow(`SELECT name,version,arch,prefix,path,installed_at FROM installed WHERE name=? AND prefix=?`, name, prefix)
+const installedColumns = `name,version,arch,prefix,path,installed_at,depends,sha256,source,repo`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanInstalled(row rowScanner) (*Installed, error) {
 	var it Installed
 	var t string
-	err := row.Scan(&it.Name, &it.Version, &it.Arch, &it.Prefix, &it.Path, &t)
+	var deps, sum, source, repo sql.NullString
+	if err := row.Scan(&it.Name, &it.Version, &it.Arch, &it.Prefix, &it.Path, &t, &deps, &sum, &source, &repo); err != nil {
+		return nil, err
+	}
+	it.SHA256, it.Source, it.Repo = sum.String, source.String, repo.String
+	it.When, _ = time.Parse(time.RFC3339Nano, t)
+	if deps.Valid && deps.String != "" {
+		if err := json.Unmarshal([]byte(deps.String), &it.Depends); err != nil {
+			return nil, fmt.Errorf("invalid dependency record of %s: %v", it.Name, err)
+		}
+	}
+	return &it, nil
+}
+
+func (db *DB) GetInstalled(name, prefix string) (*Installed, error) {
+	row := db.QueryRow(`SELECT `+installedColumns+` FROM installed WHERE name=? AND prefix=?`, name, prefix)
+	it, err := scanInstalled(row)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
+	return it, err
+}
+
+// ListInstalled returns every package installed in prefix, sorted by name.
+func (db *DB) ListInstalled(prefix string) ([]Installed, error) {
+	rows, err := db.Query(`SELECT `+installedColumns+` FROM installed WHERE prefix=? ORDER BY name`, prefix)
 	if err != nil {
 		return nil, err
 	}
-	it.When, _ = time.Parse(time.RFC3339Nano, t)
-	return &it, nil
+	defer rows.Close()
+	var list []Installed
+	for rows.Next() {
+		it, err := scanInstalled(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *it)
+	}
+	return list, rows.Err()
+}
+
+// GetInstalledFiles returns the recorded file list of an installed package, sorted by path.
+func (db *DB) GetInstalledFiles(name, prefix string) ([]InstalledFile, error) {
+	rows, err := db.Query(`SELECT path,type,sha256,mode FROM files WHERE name=? AND prefix=? ORDER BY path`, name, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var files []InstalledFile
+	for rows.Next() {
+		var f InstalledFile
+		var sum sql.NullString
+		var mode uint32
+		if err := rows.Scan(&f.Path, &f.Type, &sum, &mode); err != nil {
+			return nil, err
+		}
+		f.SHA256 = sum.String
+		f.Mode = os.FileMode(mode)
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// GetInstalledScripts returns the lifecycle scripts (name -> content) recorded for an installed package.
+func (db *DB) GetInstalledScripts(name, prefix string) (map[string]string, error) {
+	rows, err := db.Query(`SELECT script,content FROM scripts WHERE name=? AND prefix=?`, name, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	scripts := map[string]string{}
+	for rows.Next() {
+		var script, content string
+		if err := rows.Scan(&script, &content); err != nil {
+			return nil, err
+		}
+		scripts[script] = content
+	}
+	return scripts, rows.Err()
+}
+
+// FileOwners returns the packages in prefix that recorded relPath.
+func (db *DB) FileOwners(prefix, relPath string) ([]string, error) {
+	rows, err := db.Query(`SELECT name FROM files WHERE prefix=? AND path=? ORDER BY name`, prefix, relPath)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var owners []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		owners = append(owners, name)
+	}
+	return owners, rows.Err()
+}
+
+// FileOwner is a recorded path together with the package that recorded it.
+type FileOwner struct {
+	Path string
+	Name string
+}
+
+// FindFilesByName returns the recorded paths in prefix whose last element is baseName, sorted by path.
+func (db *DB) FindFilesByName(prefix, baseName string) ([]FileOwner, error) {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(baseName)
+	rows, err := db.Query(`SELECT path,name FROM files WHERE prefix=? AND (path=? OR path LIKE ? ESCAPE '\') ORDER BY path,name`,
+		prefix, baseName, "%/"+escaped)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var found []FileOwner
+	for rows.Next() {
+		var f FileOwner
+		if err := rows.Scan(&f.Path, &f.Name); err != nil {
+			return nil, err
+		}
+		// LIKE is case-insensitive
+		if f.Path != baseName && !strings.HasSuffix(f.Path, "/"+baseName) {
+			continue
+		}
+		found = append(found, f)
+	}
+	return found, rows.Err()
 }
 
 func (db *DB) DeleteInstalled(name, prefix string) error {
-	_, err := db.Exec(`DELETE FROM installed WHERE name=? AND prefix=?`, name, prefix)
-	return err
+	return db.ApplyChanges(prefix, []string{name}, nil, nil)
 }
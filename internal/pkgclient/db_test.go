@@ -0,0 +1,121 @@
+package pkgclient
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUninstallRemovesRecordedFiles(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	prefix := t.TempDir()
+	dbPath := filepath.Join(t.TempDir(), "installed.db")
+	db, err := OpenDB(dbPath)
+	if err != nil {
+		t.Fatalf("OpenDB failed: %v", err)
+	}
+	defer db.Close()
+
+	writeTestFile(t, prefix, "include/foo/foo.h", "foo")
+	writeTestFile(t, prefix, "lib/libfoo.so.1", "elf")
+	writeTestFile(t, prefix, "lib/libbar.so", "bar")
+	writeTestFile(t, prefix, "share/shared.txt", "shared")
+	writeTestFile(t, prefix, "etc/foo.conf", "conf")
+	// pre-existing empty directory that foo doesn't own
+	if err := os.MkdirAll(filepath.Join(prefix, "var", "empty"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("libfoo.so.1", filepath.Join(prefix, "lib", "libfoo.so")); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := collectInstalledFiles(prefix, []string{
+		"include", "include/foo", "include/foo/foo.h", "lib", "lib/libfoo.so.1", "lib/libfoo.so", "share/shared.txt", "etc/foo.conf",
+	})
+	if err != nil {
+		t.Fatalf("collectInstalledFiles failed: %v", err)
+	}
+	if err := db.InsertInstalled(Installed{Name: "foo", Version: "1.0.0", Arch: "aarch64", Prefix: prefix, Path: "foo.pkg"}, files); err != nil {
+		t.Fatalf("InsertInstalled failed: %v", err)
+	}
+	barFiles, err := collectInstalledFiles(prefix, []string{"lib/libbar.so", "share/shared.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.InsertInstalled(Installed{Name: "bar", Version: "1.0.0", Arch: "aarch64", Prefix: prefix, Path: "bar.pkg"}, barFiles); err != nil {
+		t.Fatal(err)
+	}
+
+	recorded, err := db.GetInstalledFiles("foo", prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != 8 {
+		t.Fatalf("recorded %d files, want 8: %#v", len(recorded), recorded)
+	}
+
+	if err := (&Client{DBPath: dbPath}).Uninstall([]string{"foo"}, prefix, false, false); err != nil {
+		t.Fatalf("Uninstall failed: %v", err)
+	}
+
+	for _, gone := range []string{"include", "lib/libfoo.so.1", "lib/libfoo.so", "etc/foo.conf"} {
+		if _, err := os.Lstat(filepath.Join(prefix, gone)); !os.IsNotExist(err) {
+			t.Fatalf("%s still exists after uninstall", gone)
+		}
+	}
+	// "etc" was not recorded by foo: it stays even though it is empty now
+	for _, kept := range []string{"lib/libbar.so", "share/shared.txt", "etc", "var/empty"} {
+		if _, err := os.Lstat(filepath.Join(prefix, kept)); err != nil {
+			t.Fatalf("%s removed by uninstall: %v", kept, err)
+		}
+	}
+	if inst, err := db.GetInstalled("foo", prefix); err != nil || inst != nil {
+		t.Fatalf("foo still recorded after uninstall: %#v, %v", inst, err)
+	}
+}
+
+func writeTestFile(t *testing.T, root, rel, content string) {
+	t.Helper()
+	path := filepath.Join(root, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindFilesByName(t *testing.T) {
+	prefix := t.TempDir()
+	db, err := OpenDB(filepath.Join(t.TempDir(), "installed.db"))
+	if err != nil {
+		t.Fatalf("OpenDB failed: %v", err)
+	}
+	defer db.Close()
+
+	files := []InstalledFile{
+		{Path: "lib/libssl.so.3", Type: FileTypeFile},
+		{Path: "lib/libssl_so.3", Type: FileTypeFile},
+		{Path: "lib/LIBSSL.so.3", Type: FileTypeFile},
+	}
+	if err := db.InsertInstalled(Installed{Name: "openssl", Version: "3.0.0", Arch: "aarch64", Prefix: prefix}, files); err != nil {
+		t.Fatal(err)
+	}
+	found, err := db.FindFilesByName(prefix, "libssl.so.3")
+	if err != nil {
+		t.Fatalf("FindFilesByName failed: %v", err)
+	}
+	if len(found) != 1 || found[0] != (FileOwner{Path: "lib/libssl.so.3", Name: "openssl"}) {
+		t.Fatalf("FindFilesByName = %#v", found)
+	}
+
+	if rel, ok := relToPrefix(filepath.Join(prefix, "lib", "libssl.so.3"), prefix); !ok || rel != "lib/libssl.so.3" {
+		t.Fatalf("relToPrefix(absolute) = %q, %v", rel, ok)
+	}
+	if rel, ok := relToPrefix("lib/libssl.so.3", prefix); !ok || rel != "lib/libssl.so.3" {
+		t.Fatalf("relToPrefix(prefix relative) = %q, %v", rel, ok)
+	}
+	if _, ok := relToPrefix("/somewhere/else", prefix); ok {
+		t.Fatalf("relToPrefix accepted a path outside prefix")
+	}
+}
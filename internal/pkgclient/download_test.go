@@ -0,0 +1,68 @@
+package pkgclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SSRVodka/oh-packager/pkg/config"
+	"github.com/SSRVodka/oh-packager/pkg/meta"
+)
+
+func TestStartDownloadsLimitsConcurrencyAndVerifiesChecksums(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		fmt.Fprint(w, "content of "+r.URL.Path)
+	}))
+	defer srv.Close()
+
+	c := &Client{Config: &config.Config{RootURL: srv.URL, DownloadJobs: 2}, Cache: t.TempDir(), HTTP: srv.Client()}
+	entries := []meta.IndexEntry{}
+	for i := 0; i < 6; i++ {
+		url := fmt.Sprintf("packages/p%d.pkg", i)
+		sum := sha256.Sum256([]byte("content of /" + url))
+		entries = append(entries, meta.IndexEntry{Name: fmt.Sprintf("p%d", i), URL: url, SHA256: hex.EncodeToString(sum[:])})
+	}
+	entries[3].SHA256 = "0000"
+
+	results, wait := c.startDownloads(context.Background(), entries)
+	wait()
+	for i, ch := range results {
+		r := <-ch
+		if i == 3 {
+			if r.err == nil {
+				t.Fatalf("checksum mismatch of p3 not detected")
+			}
+			if _, err := os.Stat(c.cachePath(entries[3])); !os.IsNotExist(err) {
+				t.Fatalf("corrupt download kept in cache")
+			}
+			continue
+		}
+		if r.err != nil {
+			t.Fatalf("download of p%d failed: %v", i, r.err)
+		}
+		assertFileContent(t, filepath.Dir(r.pkgPath), filepath.Base(r.pkgPath), fmt.Sprintf("content of /packages/p%d.pkg", i))
+	}
+	if maxRunning != 2 {
+		t.Fatalf("%d concurrent downloads, want 2", maxRunning)
+	}
+}
@@ -0,0 +1,320 @@
+package pkgclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/SSRVodka/oh-packager/internal/common"
+	"github.com/SSRVodka/oh-packager/pkg/meta"
+)
+
+// The indexes of the repositories are kept in IndexDir/<repo>/<channel>/ (index.json, its signature
+// index.json.sig and state.json). They are verified every time they are loaded (see verifyRepoFile).
+// `ohla update` refreshes them with conditional requests; the other commands resolve against them.
+
+// staleIndexAge is the age from which commands using a local index suggest `ohla update`.
+const staleIndexAge = 7 * 24 * time.Hour
+
+// errNoLocalIndex is returned for repositories whose index was never fetched.
+var errNoLocalIndex = errors.New("no local index")
+
+// storedIndexState describes a local index.
+type storedIndexState struct {
+	// root URL of the repository the index was fetched from
+	URL string `json:"url"`
+	// index.json URL (repository or mirror) that served the index, with its validators
+	IndexURL     string `json:"index_url,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	// when the index content was last downloaded
+	Fetched time.Time `json:"fetched"`
+	// when the index was last found up to date
+	Checked time.Time `json:"checked"`
+	// repository name and generation time published in the index: later indexes must match them
+	Repo      string    `json:"repo,omitempty"`
+	Generated time.Time `json:"generated"`
+}
+
+func (c *Client) storedIndexDir(repo repository) string {
+	return filepath.Join(c.IndexDir, repo.Name, url.PathEscape(repo.Channel))
+}
+
+// readIndexState returns the state of the local index of repo. Indexes of another repository
+// URL (the repository was reconfigured) are reported as missing.
+func (c *Client) readIndexState(repo repository) (*storedIndexState, error) {
+	if c.IndexDir == "" {
+		return nil, errNoLocalIndex
+	}
+	b, err := os.ReadFile(filepath.Join(c.storedIndexDir(repo), "state.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errNoLocalIndex
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state storedIndexState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("invalid local index state: %v", err)
+	}
+	if state.URL != common.RedactURL(repo.URL) {
+		return nil, errNoLocalIndex
+	}
+	return &state, nil
+}
+
+func (c *Client) writeIndexState(repo repository, state *storedIndexState) error {
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(c.storedIndexDir(repo), "state.json"), b)
+}
+
+// storedRepoIndex returns the local index of repo and its state.
+func (c *Client) storedRepoIndex(repo repository) (*meta.Index, *storedIndexState, error) {
+	state, err := c.readIndexState(repo)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := os.ReadFile(filepath.Join(c.storedIndexDir(repo), "index.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, errNoLocalIndex
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	sig, err := os.ReadFile(filepath.Join(c.storedIndexDir(repo), "index.json.sig"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, err
+	}
+	if err := c.verifyRepoFile(repo, indexRelPath(repo), b, sig); err != nil {
+		return nil, nil, err
+	}
+	var idx meta.Index
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return nil, nil, fmt.Errorf("invalid local index: %v", err)
+	}
+	if err := checkIndexOrigin(repo, &idx, nil); err != nil {
+		return nil, nil, err
+	}
+	return &idx, state, nil
+}
+
+// checkIndexOrigin makes sure idx is an index of the channel of repo and, when the local index
+// has the state local, of the same repository and not older: a validly signed index of another
+// channel or repository, or an old one replayed by a mirror, is refused.
+func checkIndexOrigin(repo repository, idx *meta.Index, local *storedIndexState) error {
+	if idx.Channel != repo.Channel {
+		return fmt.Errorf("index of channel '%s' served for channel '%s' of repository '%s'", idx.Channel, repo.Channel, repo.Name)
+	}
+	if local == nil {
+		return nil
+	}
+	if local.Repo != "" && idx.Repo != local.Repo {
+		return fmt.Errorf("index of repository '%s' served for repository '%s' (local index from '%s')", idx.Repo, repo.Name, local.Repo)
+	}
+	if idx.Generated.Before(local.Generated) {
+		return fmt.Errorf("index of repository '%s' generated at %s is older than the local one (%s)",
+			repo.Name, idx.Generated.Format(time.RFC3339), local.Generated.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// indexURLs returns the index.json URLs of repo, in the order they are tried: every base URL
+// (see mirrorBases) with both repository layouts, the URL that served the local index first.
+func (c *Client) indexURLs(repo repository, state *storedIndexState) []string {
+	urls := []string{}
+	if state != nil && state.IndexURL != "" {
+		urls = append(urls, state.IndexURL)
+	}
+	for _, base := range c.mirrorBases(repo) {
+		// Some deployments put channels directly under root; try both patterns.
+		for _, u := range []string{
+			fmt.Sprintf("%s/channels/%s/index.json", strings.TrimRight(base, "/"), repo.Channel),
+			fmt.Sprintf("%s/%s/channels/%s/index.json", strings.TrimRight(base, "/"), "repo", repo.Channel),
+		} {
+			if state == nil || u != state.IndexURL {
+				urls = append(urls, u)
+			}
+		}
+	}
+	return urls
+}
+
+// updateRepoIndex refreshes the local index of repo. The URL that served the local index is asked
+// first with If-None-Match/If-Modified-Since, so unchanged indexes are not downloaded again.
+// Without IndexDir the index is fetched and nothing is stored.
+//
+// @return (index, whether it was downloaded (false: the local one is up to date), error)
+func (c *Client) updateRepoIndex(repo repository) (*meta.Index, bool, error) {
+	state, err := c.readIndexState(repo)
+	if err != nil && !errors.Is(err, errNoLocalIndex) {
+		c.logf(" - WARN: ignoring the local index of '%s': %v\n", repo.Name, err)
+	}
+	// state is reset below when the local copy is gone, local keeps what it recorded
+	local := state
+	// signature errors are reported rather than the failures of the other URLs
+	var lastErr, verifyErr error
+	for _, u := range c.indexURLs(repo, state) {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if state != nil && u == state.IndexURL {
+			if state.ETag != "" {
+				req.Header.Set("If-None-Match", state.ETag)
+			}
+			if state.LastModified != "" {
+				req.Header.Set("If-Modified-Since", state.LastModified)
+			}
+		}
+		resp, err := c.HTTP.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotModified && state != nil {
+			idx, _, err := c.storedRepoIndex(repo)
+			if err == nil {
+				state.Checked = time.Now().UTC()
+				if err := c.writeIndexState(repo, state); err != nil {
+					return nil, false, err
+				}
+				return idx, false, nil
+			}
+			// the local copy is gone: download it again
+			state = nil
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= 400 {
+			lastErr = fmt.Errorf("HTTP %d fetching %s", resp.StatusCode, common.RedactURL(u))
+			continue
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		// indexes of mirrors too must be signed by the repository
+		sig, err := c.verifyFetched(repo, u, indexRelPath(repo), b)
+		if err != nil {
+			verifyErr = err
+			continue
+		}
+		var idx meta.Index
+		if err := json.Unmarshal(b, &idx); err != nil {
+			lastErr = fmt.Errorf("invalid index %s: %v", common.RedactURL(u), err)
+			continue
+		}
+		if err := checkIndexOrigin(repo, &idx, local); err != nil {
+			verifyErr = fmt.Errorf("%s: %v", common.RedactURL(u), err)
+			continue
+		}
+		if repo.AllowUnsigned {
+			c.logf(" - WARN: the index of repository '%s' is not verified (allow_unsigned)\n", repo.Name)
+		}
+		if c.IndexDir != "" {
+			now := time.Now().UTC()
+			newState := &storedIndexState{URL: common.RedactURL(repo.URL), IndexURL: u,
+				ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified"), Fetched: now, Checked: now,
+				Repo: idx.Repo, Generated: idx.Generated}
+			if err := c.storeRepoIndex(repo, b, sig, newState); err != nil {
+				return nil, false, fmt.Errorf("failed to store the index of '%s': %v", repo.Name, err)
+			}
+		}
+		return &idx, true, nil
+	}
+	if verifyErr != nil {
+		return nil, false, fmt.Errorf("rejected index.json: %v", verifyErr)
+	}
+	return nil, false, fmt.Errorf("failed to fetch index.json: %v", lastErr)
+}
+
+// storeRepoIndex replaces the local index of repo with the index.json content b and its signature
+// sig (nil for unsigned repositories).
+func (c *Client) storeRepoIndex(repo repository, b, sig []byte, state *storedIndexState) error {
+	dir := c.storedIndexDir(repo)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if sig == nil {
+		if err := os.Remove(filepath.Join(dir, "index.json.sig")); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	} else if err := writeFileAtomic(filepath.Join(dir, "index.json.sig"), sig); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, "index.json"), b); err != nil {
+		return err
+	}
+	return c.writeIndexState(repo, state)
+}
+
+// indexRelPath returns the path of the index of repo relative to the repository root.
+func indexRelPath(repo repository) string {
+	return fmt.Sprintf("channels/%s/index.json", repo.Channel)
+}
+
+// Update refreshes the local indexes of every repository.
+func (c *Client) Update() error {
+	if c.Offline {
+		return errors.New("`ohla update` needs the network (remove --offline)")
+	}
+	if err := c.checkRepos(); err != nil {
+		return err
+	}
+	failed := 0
+	for _, repo := range c.repositories() {
+		idx, downloaded, err := c.updateRepoIndex(repo)
+		if err != nil {
+			fmt.Printf("%s (%s): %v\n", repo.Name, repo.Channel, err)
+			failed++
+			continue
+		}
+		if downloaded {
+			fmt.Printf("%s (%s): updated, %d packages\n", repo.Name, repo.Channel, len(idx.Packages))
+		} else {
+			fmt.Printf("%s (%s): up to date, %d packages\n", repo.Name, repo.Channel, len(idx.Packages))
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to update %d of %d repositories", failed, len(c.repositories()))
+	}
+	return nil
+}
+
+// indexAge describes how long ago a local index was last updated.
+func indexAge(state *storedIndexState) string {
+	d := time.Since(state.Checked)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%d minutes ago", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%d hours ago", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%d days ago", int(d.Hours()/24))
+	}
+}
+
+// writeFileAtomic replaces path with data, so that readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
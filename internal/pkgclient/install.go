@@ -0,0 +1,461 @@
+package pkgclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/SSRVodka/oh-packager/internal/common"
+	"github.com/SSRVodka/oh-packager/pkg/meta"
+)
+
+var errInterrupted = errors.New("interrupted")
+
+// installStep is one package of an install transaction.
+type installStep struct {
+	entry   meta.IndexEntry
+	pkgPath string
+	// URL the package was downloaded from (empty for cached and local packages)
+	source string
+	// installed version being replaced (nil for fresh installs)
+	previous *Installed
+	// extracted package in the transaction staging area
+	stageDir string
+	// component entries relative to stageDir, which are also their paths relative to the prefix
+	relPaths []string
+}
+
+// action is the OHLA_ACTION of the lifecycle scripts of step.
+func (step *installStep) action() string {
+	if step.previous != nil {
+		return actionUpgrade
+	}
+	return actionInstall
+}
+
+// installChosen installs the resolved packages into prefix as one transaction:
+// every package is downloaded and staged first, then applied. If anything fails
+// (or the user interrupts the installation) the prefix is restored.
+//
+// @param[in] localPkgs package name -> local .pkg file (skip downloading)
+// @param[in] removals installed packages to remove in the same transaction
+func (c *Client) installChosen(chosen map[string]meta.IndexEntry, localPkgs map[string]string, removals []string, prefix string) error {
+	db, err := OpenDB(c.DBPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	txn, err := beginTransaction(prefix)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	installed, err := c.runInstallTransaction(ctx, db, txn, chosen, localPkgs, removals)
+	if err != nil {
+		if rbErr := txn.rollback(); rbErr != nil {
+			return fmt.Errorf("installation failed: %v\n%v", err, rbErr)
+		}
+		return fmt.Errorf("installation failed, %s restored: %w", prefix, err)
+	}
+	if err := txn.commit(); err != nil {
+		return err
+	}
+
+	c.logf("\nFinish installation: %d packages installed\n\n", installed)
+	return nil
+}
+
+// @return (number of installed packages, error)
+func (c *Client) runInstallTransaction(ctx context.Context, db *DB, txn *transaction,
+	chosen map[string]meta.IndexEntry, localPkgs map[string]string, removals []string) (int, error) {
+
+	prefix := txn.prefix
+
+	// 1) download and stage everything: the prefix is untouched until all packages are ready
+	steps, err := c.stageInstallSteps(ctx, db, prefix, txn.stageDir, chosen, localPkgs)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, step := range steps {
+		if step.source != "" {
+			if err := txn.logf("downloaded %s %s from %s", step.entry.Name, step.entry.Version, common.RedactURL(step.source)); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	// 2) make sure nothing owned by another package or by the SDK gets clobbered
+	baseline, err := c.ensureSdkBaseline(db, prefix)
+	if err != nil {
+		return 0, err
+	}
+	removing := map[string]bool{}
+	for _, name := range removals {
+		removing[name] = true
+	}
+	if err := c.checkFileConflicts(db, prefix, steps, baseline, removing, c.Overwrite); err != nil {
+		return 0, err
+	}
+
+	// 3) apply
+	for _, name := range removals {
+		c.logf("Removing %s\n", name)
+		inst, err := db.GetInstalled(name, prefix)
+		if err != nil {
+			return 0, err
+		}
+		if inst == nil {
+			continue
+		}
+		if err := c.removePackage(db, txn, inst, removing); err != nil {
+			return 0, fmt.Errorf("failed to remove %s: %v", name, err)
+		}
+	}
+	for i, step := range steps {
+		if ctx.Err() != nil {
+			return 0, errInterrupted
+		}
+		progress := fmt.Sprintf("[%d/%d] ", i+1, len(steps))
+		if err := c.applyInstallStep(ctx, db, txn, step, progress); err != nil {
+			return 0, err
+		}
+	}
+
+	// 4) post-installation scripts run last, once every package is in place:
+	// their changes outside the installed files are not journaled
+	for _, step := range steps {
+		if ctx.Err() != nil {
+			return 0, errInterrupted
+		}
+		if err := c.runStagedScript(txn, step, common.ScriptPostInst, step.action()); err != nil {
+			return 0, err
+		}
+	}
+
+	// 5) record in DB (after patching so that the checksums match what is on disk)
+	removed := append([]string(nil), removals...)
+	added := []Installed{}
+	files := map[string][]InstalledFile{}
+	for _, step := range steps {
+		name := step.entry.Name
+		stepFiles, err := collectInstalledFiles(prefix, step.relPaths)
+		if err != nil {
+			return 0, err
+		}
+		if step.previous != nil {
+			removed = append(removed, name)
+		}
+		scripts, err := stagedScripts(step.stageDir)
+		if err != nil {
+			return 0, err
+		}
+		added = append(added, Installed{
+			Name:    name,
+			Version: step.entry.Version,
+			Arch:    step.entry.Arch,
+			Path:    step.pkgPath,
+			Depends: step.entry.Depends,
+			SHA256:  step.entry.SHA256,
+			Source:  common.RedactURL(step.source),
+			Repo:    step.entry.Repo,
+			Scripts: scripts,
+		})
+		files[name] = stepFiles
+	}
+	if err := txn.applyDBChanges(db, removed, added, files); err != nil {
+		return 0, err
+	}
+	return len(steps), nil
+}
+
+// applyInstallStep copies the staged files of step into the prefix. progress prefixes the progress message.
+func (c *Client) applyInstallStep(ctx context.Context, db *DB, txn *transaction, step *installStep, progress string) error {
+	prefix := txn.prefix
+	name := step.entry.Name
+
+	if step.previous != nil {
+		c.logf("%sUpgrading %s %s -> %s\n", progress, name, step.previous.Version, step.entry.Version)
+		if err := c.runInstalledScript(db, txn, step.previous, common.ScriptPreRm, actionUpgrade); err != nil {
+			return err
+		}
+	} else {
+		c.logf("%sInstalling %s %s\n", progress, name, step.entry.Version)
+	}
+	if err := c.runStagedScript(txn, step, common.ScriptPreInst, step.action()); err != nil {
+		return err
+	}
+	for _, rel := range step.relPaths {
+		if ctx.Err() != nil {
+			return errInterrupted
+		}
+		src := filepath.Join(step.stageDir, filepath.FromSlash(rel))
+		dst := filepath.Join(prefix, filepath.FromSlash(rel))
+		info, err := os.Lstat(src)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			err = txn.mkdirAll(dst)
+		} else {
+			err = txn.moveEntry(src, dst)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to install '%s' of package '%s': %v", rel, name, err)
+		}
+	}
+
+	// drop files of the previous version that are not shipped anymore
+	if step.previous != nil {
+		if err := c.removeStaleFiles(db, txn, step); err != nil {
+			return err
+		}
+		if err := c.runInstalledScript(db, txn, step.previous, common.ScriptPostRm, actionUpgrade); err != nil {
+			return err
+		}
+	}
+
+	// patch libraries for development
+	return c.patchInstalledLibs(txn, name, step.entry.Arch)
+}
+
+// installOrder returns the names of chosen in installation order: dependencies (see
+// IndexEntry.Depends) come before their dependents, independent packages by name.
+// Dependency cycles are broken at the first package by name of the cycle, with a warning.
+func (c *Client) installOrder(chosen map[string]meta.IndexEntry) []string {
+	deps := make(map[string][]string, len(chosen))
+	names := make([]string, 0, len(chosen))
+	for name, e := range chosen {
+		names = append(names, name)
+		for _, dep := range e.Depends {
+			if depName := dependencyName(dep); depName != name {
+				if _, ok := chosen[depName]; ok {
+					deps[name] = append(deps[name], depName)
+				}
+			}
+		}
+		sort.Strings(deps[name])
+	}
+	sort.Strings(names)
+
+	done := make(map[string]bool, len(chosen))
+	pending := func(name string) []string {
+		waiting := []string{}
+		for _, dep := range deps[name] {
+			if !done[dep] {
+				waiting = append(waiting, dep)
+			}
+		}
+		return waiting
+	}
+	order := make([]string, 0, len(chosen))
+	for len(order) < len(names) {
+		next := ""
+		for _, name := range names {
+			if !done[name] && len(pending(name)) == 0 {
+				next = name
+				break
+			}
+		}
+		if next == "" {
+			// every remaining package waits for another one: they form a cycle
+			for _, name := range names {
+				if !done[name] {
+					next = name
+					break
+				}
+			}
+			c.logf(" - WARN: dependency cycle: installing %s before its dependencies %s\n", next, strings.Join(pending(next), ", "))
+		}
+		done[next] = true
+		order = append(order, next)
+	}
+	return order
+}
+
+// stageInstallSteps downloads the packages of chosen that are not installed in prefix at the same
+// version yet and extracts each of them into stageRoot/<name>. Downloads run concurrently; each
+// package is extracted, in installation order, as soon as its download is done.
+func (c *Client) stageInstallSteps(ctx context.Context, db *DB, prefix, stageRoot string,
+	chosen map[string]meta.IndexEntry, localPkgs map[string]string) ([]*installStep, error) {
+
+	names := c.installOrder(chosen)
+	steps := []*installStep{}
+	downloads := []meta.IndexEntry{}
+	for _, name := range names {
+		entry := chosen[name]
+		installed, err := db.GetInstalled(name, prefix)
+		if err != nil {
+			return nil, err
+		}
+		if installed != nil && installed.Version == entry.Version {
+			c.logf(" - %s already installed at same version %s, skipping\n", name, entry.Version)
+			continue
+		}
+		if _, ok := localPkgs[name]; !ok {
+			downloads = append(downloads, entry)
+		}
+		steps = append(steps, &installStep{entry: entry, previous: installed})
+	}
+
+	dlCtx, cancel := context.WithCancel(ctx)
+	results, wait := c.startDownloads(dlCtx, downloads)
+	defer wait()
+	defer cancel()
+
+	next := 0
+	for i, step := range steps {
+		name := step.entry.Name
+		c.logf("[%d/%d] Preparing %s %s\n", i+1, len(steps), name, step.entry.Version)
+		expected := step.entry.SHA256
+		if pkgPath, ok := localPkgs[name]; ok {
+			c.logf(" - using local file: %s\n", pkgPath)
+			step.pkgPath = pkgPath
+			// a local build may differ from the package of the same version in the index
+			expected = ""
+		} else {
+			var r downloadResult
+			select {
+			case r = <-results[next]:
+			case <-ctx.Done():
+				return nil, errInterrupted
+			}
+			next++
+			if r.err != nil {
+				if ctx.Err() != nil {
+					return nil, errInterrupted
+				}
+				return nil, r.err
+			}
+			step.pkgPath, step.source = r.pkgPath, r.source
+		}
+
+		c.logf("Extracting %s %s\n", name, step.entry.Version)
+		step.stageDir = filepath.Join(stageRoot, name)
+		// the checksum of local packages is computed while extracting them
+		var err error
+		if step.relPaths, step.entry.SHA256, err = c.stagePackage(step.pkgPath, step.stageDir, name, expected); err != nil {
+			return nil, err
+		}
+	}
+	return steps, nil
+}
+
+// removeStaleFiles removes the files recorded for the previous version of step that the new version doesn't ship.
+func (c *Client) removeStaleFiles(db *DB, txn *transaction, step *installStep) error {
+	name := step.entry.Name
+	oldFiles, err := db.GetInstalledFiles(name, txn.prefix)
+	if err != nil {
+		return err
+	}
+	shipped := make(map[string]bool, len(step.relPaths))
+	for _, rel := range step.relPaths {
+		shipped[rel] = true
+	}
+	stale := []InstalledFile{}
+	for _, f := range oldFiles {
+		if !shipped[f.Path] {
+			stale = append(stale, f)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	if err := c.removeInstalledFiles(db, txn, name, txn.prefix, stale, nil); err != nil {
+		return err
+	}
+	c.logf(" - removed %d files no longer shipped since %s\n", len(stale), step.previous.Version)
+	return nil
+}
+
+// stagePackage extracts pkgPath into stageDir, checking the package against sha256 unless it is empty.
+//
+// @return (install components entries (`common.GetInstallComponents()`) relative to stageDir, sha256 of the package, error)
+func (c *Client) stagePackage(pkgPath, stageDir, pkgName, sha256 string) ([]string, string, error) {
+	_ = os.RemoveAll(stageDir)
+	sum, err := common.ExtractTarGzSHA256(pkgPath, stageDir, sha256)
+	if err != nil {
+		return nil, "", err
+	}
+	relPaths := []string{}
+	for _, component := range common.GetInstallComponents() {
+		srcDir := filepath.Join(stageDir, component)
+		if !common.IsDirExists(srcDir) {
+			if !common.IsOptionalInstallComponent(component) {
+				c.logf(" - WARN: package '%s' doesn't have component '%s'\n", pkgName, component)
+			}
+			continue
+		}
+		walkErr := filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, relErr := filepath.Rel(stageDir, path)
+			if relErr != nil {
+				return relErr
+			}
+			relPaths = append(relPaths, filepath.ToSlash(rel))
+			return nil
+		})
+		if walkErr != nil {
+			return nil, "", fmt.Errorf("failed to extract component '%s': %v", component, walkErr)
+		}
+	}
+	return relPaths, sum, nil
+}
+
+// patchInstalledLibs patches the .la/.pc files of the prefix for the current installation.
+// The original files are saved in the transaction first.
+func (c *Client) patchInstalledLibs(txn *transaction, pkgName, arch string) error {
+	prefix := txn.prefix
+	archDepRelPath, archErr := common.GetOhosArchDepLibDirRelPath(arch)
+	if archErr != nil {
+		return archErr
+	}
+	libDirs := []string{filepath.Join(prefix, archDepRelPath)}
+	// patch shared files like xorg libraries
+	shareDir := filepath.Join(prefix, common.GetOhosSharedDirRelPath())
+	if common.IsDirExists(shareDir) {
+		libDirs = append(libDirs, shareDir)
+	}
+	// patch arch-dependent libs under arch-independent dir
+	irregular, readErr := common.IsArchDepLibInArchIndepDir(prefix)
+	if readErr != nil {
+		return readErr
+	}
+	if irregular {
+		c.logf("WARN: current libraries install architecture-dependent library under architecture-independent directory, " +
+			"and it may break your SDK env if you use different architectures. Take care of it\n")
+		libDirs = append(libDirs, filepath.Join(prefix, common.GetOhosArchIndepLibDirRelPath()))
+	}
+
+	c.logf("Patching libraries of package '%s'\n", pkgName)
+	for _, libDir := range libDirs {
+		for _, pattern := range []string{filepath.Join(libDir, "*.la"), filepath.Join(libDir, "pkgconfig", "*.pc")} {
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				return fmt.Errorf("glob %q: %w", pattern, err)
+			}
+			for _, m := range matches {
+				if err := txn.preserve(m); err != nil {
+					return fmt.Errorf("failed to back up '%s' before patching: %v", m, err)
+				}
+			}
+		}
+		if err := c.patchLibFilesForCurrentInstallation(libDir, prefix); err != nil {
+			c.logf(" - WARN: %v\n", err)
+		}
+	}
+	return nil
+}
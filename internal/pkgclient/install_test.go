@@ -0,0 +1,129 @@
+package pkgclient
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/SSRVodka/oh-packager/pkg/meta"
+)
+
+// writeTestPkg writes a package archive with the given content (path -> content, paths ending
+// with "/" are directories) to path and returns its sha256.
+func writeTestPkg(t *testing.T, path string, content map[string]string) string {
+	t.Helper()
+	names := make([]string, 0, len(content))
+	for name := range content {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(content[name]))}
+		if strings.HasSuffix(name, "/") {
+			hdr = &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0o755}
+		}
+		mustDo(t, tw.WriteHeader(hdr))
+		if _, err := tw.Write([]byte(content[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustDo(t, tw.Close())
+	mustDo(t, gz.Close())
+	mustDo(t, os.WriteFile(path, buf.Bytes(), 0o644))
+	sum := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+func testEntry(name, version string) meta.IndexEntry {
+	return meta.IndexEntry{Name: name, Version: version, Arch: "aarch64", OhosApi: "12"}
+}
+
+func TestUpgradeRemovesFilesNoLongerShipped(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	prefix := t.TempDir()
+	pkgDir := t.TempDir()
+	dbPath := filepath.Join(t.TempDir(), "installed.db")
+	c := &Client{DBPath: dbPath, ScriptPolicy: ScriptsNever}
+
+	fooV1 := filepath.Join(pkgDir, "foo-1.0.0.pkg")
+	writeTestPkg(t, fooV1, map[string]string{"include/foo.h": "foo 1", "share/doc/foo.txt": "foo doc"})
+	// bar ships share/doc as an empty directory
+	bar := filepath.Join(pkgDir, "bar-1.0.0.pkg")
+	writeTestPkg(t, bar, map[string]string{"include/bar.h": "bar", "share/doc/": ""})
+	mustDo(t, c.installChosen(map[string]meta.IndexEntry{"foo": testEntry("foo", "1.0.0"), "bar": testEntry("bar", "1.0.0")},
+		map[string]string{"foo": fooV1, "bar": bar}, nil, prefix))
+	assertFileContent(t, prefix, "share/doc/foo.txt", "foo doc")
+
+	fooV2 := filepath.Join(pkgDir, "foo-2.0.0.pkg")
+	writeTestPkg(t, fooV2, map[string]string{"include/foo.h": "foo 2"})
+	mustDo(t, c.installChosen(map[string]meta.IndexEntry{"foo": testEntry("foo", "2.0.0")},
+		map[string]string{"foo": fooV2}, nil, prefix))
+
+	assertFileContent(t, prefix, "include/foo.h", "foo 2")
+	if _, err := os.Lstat(filepath.Join(prefix, "share/doc/foo.txt")); !os.IsNotExist(err) {
+		t.Fatalf("share/doc/foo.txt still exists after the upgrade")
+	}
+	for _, kept := range []string{"include/bar.h", "share/doc"} {
+		if _, err := os.Lstat(filepath.Join(prefix, kept)); err != nil {
+			t.Fatalf("%s of bar removed by the upgrade of foo: %v", kept, err)
+		}
+	}
+
+	db, err := OpenDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	files, err := db.GetInstalledFiles("foo", prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, f := range files {
+		got = append(got, f.Path)
+	}
+	if want := "include include/foo.h"; strings.Join(got, " ") != want {
+		t.Fatalf("files of foo recorded after the upgrade: %v, want %s", got, want)
+	}
+	if inst, err := db.GetInstalled("foo", prefix); err != nil || inst == nil || inst.Version != "2.0.0" {
+		t.Fatalf("foo recorded as %+v, %v", inst, err)
+	}
+}
+
+func TestInstallLocalPackageOfIndexedVersion(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	prefix := t.TempDir()
+	pkgDir := t.TempDir()
+	dbPath := filepath.Join(t.TempDir(), "installed.db")
+	c := &Client{DBPath: dbPath, ScriptPolicy: ScriptsNever}
+
+	// the repository has foo 1.0.0 too, but the local file is a rebuild of it
+	indexed := testEntry("foo", "1.0.0")
+	indexed.SHA256 = writeTestPkg(t, filepath.Join(pkgDir, "repo-foo-1.0.0.pkg"), map[string]string{"include/foo.h": "repository build"})
+	local := filepath.Join(pkgDir, "foo-1.0.0.pkg")
+	localSum := writeTestPkg(t, local, map[string]string{"include/foo.h": "local build"})
+
+	if err := c.installChosen(map[string]meta.IndexEntry{"foo": indexed}, map[string]string{"foo": local}, nil, prefix); err != nil {
+		t.Fatalf("installation of the local package failed: %v", err)
+	}
+	assertFileContent(t, prefix, "include/foo.h", "local build")
+
+	db, err := OpenDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if inst, err := db.GetInstalled("foo", prefix); err != nil || inst == nil || inst.SHA256 != localSum {
+		t.Fatalf("foo recorded as %+v, %v; want the sha256 of the local file", inst, err)
+	}
+}
@@ -0,0 +1,178 @@
+package pkgclient
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/SSRVodka/oh-packager/internal/common"
+)
+
+// collectInstalledFiles stats the installed paths (relative to prefix) and builds the DB file list.
+// Paths that disappeared in the meantime (e.g. removed by a post-installation script) are skipped.
+func collectInstalledFiles(prefix string, relPaths []string) ([]InstalledFile, error) {
+	files := make([]InstalledFile, 0, len(relPaths))
+	for _, rel := range relPaths {
+		full := filepath.Join(prefix, filepath.FromSlash(rel))
+		info, err := os.Lstat(full)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat installed file '%s': %v", full, err)
+		}
+		f := InstalledFile{Path: rel, Mode: info.Mode()}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			f.Type = FileTypeSymlink
+		case info.IsDir():
+			f.Type = FileTypeDir
+		default:
+			f.Type = FileTypeFile
+			sum, sumErr := common.ComputeSHA256(full)
+			if sumErr != nil {
+				return nil, fmt.Errorf("failed to checksum installed file '%s': %v", full, sumErr)
+			}
+			f.SHA256 = sum
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// removeInstalledFiles removes the recorded files of pkgName from prefix through txn and prunes
+// its recorded directories left empty. Files and directories also recorded by another package that is not being removed are kept.
+// Files shipped by the OHOS sdk (see loadSdkBaseline) that the package overwrote get their original content back.
+func (c *Client) removeInstalledFiles(db *DB, txn *transaction, pkgName, prefix string, files []InstalledFile, removing map[string]bool) error {
+	baseline, err := loadSdkBaseline(prefix)
+	if err != nil {
+		return err
+	}
+	dirs := map[string]bool{}
+	for _, f := range files {
+		full := filepath.Join(prefix, filepath.FromSlash(f.Path))
+		owners, err := db.FileOwners(prefix, f.Path)
+		if err != nil {
+			return err
+		}
+		sharedWith := otherOwners(owners, pkgName, removing)
+		// only directories the package recorded are pruned, never pre-existing ones
+		// or ones another package recorded too
+		if f.Type == FileTypeDir {
+			if len(sharedWith) == 0 {
+				dirs[full] = true
+			}
+			continue
+		}
+		if len(sharedWith) > 0 {
+			c.logf(" - keeping %s (also owned by %s)\n", f.Path, strings.Join(sharedWith, ", "))
+			continue
+		}
+		if e, ok := baseline.lookup(f.Path); ok {
+			if err := c.restoreSdkEntry(txn, e); err != nil {
+				c.logf(" - WARN: keeping %s of %s: the original of the OHOS SDK cannot be restored (%v)\n", f.Path, pkgName, err)
+			}
+			continue
+		}
+
+		info, err := os.Lstat(full)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to stat '%s': %v", full, err)
+		}
+		if f.Type == FileTypeFile && info.Mode().IsRegular() && f.SHA256 != "" {
+			if same, _ := common.VerifyFileSHA256(full, f.SHA256); !same {
+				c.logf(" - WARN: %s was modified after installation, removing anyway\n", f.Path)
+			}
+		}
+		if err := txn.remove(full); err != nil {
+			return fmt.Errorf("failed to remove '%s': %v", full, err)
+		}
+	}
+	for d := range dirs {
+		rel, relErr := filepath.Rel(prefix, d)
+		if relErr != nil {
+			return relErr
+		}
+		if _, ok := baseline.lookup(filepath.ToSlash(rel)); ok {
+			delete(dirs, d)
+		}
+	}
+	return pruneEmptyDirs(txn, dirs)
+}
+
+// restoreSdkEntry puts back the OHOS sdk original of a path overwritten by a package.
+// The original content was saved in the object store when the package was installed.
+func (c *Client) restoreSdkEntry(txn *transaction, e inventoryEntry) error {
+	full := filepath.Join(txn.prefix, filepath.FromSlash(e.Path))
+	src := ""
+	switch e.Type {
+	case FileTypeFile:
+		if same, _ := common.VerifyFileSHA256(full, e.SHA256); same {
+			return nil
+		}
+		src = sdkObjectPath(txn.prefix, e.SHA256)
+		if !common.IsFileExists(src) {
+			return fmt.Errorf("content %s not saved", e.SHA256)
+		}
+	case FileTypeSymlink:
+		if target, err := os.Readlink(full); err == nil && target == e.Target {
+			return nil
+		}
+		src = filepath.Join(txn.stageDir, "sdk", filepath.FromSlash(e.Path))
+		if err := os.MkdirAll(filepath.Dir(src), 0o755); err != nil {
+			return err
+		}
+		if err := os.Symlink(e.Target, src); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	if err := txn.restoreEntry(src, full); err != nil {
+		return err
+	}
+	if e.Type == FileTypeFile {
+		if err := os.Chmod(full, e.Mode.Perm()); err != nil {
+			return err
+		}
+	}
+	c.logf(" - restored %s of the OHOS SDK\n", e.Path)
+	return nil
+}
+
+// pruneEmptyDirs removes the given directories deepest first, keeping non-empty ones.
+func pruneEmptyDirs(txn *transaction, dirs map[string]bool) error {
+	list := make([]string, 0, len(dirs))
+	for d := range dirs {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		di := strings.Count(list[i], string(filepath.Separator))
+		dj := strings.Count(list[j], string(filepath.Separator))
+		if di != dj {
+			return di > dj
+		}
+		return list[i] > list[j]
+	})
+	for _, d := range list {
+		if err := txn.removeDirIfEmpty(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func otherOwners(owners []string, self string, removing map[string]bool) []string {
+	var others []string
+	for _, o := range owners {
+		if o != self && !removing[o] {
+			others = append(others, o)
+		}
+	}
+	return others
+}
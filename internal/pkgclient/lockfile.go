@@ -0,0 +1,252 @@
+package pkgclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/SSRVodka/oh-packager/internal/common"
+	"github.com/SSRVodka/oh-packager/pkg/meta"
+)
+
+// DefaultLockFile is the lock file name used when none is given.
+const DefaultLockFile = "ohla.lock"
+
+const lockFormatVersion = 1
+
+// LockFile pins the exact resolved package closure of a project.
+type LockFile struct {
+	Format    int             `json:"format_version"`
+	Generated time.Time       `json:"generated"`
+	Requested []string        `json:"requested,omitempty"`
+	Packages  []LockedPackage `json:"packages"`
+}
+
+// LockedPackage is one exact package artifact of a lock file.
+type LockedPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Arch    string `json:"arch"`
+	OhosApi string `json:"ohos_api"`
+	SHA256  string `json:"sha256"`
+	URL     string `json:"url"`
+	// repository the package was resolved from (empty: root_url)
+	Repo string `json:"repo,omitempty"`
+}
+
+// ReadLockFile loads a lock file written by `ohla lock`.
+func ReadLockFile(path string) (*LockFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lf LockFile
+	if err := json.Unmarshal(b, &lf); err != nil {
+		return nil, fmt.Errorf("invalid lock file '%s': %v", path, err)
+	}
+	if lf.Format > lockFormatVersion {
+		return nil, fmt.Errorf("lock file '%s' has format version %d, this ohla supports up to %d", path, lf.Format, lockFormatVersion)
+	}
+	if len(lf.Packages) == 0 {
+		return nil, fmt.Errorf("lock file '%s' locks no packages", path)
+	}
+	return &lf, nil
+}
+
+// WriteLockFile writes lf to path with packages sorted by name.
+func WriteLockFile(path string, lf *LockFile) error {
+	sort.Slice(lf.Packages, func(i, j int) bool { return lf.Packages[i].Name < lf.Packages[j].Name })
+	b, err := json.MarshalIndent(lf, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
+
+// Lock resolves pkgSpecs (names or constraints like "zlib >= 1.3") for arch against the
+// channel index and writes the resulting closure to lockPath.
+func (c *Client) Lock(pkgSpecs []string, arch, lockPath string) error {
+	if err := c.checkRepos(); err != nil {
+		return err
+	}
+	if len(pkgSpecs) == 0 {
+		return fmt.Errorf("empty package list")
+	}
+	fmt.Printf("Resolving dependencies...\n")
+	chosen, err := c.ResolveDependencies(pkgSpecs, arch)
+	if err != nil {
+		return err
+	}
+	lf := &LockFile{
+		Format:    lockFormatVersion,
+		Generated: time.Now().UTC(),
+		Requested: pkgSpecs,
+	}
+	for _, e := range chosen {
+		lf.Packages = append(lf.Packages, LockedPackage{
+			Name:    e.Name,
+			Version: e.Version,
+			Arch:    e.Arch,
+			OhosApi: e.OhosApi,
+			SHA256:  e.SHA256,
+			URL:     e.URL,
+			Repo:    e.Repo,
+		})
+	}
+	if err := WriteLockFile(lockPath, lf); err != nil {
+		return err
+	}
+	for _, p := range lf.Packages {
+		fmt.Printf(" - %s (%s)\n", p.Name, p.Version)
+	}
+	fmt.Printf("Locked %d packages in %s\n", len(lf.Packages), lockPath)
+	return nil
+}
+
+// SyncSdk makes the packages installed in OHOS sdk match the lock file.
+func (c *Client) SyncSdk(lockPath string, noConfirm, prune bool) error {
+	prefix, err := c.sdkPrefix()
+	if err != nil {
+		return err
+	}
+	return c.Sync(lockPath, prefix, noConfirm, prune)
+}
+
+// Sync installs the packages of the lock file into prefix at their locked versions.
+// With prune, other installed packages are removed so that prefix exactly matches the lock file.
+//
+// @note prefix must be an absolute path
+func (c *Client) Sync(lockPath, prefix string, noConfirm, prune bool) error {
+	if err := c.checkRepos(); err != nil {
+		return err
+	}
+	if err := validateOverwriteGlobs(c.Overwrite); err != nil {
+		return err
+	}
+	lf, err := ReadLockFile(lockPath)
+	if err != nil {
+		return err
+	}
+	sdkInfo, err := common.LoadLocalSdkInfo(c.Config.OhosSdk)
+	if err != nil {
+		return err
+	}
+	idx, err := c.loadIndex()
+	if err != nil {
+		return err
+	}
+	chosen, err := lockedEntries(lf, idx, sdkInfo.ApiVersion)
+	if err != nil {
+		return err
+	}
+
+	db, err := OpenDB(c.DBPath)
+	if err != nil {
+		return err
+	}
+	installed, err := db.ListInstalled(prefix)
+	db.Close()
+	if err != nil {
+		return err
+	}
+	installedVersions := map[string]string{}
+	removals := []string{}
+	for _, inst := range installed {
+		installedVersions[inst.Name] = inst.Version
+		if _, ok := chosen[inst.Name]; ok {
+			continue
+		}
+		if prune {
+			removals = append(removals, inst.Name)
+		} else {
+			fmt.Printf("NOTE: %s %s is not locked, keeping it (use --prune to remove it)\n", inst.Name, inst.Version)
+		}
+	}
+	changes := map[string]meta.IndexEntry{}
+	for name, e := range chosen {
+		if installedVersions[name] != e.Version {
+			changes[name] = e
+		}
+	}
+	if len(changes) == 0 && len(removals) == 0 {
+		fmt.Printf("%s is in sync with %s\n", prefix, lockPath)
+		return nil
+	}
+
+	if !noConfirm {
+		names := make([]string, 0, len(changes))
+		for name := range changes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Printf("We are going to sync %s with %s:\n", prefix, lockPath)
+		for _, name := range names {
+			if old, ok := installedVersions[name]; ok {
+				fmt.Printf(" - %s (%s -> %s)\n", name, old, changes[name].Version)
+			} else {
+				fmt.Printf(" + %s (%s)\n", name, changes[name].Version)
+			}
+		}
+		for _, name := range removals {
+			fmt.Printf(" x %s (%s, not locked)\n", name, installedVersions[name])
+		}
+		ok, confirmErr := common.ConfirmAction("Proceed? (Y/[n]) ")
+		if confirmErr != nil {
+			return confirmErr
+		}
+		if !ok {
+			fmt.Printf("Sync abort.\n")
+			return nil
+		}
+	}
+	return c.installChosen(changes, map[string]string{}, removals, prefix)
+}
+
+// lockedEntries looks every locked package up in idx. The artifact must still be published
+// unchanged (same checksum and URL) by the same repository and be built for the local SDK API.
+func lockedEntries(lf *LockFile, idx *meta.Index, sdkApi string) (map[string]meta.IndexEntry, error) {
+	// the first entry is the one of the highest priority repository
+	published := map[string]meta.IndexEntry{}
+	for _, e := range idx.Packages {
+		for _, key := range []string{e.Name + "\x00" + e.Version + "\x00" + e.Arch, e.Name + "\x00" + e.Version + "\x00" + e.Arch + "\x00" + e.Repo} {
+			if _, ok := published[key]; !ok {
+				published[key] = e
+			}
+		}
+	}
+	chosen := map[string]meta.IndexEntry{}
+	missing := []string{}
+	arch := ""
+	for _, p := range lf.Packages {
+		if arch == "" {
+			arch = p.Arch
+		} else if p.Arch != arch {
+			return nil, fmt.Errorf("different archs in lock file: '%s' vs '%s'", p.Arch, arch)
+		}
+		if p.OhosApi != sdkApi {
+			return nil, fmt.Errorf("%s %s is locked for API %s, but the local SDK is API %s", p.Name, p.Version, p.OhosApi, sdkApi)
+		}
+		key := p.Name + "\x00" + p.Version + "\x00" + p.Arch
+		if p.Repo != "" {
+			key += "\x00" + p.Repo
+		}
+		e, ok := published[key]
+		switch {
+		case !ok:
+			missing = append(missing, fmt.Sprintf("%s %s (%s): not in the repository anymore", p.Name, p.Version, p.Arch))
+		case e.SHA256 != p.SHA256:
+			missing = append(missing, fmt.Sprintf("%s %s (%s): checksum changed (locked %s, repository %s)", p.Name, p.Version, p.Arch, p.SHA256, e.SHA256))
+		case e.URL != p.URL:
+			missing = append(missing, fmt.Sprintf("%s %s (%s): moved from %s to %s", p.Name, p.Version, p.Arch, p.URL, e.URL))
+		default:
+			chosen[p.Name] = e
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("locked artifacts unavailable:\n  %s", strings.Join(missing, "\n  "))
+	}
+	return chosen, nil
+}
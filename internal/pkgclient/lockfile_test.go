@@ -0,0 +1,78 @@
+package pkgclient
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/SSRVodka/oh-packager/pkg/meta"
+)
+
+func TestLockFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), DefaultLockFile)
+	lf := &LockFile{
+		Format:    lockFormatVersion,
+		Requested: []string{"foo"},
+		Packages: []LockedPackage{
+			{Name: "zlib", Version: "1.3.1", Arch: "aarch64", OhosApi: "12", SHA256: "b", URL: "channels/stable/pkgs/zlib.pkg"},
+			{Name: "foo", Version: "1.0.0", Arch: "aarch64", OhosApi: "12", SHA256: "a", URL: "channels/stable/pkgs/foo.pkg"},
+		},
+	}
+	if err := WriteLockFile(path, lf); err != nil {
+		t.Fatalf("WriteLockFile failed: %v", err)
+	}
+	got, err := ReadLockFile(path)
+	if err != nil {
+		t.Fatalf("ReadLockFile failed: %v", err)
+	}
+	if len(got.Packages) != 2 || got.Packages[0].Name != "foo" || got.Packages[1] != lf.Packages[1] {
+		t.Fatalf("unexpected lock file content: %#v", got.Packages)
+	}
+}
+
+func TestReadLockFileRejectsEmptyLocks(t *testing.T) {
+	for _, content := range []string{`{"format_version": 1}`, `{"format_version": 1, "packages": []}`} {
+		path := filepath.Join(t.TempDir(), DefaultLockFile)
+		mustDo(t, os.WriteFile(path, []byte(content), 0o644))
+		if _, err := ReadLockFile(path); err == nil {
+			t.Fatalf("empty lock file %s accepted", content)
+		}
+	}
+}
+
+func TestLockedEntriesRequireUnchangedArtifacts(t *testing.T) {
+	idx := &meta.Index{Packages: []meta.IndexEntry{
+		{Name: "foo", Version: "1.0.0", Arch: "aarch64", OhosApi: "12", SHA256: "a", URL: "pkgs/foo-1.0.0.pkg"},
+		{Name: "foo", Version: "1.1.0", Arch: "aarch64", OhosApi: "12", SHA256: "c", URL: "pkgs/foo-1.1.0.pkg"},
+		{Name: "zlib", Version: "1.3.1", Arch: "aarch64", OhosApi: "12", SHA256: "new", URL: "pkgs/zlib.pkg"},
+	}}
+	foo := LockedPackage{Name: "foo", Version: "1.0.0", Arch: "aarch64", OhosApi: "12", SHA256: "a", URL: "pkgs/foo-1.0.0.pkg"}
+
+	chosen, err := lockedEntries(&LockFile{Packages: []LockedPackage{foo}}, idx, "12")
+	if err != nil {
+		t.Fatalf("lockedEntries failed: %v", err)
+	}
+	if chosen["foo"].Version != "1.0.0" {
+		t.Fatalf("locked version not honoured: %#v", chosen)
+	}
+
+	lf := &LockFile{Packages: []LockedPackage{
+		foo,
+		{Name: "zlib", Version: "1.3.1", Arch: "aarch64", OhosApi: "12", SHA256: "old", URL: "pkgs/zlib.pkg"},
+		{Name: "bar", Version: "2.0.0", Arch: "aarch64", OhosApi: "12", SHA256: "d", URL: "pkgs/bar.pkg"},
+	}}
+	_, err = lockedEntries(lf, idx, "12")
+	if err == nil {
+		t.Fatalf("expected unavailable artifacts to be reported")
+	}
+	for _, want := range []string{"zlib 1.3.1 (aarch64): checksum changed", "bar 2.0.0 (aarch64): not in the repository anymore"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("missing %q in error:\n%v", want, err)
+		}
+	}
+
+	if _, err := lockedEntries(&LockFile{Packages: []LockedPackage{foo}}, idx, "14"); err == nil {
+		t.Fatalf("expected API mismatch to be rejected")
+	}
+}
@@ -0,0 +1,144 @@
+package pkgclient
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SSRVodka/oh-packager/internal/common"
+)
+
+// mirror selection modes (config.Config.MirrorSelection)
+const (
+	MirrorsInOrder   = "order"
+	MirrorsByLatency = "latency"
+)
+
+// mirrorProbeTimeout bounds the latency measurement of one mirror.
+var mirrorProbeTimeout = 3 * time.Second
+
+// unreachable is the latency of mirrors that didn't answer their probe.
+const unreachable = time.Duration(math.MaxInt64)
+
+// findRepo returns the repository named name. Entries without a repository
+// (e.g. from lock files written before repositories had names) come from root_url.
+func (c *Client) findRepo(name string) repository {
+	for _, r := range c.repositories() {
+		if r.Name == name {
+			return r
+		}
+	}
+	return repository{Name: DefaultRepoName, URL: localRepoURL(c.Config.RootURL), Channel: c.Config.Channel, Mirrors: c.Config.Mirrors, AllowUnsigned: c.Config.AllowUnsigned}
+}
+
+// recordMirrors remembers the mirrors advertised by the index of repo. Invalid URLs are ignored.
+func (c *Client) recordMirrors(repo repository, mirrors []string) {
+	valid := []string{}
+	for _, m := range mirrors {
+		if !common.IsValidHttpUrl(m) {
+			c.logf(" - WARN: ignoring invalid mirror '%s' advertised by repository '%s'\n", m, repo.Name)
+			continue
+		}
+		valid = append(valid, m)
+	}
+	c.mirrorMu.Lock()
+	defer c.mirrorMu.Unlock()
+	if c.advertised == nil {
+		c.advertised = map[string][]string{}
+	}
+	c.advertised[repo.Name] = valid
+}
+
+// mirrorBases returns the base URLs repo is served from, in the order they are tried:
+// the repository URL, its configured mirrors, then the mirrors advertised by its index.
+// With the "latency" selection they are sorted by their measured latency instead.
+func (c *Client) mirrorBases(repo repository) []string {
+	c.mirrorMu.Lock()
+	advertised := c.advertised[repo.Name]
+	c.mirrorMu.Unlock()
+
+	bases := []string{}
+	seen := map[string]bool{}
+	for _, u := range append(append([]string{repo.URL}, repo.Mirrors...), advertised...) {
+		key := strings.TrimRight(u, "/")
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		bases = append(bases, u)
+	}
+	if c.Config != nil && c.Config.MirrorSelection == MirrorsByLatency && len(bases) > 1 {
+		latency := c.mirrorLatencies(bases)
+		sort.SliceStable(bases, func(i, j int) bool { return latency[bases[i]] < latency[bases[j]] })
+	}
+	return bases
+}
+
+// mirrorLatencies measures the latency of bases concurrently. Measures are kept for the lifetime of c.
+func (c *Client) mirrorLatencies(bases []string) map[string]time.Duration {
+	c.mirrorMu.Lock()
+	if c.latency == nil {
+		c.latency = map[string]time.Duration{}
+	}
+	result := map[string]time.Duration{}
+	probe := []string{}
+	for _, b := range bases {
+		if d, ok := c.latency[b]; ok {
+			result[b] = d
+		} else {
+			probe = append(probe, b)
+		}
+	}
+	c.mirrorMu.Unlock()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, b := range probe {
+		wg.Add(1)
+		go func(b string) {
+			defer wg.Done()
+			d := c.probeMirror(b)
+			mu.Lock()
+			result[b] = d
+			mu.Unlock()
+		}(b)
+	}
+	wg.Wait()
+
+	c.mirrorMu.Lock()
+	for _, b := range probe {
+		c.latency[b] = result[b]
+	}
+	c.mirrorMu.Unlock()
+	return result
+}
+
+// probeMirror returns the time base takes to answer a HEAD request. Any HTTP response counts.
+func (c *Client) probeMirror(base string) time.Duration {
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, strings.TrimRight(base, "/")+"/", nil)
+	if err != nil {
+		return unreachable
+	}
+	start := time.Now()
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return unreachable
+	}
+	resp.Body.Close()
+	return time.Since(start)
+}
+
+// ValidateMirrorSelection checks the mirror_selection setting.
+func ValidateMirrorSelection(mode string) error {
+	if mode != "" && mode != MirrorsInOrder && mode != MirrorsByLatency {
+		return fmt.Errorf("invalid mirror selection '%s' (use '%s' or '%s')", mode, MirrorsInOrder, MirrorsByLatency)
+	}
+	return nil
+}
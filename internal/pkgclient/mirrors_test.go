@@ -0,0 +1,89 @@
+package pkgclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/SSRVodka/oh-packager/pkg/config"
+	"github.com/SSRVodka/oh-packager/pkg/meta"
+)
+
+func TestDownloadFailsOverToMirrors(t *testing.T) {
+	content := []byte("package content")
+	sum := sha256.Sum256(content)
+	entry := meta.IndexEntry{Name: "zlib", Version: "1.3.1", Arch: "aarch64", OhosApi: "12",
+		URL: "channels/stable/pkgs/zlib-1.3.1.pkg", SHA256: hex.EncodeToString(sum[:])}
+
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(content) }))
+	defer good.Close()
+	corrupt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("tampered content")) }))
+	defer corrupt.Close()
+	// the repository serves its index, advertising the good mirror, but lost its packages
+	b, err := json.Marshal(meta.Index{Channel: "stable", Mirrors: []string{good.URL, "ftp://bad.example.com"}, Packages: []meta.IndexEntry{entry}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/channels/stable/index.json" {
+			w.Write(b)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer primary.Close()
+
+	cfg := &config.Config{RootURL: primary.URL, Channel: "stable", Mirrors: []string{corrupt.URL}, AllowUnsigned: true}
+	c := &Client{Config: cfg, Cache: t.TempDir(), HTTP: primary.Client()}
+	idx, err := c.loadIndex()
+	if err != nil {
+		t.Fatalf("loadIndex failed: %v", err)
+	}
+	bases := c.mirrorBases(c.findRepo(DefaultRepoName))
+	if len(bases) != 3 || bases[0] != primary.URL || bases[1] != corrupt.URL || bases[2] != good.URL {
+		t.Fatalf("mirrors tried in the wrong order: %v", bases)
+	}
+
+	// the corrupt mirror is skipped: every download is still checked against the index
+	pkgPath, source, err := c.download(context.Background(), idx.Packages[0])
+	if err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	if want := good.URL + "/" + entry.URL; source != want {
+		t.Fatalf("package downloaded from %s, want %s", source, want)
+	}
+	if got, err := os.ReadFile(pkgPath); err != nil || string(got) != string(content) {
+		t.Fatalf("downloaded %q, %v", got, err)
+	}
+
+	// the index is fetched from a mirror when the repository is down
+	primary.Close()
+	cfg.Mirrors = []string{corrupt.URL, good.URL}
+	good.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(b) })
+	if idx, err := c.loadIndex(); err != nil || len(idx.Packages) != 1 {
+		t.Fatalf("index not fetched from a mirror: %v", err)
+	}
+}
+
+func TestMirrorSelectionByLatency(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { time.Sleep(200 * time.Millisecond) }))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+
+	cfg := &config.Config{RootURL: slow.URL, Mirrors: []string{"http://127.0.0.1:1", fast.URL}, MirrorSelection: MirrorsByLatency}
+	c := &Client{Config: cfg, HTTP: fast.Client()}
+	bases := c.mirrorBases(c.findRepo(DefaultRepoName))
+	if len(bases) != 3 || bases[0] != fast.URL || bases[1] != slow.URL {
+		t.Fatalf("mirrors not sorted by latency: %v", bases)
+	}
+	if err := ValidateMirrorSelection("random"); err == nil {
+		t.Fatalf("invalid mirror selection accepted")
+	}
+}
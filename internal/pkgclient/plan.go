@@ -0,0 +1,279 @@
+package pkgclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/SSRVodka/oh-packager/internal/common"
+	"github.com/SSRVodka/oh-packager/pkg/meta"
+)
+
+// InstallPlan is what an installation would do, computed without touching the prefix.
+// Packages are listed in installation order.
+type InstallPlan struct {
+	Prefix       string           `json:"prefix"`
+	Arch         string           `json:"arch"`
+	OhosApi      string           `json:"ohos_api"`
+	DownloadSize int64            `json:"download_size"`
+	Packages     []PlannedPackage `json:"packages"`
+}
+
+// PlannedPackage is one resolved package of an InstallPlan.
+type PlannedPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// "install", "upgrade" or "keep" (already installed at this version)
+	Action   string `json:"action"`
+	Previous string `json:"previous_version,omitempty"`
+	// why the package is part of the installation: "requested" or "required by <name> (<spec>)"
+	Reasons []string `json:"reasons"`
+	// repository the package comes from
+	Repo string `json:"repo,omitempty"`
+	// package URL relative to the repository, or local .pkg file
+	Source string `json:"source"`
+	Size   int64  `json:"size"`
+	// bytes still to download (0 for local or cached packages)
+	DownloadSize int64 `json:"download_size"`
+	// paths written to the prefix, relative to it
+	Files      []string           `json:"files,omitempty"`
+	Overwrites []PlannedOverwrite `json:"overwrites,omitempty"`
+	// lifecycle scripts (preinst, postinst, ...) shipped by the package: name -> content
+	Scripts map[string]string `json:"scripts,omitempty"`
+}
+
+// PlannedOverwrite is a file of a package that already exists in the prefix.
+type PlannedOverwrite struct {
+	Path string `json:"path"`
+	// owning package or ownerSdk; empty for files no package owns, which are replaced without a conflict
+	Owner string `json:"owner"`
+	// the file may be replaced: it is unowned or the conflict matches an --overwrite pattern;
+	// otherwise the installation would fail
+	Allowed bool `json:"allowed"`
+}
+
+// installReasons explains why every package of chosen is installed: requested by the user
+// and/or required by other chosen packages.
+func installReasons(requested []string, chosen map[string]meta.IndexEntry) (map[string][]string, error) {
+	reasons := map[string][]string{}
+	for _, r := range requested {
+		name, _, err := parseDependencySpec(strings.TrimSpace(r))
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := chosen[name]; ok && len(reasons[name]) == 0 {
+			reasons[name] = append(reasons[name], "requested")
+		}
+	}
+	names := make([]string, 0, len(chosen))
+	for name := range chosen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, dep := range chosen[name].Depends {
+			depName, _, err := parseDependencySpec(dep)
+			if err != nil {
+				return nil, err
+			}
+			reasons[depName] = append(reasons[depName], fmt.Sprintf("required by %s (%s)", name, dep))
+		}
+	}
+	return reasons, nil
+}
+
+// planInstall computes the InstallPlan of installing chosen into prefix. Packages are downloaded
+// into the cache and extracted into a temporary directory to list their files.
+func (c *Client) planInstall(chosen map[string]meta.IndexEntry, localPkgs map[string]string, requested []string, arch, api, prefix string) (*InstallPlan, error) {
+	reasons, err := installReasons(requested, chosen)
+	if err != nil {
+		return nil, err
+	}
+	db, err := OpenDB(c.DBPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	order := c.installOrder(chosen)
+	plan := &InstallPlan{Prefix: prefix, Arch: arch, OhosApi: api, Packages: []PlannedPackage{}}
+	for _, name := range order {
+		e := chosen[name]
+		p := PlannedPackage{Name: name, Version: e.Version, Action: "install", Reasons: reasons[name], Repo: e.Repo, Source: e.URL, Size: e.Size}
+		installed, err := db.GetInstalled(name, prefix)
+		if err != nil {
+			return nil, err
+		}
+		if installed != nil {
+			p.Action = "upgrade"
+			if installed.Version == e.Version {
+				p.Action = "keep"
+			} else {
+				p.Previous = installed.Version
+			}
+		}
+		if local, ok := localPkgs[name]; ok {
+			p.Repo, p.Source = "", local
+			if info, statErr := os.Stat(local); statErr == nil {
+				p.Size = info.Size()
+			}
+		} else if p.Action != "keep" && !c.isCached(e) {
+			p.DownloadSize = e.Size
+			plan.DownloadSize += e.Size
+		}
+		plan.Packages = append(plan.Packages, p)
+	}
+
+	stageRoot, err := os.MkdirTemp("", "ohla-plan-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(stageRoot)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	steps, err := c.stageInstallSteps(ctx, db, prefix, stageRoot, chosen, localPkgs)
+	if err != nil {
+		return nil, err
+	}
+
+	baseline, err := loadSdkBaseline(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if baseline == nil && c.isSdkPrefix(prefix) {
+		if baseline, err = captureSdkBaseline(db, prefix); err != nil {
+			return nil, err
+		}
+	}
+	conflicts, err := findFileConflicts(db, prefix, steps, baseline, map[string]bool{})
+	if err != nil {
+		return nil, err
+	}
+	unowned, err := findUnownedTargets(db, prefix, steps, conflicts)
+	if err != nil {
+		return nil, err
+	}
+	conflicts = append(conflicts, unowned...)
+
+	byName := map[string]*PlannedPackage{}
+	for i := range plan.Packages {
+		byName[plan.Packages[i].Name] = &plan.Packages[i]
+	}
+	for _, step := range steps {
+		p := byName[step.entry.Name]
+		p.Files = step.relPaths
+		if p.Scripts, err = stagedScripts(step.stageDir); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Path < conflicts[j].Path })
+	for _, conflict := range conflicts {
+		p := byName[conflict.Package]
+		p.Overwrites = append(p.Overwrites, PlannedOverwrite{
+			Path:    conflict.Path,
+			Owner:   conflict.Owner,
+			Allowed: conflict.Owner == "" || matchesOverwrite(c.Overwrite, conflict.Path),
+		})
+	}
+	return plan, nil
+}
+
+// findUnownedTargets finds the staged files of steps that would replace existing files of the prefix
+// no package owns (e.g. copied there by hand). Paths already reported in conflicts are left out.
+// The returned entries have an empty Owner.
+func findUnownedTargets(db *DB, prefix string, steps []*installStep, conflicts []fileConflict) ([]fileConflict, error) {
+	reported := map[string]bool{}
+	for _, conflict := range conflicts {
+		reported[conflict.Path] = true
+	}
+	found := []fileConflict{}
+	for _, step := range steps {
+		for _, rel := range step.relPaths {
+			if reported[rel] {
+				continue
+			}
+			staged, err := os.Lstat(filepath.Join(step.stageDir, filepath.FromSlash(rel)))
+			if err != nil {
+				return nil, err
+			}
+			if staged.IsDir() {
+				continue
+			}
+			existing, err := os.Lstat(filepath.Join(prefix, filepath.FromSlash(rel)))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if existing.IsDir() {
+				continue
+			}
+			owners, err := db.FileOwners(prefix, rel)
+			if err != nil {
+				return nil, err
+			}
+			if len(owners) == 0 {
+				reported[rel] = true
+				found = append(found, fileConflict{Path: rel, Package: step.entry.Name})
+			}
+		}
+	}
+	return found, nil
+}
+
+// isCached reports whether the package of e is in the download cache with the right checksum.
+func (c *Client) isCached(e meta.IndexEntry) bool {
+	ok, err := common.VerifyFileSHA256(c.cachePath(e), e.SHA256)
+	return err == nil && ok
+}
+
+// WriteJSON writes the plan as indented JSON.
+func (p *InstallPlan) WriteJSON(w io.Writer) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// Print shows the plan for humans.
+func (p *InstallPlan) Print() {
+	fmt.Printf("Installation plan (%s, API %s) for %s:\n", p.Arch, p.OhosApi, p.Prefix)
+	for _, pkg := range p.Packages {
+		switch pkg.Action {
+		case "keep":
+			fmt.Printf(" = %s (%s, already installed)\n", pkg.Name, pkg.Version)
+			continue
+		case "upgrade":
+			fmt.Printf(" - %s (%s -> %s)\n", pkg.Name, pkg.Previous, pkg.Version)
+		default:
+			fmt.Printf(" + %s (%s)\n", pkg.Name, pkg.Version)
+		}
+		fmt.Printf("     why: %s\n", strings.Join(pkg.Reasons, "; "))
+		fmt.Printf("     %d files, download %d bytes\n", len(pkg.Files), pkg.DownloadSize)
+		for _, o := range pkg.Overwrites {
+			if o.Owner == "" {
+				fmt.Printf("     overwrites %s (not owned by any package)\n", o.Path)
+			} else if o.Allowed {
+				fmt.Printf("     overwrites %s (owned by %s)\n", o.Path, o.Owner)
+			} else {
+				fmt.Printf("     CONFLICT: %s is owned by %s\n", o.Path, o.Owner)
+			}
+		}
+		for _, script := range common.GetPkgScripts() {
+			if content, ok := pkg.Scripts[script]; ok {
+				fmt.Printf("     ships a %s script (%d lines)\n", script, strings.Count(strings.TrimRight(content, "\n"), "\n")+1)
+			}
+		}
+	}
+	fmt.Printf("Total download: %d bytes\n", p.DownloadSize)
+}
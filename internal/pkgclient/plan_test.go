@@ -0,0 +1,91 @@
+package pkgclient
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/SSRVodka/oh-packager/pkg/meta"
+)
+
+func TestInstallReasonsExplainDependencies(t *testing.T) {
+	chosen := map[string]meta.IndexEntry{
+		"zlib":   {Name: "zlib", Version: "1.3.1"},
+		"libpng": {Name: "libpng", Version: "1.6.43", Depends: []string{"zlib >= 1.2"}},
+		"curl":   {Name: "curl", Version: "8.9.0", Depends: []string{"libpng", "zlib"}},
+	}
+	reasons, err := installReasons([]string{"curl", "zlib >= 1.3"}, chosen)
+	if err != nil {
+		t.Fatalf("installReasons failed: %v", err)
+	}
+	for name, want := range map[string]string{
+		"curl":   "requested",
+		"libpng": "required by curl (libpng)",
+		"zlib":   "requested|required by curl (zlib)|required by libpng (zlib >= 1.2)",
+	} {
+		if got := strings.Join(reasons[name], "|"); got != want {
+			t.Fatalf("reasons of %s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestInstallOrderPutsDependenciesFirst(t *testing.T) {
+	chosen := map[string]meta.IndexEntry{
+		"zlib":    {Name: "zlib", Version: "1.3.1"},
+		"openssl": {Name: "openssl", Version: "3.3.0"},
+		"curl":    {Name: "curl", Version: "8.9.0", Depends: []string{"openssl >= 3", "zlib"}},
+		"libpng":  {Name: "libpng", Version: "1.6.43", Depends: []string{"zlib >= 1.2"}},
+		"app":     {Name: "app", Version: "1.0.0", Depends: []string{"curl", "libpng"}},
+	}
+	c := &Client{Log: &bytes.Buffer{}}
+	for i := 0; i < 5; i++ {
+		if got, want := strings.Join(c.installOrder(chosen), " "), "openssl zlib curl libpng app"; got != want {
+			t.Fatalf("installOrder = %s, want %s", got, want)
+		}
+	}
+}
+
+func TestInstallOrderBreaksDependencyCyclesByName(t *testing.T) {
+	chosen := map[string]meta.IndexEntry{
+		"zlib":   {Name: "zlib", Version: "1.3.1"},
+		"python": {Name: "python", Version: "3.12.4", Depends: []string{"pip", "zlib"}},
+		"pip":    {Name: "pip", Version: "24.0", Depends: []string{"python >= 3.8"}},
+	}
+	for i := 0; i < 5; i++ {
+		var log bytes.Buffer
+		c := &Client{Log: &log}
+		if got, want := strings.Join(c.installOrder(chosen), " "), "zlib pip python"; got != want {
+			t.Fatalf("installOrder = %s, want %s", got, want)
+		}
+		if !strings.Contains(log.String(), "dependency cycle: installing pip before its dependencies python") {
+			t.Fatalf("no warning about the cycle, log:\n%s", log.String())
+		}
+	}
+}
+
+func TestPlanListsUnownedFilesItOverwrites(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	prefix := t.TempDir()
+	pkgPath := filepath.Join(t.TempDir(), "foo-1.0.0.pkg")
+	writeTestPkg(t, pkgPath, map[string]string{"include/foo.h": "foo", "lib/libfoo.so": "new foo", "share/doc/": ""})
+	// copied into the prefix by hand
+	writeTestFile(t, prefix, "lib/libfoo.so", "old foo")
+	writeTestFile(t, prefix, "share/doc/README", "docs")
+
+	var log bytes.Buffer
+	c := &Client{DBPath: filepath.Join(t.TempDir(), "installed.db"), Log: &log}
+	plan, err := c.planInstall(map[string]meta.IndexEntry{"foo": testEntry("foo", "1.0.0")}, map[string]string{"foo": pkgPath},
+		[]string{"foo"}, "aarch64", "12", prefix)
+	if err != nil {
+		t.Fatalf("planInstall failed: %v", err)
+	}
+	want := []PlannedOverwrite{{Path: "lib/libfoo.so", Allowed: true}}
+	if got := plan.Packages[0].Overwrites; len(got) != 1 || got[0] != want[0] {
+		t.Fatalf("overwrites = %+v, want %+v", got, want)
+	}
+	assertFileContent(t, prefix, "lib/libfoo.so", "old foo")
+	if !strings.Contains(log.String(), "Extracting foo 1.0.0") {
+		t.Fatalf("progress not written to the log writer:\n%s", log.String())
+	}
+}
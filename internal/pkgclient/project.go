@@ -0,0 +1,128 @@
+package pkgclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/SSRVodka/oh-packager/internal/common"
+)
+
+// ProjectFileName is the project file looked up from the working directory upwards.
+const ProjectFileName = "ohla.json"
+
+// placeholder of Project.Prefix replaced by each target arch
+const archPlaceholder = "{arch}"
+
+// Project declares the native dependencies of an application repository.
+type Project struct {
+	// dependency specs, same syntax as package dependencies (e.g. "zlib >= 1.3")
+	Packages []string `json:"packages"`
+	// target arches (default: the configured arch)
+	Arches []string `json:"arches,omitempty"`
+	// install prefix relative to the project file directory; may contain "{arch}".
+	// Empty prefix indicates OHOS sdk
+	Prefix string `json:"prefix,omitempty"`
+
+	// directory of the project file
+	Dir string `json:"-"`
+}
+
+// FindProjectFile looks for ProjectFileName in dir and its parents.
+func FindProjectFile(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		candidate := filepath.Join(dir, ProjectFileName)
+		if common.IsFileExists(candidate) {
+			return candidate, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("no %s found in the current directory or its parents", ProjectFileName)
+		}
+		dir = parent
+	}
+}
+
+// LoadProject reads and validates a project file.
+func LoadProject(path string) (*Project, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p Project
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("invalid project file '%s': %v", path, err)
+	}
+	p.Dir = filepath.Dir(path)
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("invalid project file '%s': %v", path, err)
+	}
+	return &p, nil
+}
+
+func (p *Project) validate() error {
+	if len(p.Packages) == 0 {
+		return errors.New("no packages declared")
+	}
+	for _, spec := range p.Packages {
+		if _, _, err := common.ParseDependencySpec(spec); err != nil {
+			return fmt.Errorf("package '%s': %v", spec, err)
+		}
+	}
+	for i, arch := range p.Arches {
+		var err error
+		if p.Arches[i], err = common.MapArchStr(arch); err != nil {
+			return err
+		}
+	}
+	if len(p.Arches) > 1 && !strings.Contains(p.Prefix, archPlaceholder) {
+		return fmt.Errorf("prefix must contain '%s' when targeting several arches", archPlaceholder)
+	}
+	return nil
+}
+
+// PrefixFor returns the absolute install prefix of arch ("" for OHOS sdk).
+func (p *Project) PrefixFor(arch string) string {
+	if p.Prefix == "" {
+		return ""
+	}
+	prefix := strings.ReplaceAll(p.Prefix, archPlaceholder, arch)
+	if !filepath.IsAbs(prefix) {
+		prefix = filepath.Join(p.Dir, prefix)
+	}
+	return filepath.Clean(prefix)
+}
+
+// InstallProject installs the packages declared by the project file at projectPath for each of its arches.
+func (c *Client) InstallProject(projectPath string, noConfirm bool) error {
+	p, err := LoadProject(projectPath)
+	if err != nil {
+		return err
+	}
+	arches := p.Arches
+	if len(arches) == 0 {
+		arches = []string{common.DefaultArch()}
+	}
+	for _, arch := range arches {
+		prefix := p.PrefixFor(arch)
+		if prefix == "" {
+			if prefix, err = c.sdkPrefix(); err != nil {
+				return err
+			}
+		} else if err := os.MkdirAll(prefix, 0o755); err != nil {
+			return err
+		}
+		c.logf("==> %s: installing %s into %s\n", arch, strings.Join(p.Packages, ", "), prefix)
+		if err := c.install(p.Packages, arch, prefix, noConfirm, false); err != nil {
+			return fmt.Errorf("%s: %w", arch, err)
+		}
+	}
+	return nil
+}
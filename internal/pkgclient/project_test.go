@@ -0,0 +1,70 @@
+package pkgclient
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindAndLoadProject(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, ProjectFileName, `{
+  "packages": ["zlib >= 1.3", "console_bridge"],
+  "arches": ["aarch64", "x86_64"],
+  "prefix": "native/{arch}"
+}`)
+	nested := filepath.Join(root, "src", "app")
+	if err := os.MkdirAll(nested, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := FindProjectFile(nested)
+	if err != nil {
+		t.Fatalf("FindProjectFile failed: %v", err)
+	}
+	if path != filepath.Join(root, ProjectFileName) {
+		t.Fatalf("FindProjectFile = %s", path)
+	}
+	p, err := LoadProject(path)
+	if err != nil {
+		t.Fatalf("LoadProject failed: %v", err)
+	}
+	if got, want := p.PrefixFor("x86_64"), filepath.Join(root, "native", "x86_64"); got != want {
+		t.Fatalf("PrefixFor = %s, want %s", got, want)
+	}
+}
+
+func TestLoadProjectNormalizesArchAliases(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, ProjectFileName, `{
+  "packages": ["zlib"],
+  "arches": ["arm64", "amd64"],
+  "prefix": "native/{arch}"
+}`)
+	p, err := LoadProject(filepath.Join(root, ProjectFileName))
+	if err != nil {
+		t.Fatalf("LoadProject failed: %v", err)
+	}
+	if len(p.Arches) != 2 || p.Arches[0] != "aarch64" || p.Arches[1] != "x86_64" {
+		t.Fatalf("Arches = %v, want [aarch64 x86_64]", p.Arches)
+	}
+	if got, want := p.PrefixFor(p.Arches[0]), filepath.Join(root, "native", "aarch64"); got != want {
+		t.Fatalf("PrefixFor = %s, want %s", got, want)
+	}
+}
+
+func TestLoadProjectRejectsInvalidFiles(t *testing.T) {
+	for name, content := range map[string]string{
+		"no packages":     `{"packages": []}`,
+		"bad constraint":  `{"packages": ["zlib >>= 1"]}`,
+		"bad arch":        `{"packages": ["zlib"], "arches": ["mips"]}`,
+		"shared prefix":   `{"packages": ["zlib"], "arches": ["aarch64", "x86_64"], "prefix": "dist"}`,
+		"not json object": `["zlib"]`,
+	} {
+		dir := t.TempDir()
+		writeTestFile(t, dir, ProjectFileName, content)
+		if _, err := LoadProject(filepath.Join(dir, ProjectFileName)); err == nil {
+			t.Fatalf("%s: expected LoadProject to fail", name)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package pkgclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/SSRVodka/oh-packager/internal/common"
+	"github.com/SSRVodka/oh-packager/pkg/meta"
+)
+
+// queryPrefix returns prefix, or the OHOS sdk prefix if prefix is empty.
+func (c *Client) queryPrefix(prefix string) (string, error) {
+	if prefix == "" {
+		return c.sdkPrefix()
+	}
+	return common.GetAbsolutePath(prefix)
+}
+
+// Info prints the metadata of a package from the channel index (and its manifest)
+// together with its installed state in prefix. Empty prefix indicates OHOS sdk.
+func (c *Client) Info(pkgName, prefix, arch string) error {
+	prefix, err := c.queryPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	db, err := OpenDB(c.DBPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	installed, err := db.GetInstalled(pkgName, prefix)
+	if err != nil {
+		return err
+	}
+	if installed != nil && arch == "" {
+		arch = installed.Arch
+	}
+	if arch == "" {
+		arch = common.DefaultArch()
+	}
+
+	// remote metadata: the installed version if the repository still has it, else the latest
+	var versions []meta.IndexEntry
+	var remoteErr error
+	if err := c.checkRepos(); err != nil {
+		remoteErr = err
+	} else if idx, err := c.loadIndex(); err != nil {
+		remoteErr = err
+	} else {
+		for _, e := range idx.Packages {
+			if e.Name == pkgName && e.Arch == arch {
+				versions = append(versions, e)
+			}
+		}
+		sortCandidates(versions, repoRanks(idx))
+	}
+	if len(versions) == 0 && installed == nil {
+		if remoteErr != nil {
+			return remoteErr
+		}
+		return fmt.Errorf("package %s (%s) not found in the repository", pkgName, arch)
+	}
+
+	if len(versions) > 0 {
+		entry := versions[0]
+		for _, e := range versions {
+			if installed != nil && e.Version == installed.Version {
+				entry = e
+				break
+			}
+		}
+		m, err := c.fetchManifest(entry)
+		if err != nil {
+			fmt.Printf("WARN: %v\n", err)
+		}
+		printManifest(m)
+		all := make([]string, 0, len(versions))
+		for _, e := range versions {
+			if len(c.repositories()) > 1 {
+				all = append(all, e.Version+" ["+e.Repo+"]")
+			} else {
+				all = append(all, e.Version)
+			}
+		}
+		printInfoField("Available", strings.Join(all, ", "))
+	} else {
+		fmt.Printf("WARN: package metadata unavailable (%v)\n", remoteErr)
+		printInfoField("Name", installed.Name)
+		printInfoField("Version", installed.Version)
+		printInfoField("Arch", installed.Arch)
+		printInfoField("Depends", strings.Join(installed.Depends, ", "))
+	}
+
+	if installed == nil {
+		printInfoField("Installed", "no")
+		return nil
+	}
+	files, err := db.GetInstalledFiles(pkgName, prefix)
+	if err != nil {
+		return err
+	}
+	printInfoField("Installed", fmt.Sprintf("%s in %s", installed.Version, prefix))
+	printInfoField("Install Date", installed.When.Local().Format("2006-01-02 15:04:05"))
+	if installed.Source != "" {
+		printInfoField("Downloaded From", installed.Source)
+	}
+	printInfoField("Files", fmt.Sprintf("%d", len(files)))
+	return nil
+}
+
+// fetchManifest downloads the manifest of entry. If the repository doesn't provide one,
+// a manifest is built from the index entry.
+func (c *Client) fetchManifest(entry meta.IndexEntry) (*meta.Manifest, error) {
+	fromIndex := &meta.Manifest{
+		Name:    entry.Name,
+		Version: entry.Version,
+		Arch:    entry.Arch,
+		OhosApi: entry.OhosApi,
+		Size:    entry.Size,
+		SHA256:  entry.SHA256,
+		URL:     entry.URL,
+		Depends: entry.Depends,
+	}
+	if entry.Manifest == "" || c.Offline {
+		return fromIndex, nil
+	}
+	var b []byte
+	var err error
+	repo := c.findRepo(entry.Repo)
+	for _, base := range c.mirrorBases(repo) {
+		u := common.JoinURL(base, entry.Manifest)
+		if b, err = common.FetchURL(c.HTTP, u); err == nil {
+			if _, err = c.verifyFetched(repo, u, strings.TrimLeft(entry.Manifest, "/"), b); err == nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return fromIndex, fmt.Errorf("failed to fetch manifest of %s: %v", entry.Name, err)
+	}
+	var m meta.Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fromIndex, fmt.Errorf("invalid manifest of %s: %v", entry.Name, err)
+	}
+	if m.URL == "" {
+		m.URL = entry.URL
+	}
+	return &m, nil
+}
+
+func printManifest(m *meta.Manifest) {
+	printInfoField("Name", m.Name)
+	printInfoField("Version", m.Version)
+	printInfoField("Arch", m.Arch)
+	printInfoField("OHOS API", m.OhosApi)
+	printInfoField("Summary", m.Summary)
+	printInfoField("Description", m.Description)
+	printInfoField("Maintainer", m.Maintainer)
+	printInfoField("License", m.License)
+	printInfoField("Size", fmt.Sprintf("%d bytes", m.Size))
+	printInfoField("SHA256", m.SHA256)
+	printInfoField("URL", m.URL)
+	printInfoField("Provides", strings.Join(m.Provides, ", "))
+	printInfoField("Depends", strings.Join(m.Depends, ", "))
+	if m.Relocatable {
+		printInfoField("Relocatable", "yes")
+	}
+	printInfoField("Install Prefix", m.InstallPrefix)
+}
+
+func printInfoField(key, value string) {
+	if value == "" {
+		value = "None"
+	}
+	fmt.Printf("%-15s: %s\n", key, value)
+}
+
+// Files prints the files installed by a package in prefix. Empty prefix indicates OHOS sdk.
+func (c *Client) Files(pkgName, prefix string) error {
+	prefix, err := c.queryPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	db, err := OpenDB(c.DBPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	installed, err := db.GetInstalled(pkgName, prefix)
+	if err != nil {
+		return err
+	}
+	if installed == nil {
+		return fmt.Errorf("%s not installed in %s", pkgName, prefix)
+	}
+	files, err := db.GetInstalledFiles(pkgName, prefix)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		full := filepath.Join(prefix, filepath.FromSlash(f.Path))
+		if f.Type == FileTypeDir {
+			full += string(filepath.Separator)
+		}
+		fmt.Println(full)
+	}
+	return nil
+}
+
+// Owns prints the package(s) of prefix that installed path. Empty prefix indicates OHOS sdk.
+// path is either a path inside prefix (absolute or relative to the working directory), a path
+// relative to prefix, or a bare file name looked up in every recorded path.
+func (c *Client) Owns(path, prefix string) error {
+	prefix, err := c.queryPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	db, err := OpenDB(c.DBPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rel, inPrefix := relToPrefix(path, prefix)
+	var found []FileOwner
+	if inPrefix {
+		owners, err := db.FileOwners(prefix, rel)
+		if err != nil {
+			return err
+		}
+		for _, o := range owners {
+			found = append(found, FileOwner{Path: rel, Name: o})
+		}
+	}
+	if len(found) == 0 && !strings.ContainsRune(path, filepath.Separator) {
+		if found, err = db.FindFilesByName(prefix, path); err != nil {
+			return err
+		}
+	}
+
+	if len(found) == 0 {
+		baseline, err := loadSdkBaseline(prefix)
+		if err != nil {
+			return err
+		}
+		if _, ok := baseline.lookup(rel); ok && inPrefix {
+			fmt.Printf("%s is shipped by the OHOS SDK\n", filepath.Join(prefix, filepath.FromSlash(rel)))
+			return nil
+		}
+		return fmt.Errorf("no installed package in %s owns %s", prefix, path)
+	}
+	for _, f := range found {
+		inst, err := db.GetInstalled(f.Name, prefix)
+		if err != nil {
+			return err
+		}
+		version := ""
+		if inst != nil {
+			version = " " + inst.Version
+		}
+		fmt.Printf("%s is owned by %s%s\n", filepath.Join(prefix, filepath.FromSlash(f.Path)), f.Name, version)
+	}
+	return nil
+}
+
+// relToPrefix converts path to a slash separated path relative to prefix.
+// Relative paths that don't exist from the working directory are taken as relative to prefix.
+//
+// @return (relative path, whether path is inside prefix)
+func relToPrefix(path, prefix string) (string, bool) {
+	abs := path
+	if !filepath.IsAbs(path) {
+		if _, err := os.Lstat(path); err != nil {
+			abs = filepath.Join(prefix, path)
+		} else if abs, err = filepath.Abs(path); err != nil {
+			return "", false
+		}
+	}
+	rel, err := filepath.Rel(prefix, filepath.Clean(abs))
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
@@ -0,0 +1,222 @@
+package pkgclient
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/SSRVodka/oh-packager/internal/common"
+	"github.com/SSRVodka/oh-packager/pkg/config"
+	"github.com/SSRVodka/oh-packager/pkg/meta"
+	"github.com/blang/semver/v4"
+)
+
+// DefaultRepoName is the name of the repository configured with `ohla config -s` (root_url).
+const DefaultRepoName = "default"
+
+// repository is a package repository packages are resolved from.
+type repository struct {
+	Name     string
+	URL      string
+	Channel  string
+	Priority int
+	// configured mirrors of URL
+	Mirrors []string
+	// signatures are not verified
+	AllowUnsigned bool
+}
+
+// repositories returns the configured repositories, highest priority first.
+// Repositories of the same priority keep the configuration order, root_url first.
+func (c *Client) repositories() []repository {
+	repos := []repository{}
+	if c.Config == nil {
+		return repos
+	}
+	if c.Config.RootURL != "" {
+		repos = append(repos, repository{Name: DefaultRepoName, URL: localRepoURL(c.Config.RootURL), Channel: c.Config.Channel, Mirrors: c.Config.Mirrors, AllowUnsigned: c.Config.AllowUnsigned})
+	}
+	for _, r := range c.Config.Repos {
+		channel := r.Channel
+		if channel == "" {
+			channel = c.Config.Channel
+		}
+		repos = append(repos, repository{Name: r.Name, URL: localRepoURL(r.URL), Channel: channel, Priority: r.Priority, Mirrors: r.Mirrors, AllowUnsigned: r.AllowUnsigned})
+	}
+	sort.SliceStable(repos, func(i, j int) bool { return repos[i].Priority > repos[j].Priority })
+	return repos
+}
+
+// localRepoURL turns the absolute path of a local repository, as written by hand in the config,
+// into a file:// URL. Other URLs are returned as they are.
+func localRepoURL(repoURL string) string {
+	if !filepath.IsAbs(repoURL) {
+		return repoURL
+	}
+	if u, err := common.FileURL(repoURL); err == nil {
+		return u
+	}
+	return repoURL
+}
+
+// checkRepos fails if no repository is configured.
+func (c *Client) checkRepos() error {
+	if len(c.repositories()) == 0 {
+		return errors.New("repo URL not configured (use --help for more info)")
+	}
+	return nil
+}
+
+// repoIndex returns the local index of repo (see Update). Repositories without one
+// are fetched first, except offline.
+func (c *Client) repoIndex(repo repository) (*meta.Index, error) {
+	idx, state, err := c.storedRepoIndex(repo)
+	if err == nil {
+		if time.Since(state.Checked) > staleIndexAge {
+			c.logf(" - WARN: the local index of '%s' was updated %s, run `ohla update` to refresh it\n", repo.Name, indexAge(state))
+		}
+		return idx, nil
+	}
+	if c.Offline {
+		if errors.Is(err, errNoLocalIndex) {
+			return nil, fmt.Errorf("no local index of channel '%s' (run `ohla update` without --offline first)", repo.Channel)
+		}
+		return nil, err
+	}
+	if c.IndexDir != "" {
+		c.logf(" - fetching the index of '%s' (%v)\n", repo.Name, err)
+	}
+	idx, _, err = c.updateRepoIndex(repo)
+	return idx, err
+}
+
+// loadIndex merges the local indexes of every repository (see repoIndex), highest priority first.
+// Entries are tagged with their repository; pinned packages only come from the repository they are pinned to.
+func (c *Client) loadIndex() (*meta.Index, error) {
+	if err := c.checkRepos(); err != nil {
+		return nil, err
+	}
+	repos := c.repositories()
+	known := map[string]bool{}
+	for _, r := range repos {
+		known[r.Name] = true
+	}
+	for name, repo := range c.Config.Pins {
+		if !known[repo] {
+			return nil, fmt.Errorf("package %s is pinned to the unknown repository '%s'", name, repo)
+		}
+	}
+
+	merged := &meta.Index{Channel: c.Config.Channel}
+	for _, repo := range repos {
+		idx, err := c.repoIndex(repo)
+		if err != nil {
+			if len(repos) == 1 {
+				return nil, err
+			}
+			return nil, fmt.Errorf("repository '%s': %v", repo.Name, err)
+		}
+		c.recordMirrors(repo, idx.Mirrors)
+		if len(repos) == 1 {
+			merged.Repo, merged.Channel, merged.Generated, merged.Mirrors = idx.Repo, idx.Channel, idx.Generated, idx.Mirrors
+		}
+		for _, e := range idx.Packages {
+			if pin, ok := c.Config.Pins[e.Name]; ok && pin != repo.Name {
+				continue
+			}
+			e.Repo = repo.Name
+			merged.Packages = append(merged.Packages, e)
+		}
+	}
+	return merged, nil
+}
+
+// sortCandidates orders the entries of one package: entries of higher priority repositories
+// (earlier in a merged index, see rank) first, then the latest versions first.
+func sortCandidates(list []meta.IndexEntry, rank map[string]int) {
+	sort.SliceStable(list, func(i, j int) bool {
+		if ri, rj := rank[list[i].Repo], rank[list[j].Repo]; ri != rj {
+			return ri < rj
+		}
+		vi, _ := semver.ParseTolerant(list[i].Version)
+		vj, _ := semver.ParseTolerant(list[j].Version)
+		return vi.GT(vj)
+	})
+}
+
+// repoRanks numbers the repositories of a merged index in the order they appear.
+func repoRanks(idx *meta.Index) map[string]int {
+	rank := map[string]int{}
+	for _, e := range idx.Packages {
+		if _, ok := rank[e.Repo]; !ok {
+			rank[e.Repo] = len(rank)
+		}
+	}
+	return rank
+}
+
+// ValidateRepo checks a repository before it is added to cfg. It returns the repository
+// with its URLs normalized (see common.NormalizeRepoURL).
+func ValidateRepo(cfg *config.Config, repo config.RepoConfig) (config.RepoConfig, error) {
+	if repo.Name == "" || strings.ContainsAny(repo.Name, " \t/") {
+		return repo, fmt.Errorf("invalid repository name '%s'", repo.Name)
+	}
+	if repo.Name == DefaultRepoName {
+		return repo, fmt.Errorf("'%s' is the repository set with `ohla config -s`", DefaultRepoName)
+	}
+	for _, r := range cfg.Repos {
+		if r.Name == repo.Name {
+			return repo, fmt.Errorf("repository '%s' already exists", repo.Name)
+		}
+	}
+	var err error
+	if repo.URL, err = common.NormalizeRepoURL(repo.URL); err != nil {
+		return repo, err
+	}
+	repo.Mirrors, err = NormalizeMirrors(repo.Mirrors)
+	return repo, err
+}
+
+// NormalizeMirrors checks the configured mirrors of a repository, see common.NormalizeRepoURL.
+func NormalizeMirrors(mirrors []string) ([]string, error) {
+	normalized := make([]string, 0, len(mirrors))
+	for _, m := range mirrors {
+		u, err := common.NormalizeRepoURL(m)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mirror: %v", err)
+		}
+		normalized = append(normalized, u)
+	}
+	return normalized, nil
+}
+
+// PrintRepos lists the configured repositories, highest priority first, with the age of their local index.
+func (c *Client) PrintRepos() {
+	cfg := c.Config
+	repos := c.repositories()
+	if len(repos) == 0 {
+		fmt.Println("no repositories configured")
+		return
+	}
+	for _, r := range repos {
+		updated := "never updated"
+		if state, err := c.readIndexState(r); err == nil {
+			updated = "updated " + indexAge(state)
+		}
+		fmt.Printf("%s\tpriority %d\tchannel %s\t%s\t%s\n", r.Name, r.Priority, r.Channel, common.RedactURL(r.URL), updated)
+		for _, m := range r.Mirrors {
+			fmt.Printf("\tmirror %s\n", common.RedactURL(m))
+		}
+	}
+	pinned := make([]string, 0, len(cfg.Pins))
+	for name := range cfg.Pins {
+		pinned = append(pinned, name)
+	}
+	sort.Strings(pinned)
+	for _, name := range pinned {
+		fmt.Printf("pin: %s -> %s\n", name, cfg.Pins[name])
+	}
+}
@@ -0,0 +1,139 @@
+package pkgclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/SSRVodka/oh-packager/internal/common"
+	"github.com/SSRVodka/oh-packager/pkg/config"
+	"github.com/SSRVodka/oh-packager/pkg/meta"
+)
+
+func serveIndex(t *testing.T, channel string, entries ...meta.IndexEntry) *httptest.Server {
+	t.Helper()
+	b, err := json.Marshal(meta.Index{Channel: channel, Packages: entries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/channels/"+channel+"/index.json", func(w http.ResponseWriter, r *http.Request) { w.Write(b) })
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestMultipleRepositoriesWithPriorities(t *testing.T) {
+	entry := func(name, version string, depends ...string) meta.IndexEntry {
+		return meta.IndexEntry{Name: name, Version: version, Arch: "aarch64", OhosApi: "12",
+			URL: "packages/" + name + "-" + version + ".pkg", Depends: depends}
+	}
+	public := serveIndex(t, "stable", entry("zlib", "1.3.1"), entry("curl", "8.9.0", "zlib"), entry("openssl", "3.3.0"))
+	internal := serveIndex(t, "team", entry("zlib", "1.2.13"), entry("openssl", "3.0.14"))
+
+	cfg := &config.Config{
+		RootURL:       public.URL,
+		Channel:       "stable",
+		AllowUnsigned: true,
+		Repos:         []config.RepoConfig{{Name: "internal", URL: internal.URL, Channel: "team", Priority: 10, AllowUnsigned: true}},
+		Pins:          map[string]string{"openssl": DefaultRepoName},
+	}
+	c := &Client{Config: cfg, HTTP: public.Client()}
+	idx, err := c.loadIndex()
+	if err != nil {
+		t.Fatalf("loadIndex failed: %v", err)
+	}
+	if len(idx.Packages) != 4 {
+		t.Fatalf("merged index has %d packages, want 4 (the pinned openssl of 'internal' dropped)", len(idx.Packages))
+	}
+
+	chosen, _, err := resolveWithPins(idx, []string{"curl", "openssl"}, "aarch64", "12", nil)
+	if err != nil {
+		t.Fatalf("resolution failed: %v", err)
+	}
+	for name, want := range map[string]string{"curl": "default 8.9.0", "zlib": "internal 1.2.13", "openssl": "default 3.3.0"} {
+		if got := chosen[name].Repo + " " + chosen[name].Version; got != want {
+			t.Fatalf("%s resolved to %s, want %s", name, got, want)
+		}
+	}
+	if got, want := c.findRepo(chosen["zlib"].Repo).URL, internal.URL; got != want {
+		t.Fatalf("zlib downloaded from %s, want %s", got, want)
+	}
+
+	// lower priority repositories still satisfy constraints the preferred one can't
+	chosen, _, err = resolveWithPins(idx, []string{"zlib >= 1.3"}, "aarch64", "12", nil)
+	if err != nil || chosen["zlib"].Repo != DefaultRepoName {
+		t.Fatalf("zlib >= 1.3 resolved to %+v, %v", chosen["zlib"], err)
+	}
+
+	// lock files keep the repository packages were resolved from
+	lf := &LockFile{Packages: []LockedPackage{
+		{Name: "zlib", Version: "1.3.1", Arch: "aarch64", OhosApi: "12", URL: "packages/zlib-1.3.1.pkg", Repo: DefaultRepoName},
+	}}
+	locked, err := lockedEntries(lf, idx, "12")
+	if err != nil || locked["zlib"].Repo != DefaultRepoName {
+		t.Fatalf("locked zlib: %+v, %v", locked["zlib"], err)
+	}
+
+	cfg.Pins["zlib"] = "nowhere"
+	if _, err := c.loadIndex(); err == nil {
+		t.Fatalf("pin to an unknown repository accepted")
+	}
+}
+
+func TestLocalFilesystemRepository(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("package content")
+	sum := sha256.Sum256(content)
+	entry := meta.IndexEntry{Name: "zlib", Version: "1.3.1", Arch: "aarch64", OhosApi: "12",
+		URL: "channels/stable/pkgs/zlib 1.3.1.pkg", SHA256: hex.EncodeToString(sum[:])}
+	b, err := json.Marshal(meta.Index{Channel: "stable", Packages: []meta.IndexEntry{entry}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustDo(t, os.MkdirAll(filepath.Join(dir, "channels", "stable", "pkgs"), 0o755))
+	mustDo(t, os.WriteFile(filepath.Join(dir, "channels", "stable", "index.json"), b, 0o644))
+	mustDo(t, os.WriteFile(filepath.Join(dir, filepath.FromSlash(entry.URL)), content, 0o644))
+
+	// plain paths are turned into file:// URLs
+	rootURL, err := common.NormalizeRepoURL(dir)
+	if err != nil || !strings.HasPrefix(rootURL, "file:///") {
+		t.Fatalf("normalized %s to %s, %v", dir, rootURL, err)
+	}
+	if again, err := common.NormalizeRepoURL(rootURL); err != nil || again != rootURL {
+		t.Fatalf("normalized %s to %s, %v", rootURL, again, err)
+	}
+	for _, bad := range []string{filepath.Join(dir, "missing"), "ftp://example.com/repo", "file://relative/repo"} {
+		if _, err := common.NormalizeRepoURL(bad); err == nil {
+			t.Fatalf("invalid repository %s accepted", bad)
+		}
+	}
+
+	cfg := &config.Config{RootURL: rootURL, Channel: "stable", AllowUnsigned: true}
+	c := &Client{Config: cfg, Cache: t.TempDir(), HTTP: newHTTPClient(cfg)}
+	idx, err := c.loadIndex()
+	if err != nil || len(idx.Packages) != 1 {
+		t.Fatalf("loadIndex failed: %v", err)
+	}
+	pkgPath, _, err := c.download(context.Background(), idx.Packages[0])
+	if err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	if got, err := os.ReadFile(pkgPath); err != nil || string(got) != string(content) {
+		t.Fatalf("copied %q, %v", got, err)
+	}
+
+	// packages read from disk are verified like downloaded ones
+	mustDo(t, os.Remove(pkgPath))
+	mustDo(t, os.WriteFile(filepath.Join(dir, filepath.FromSlash(entry.URL)), []byte("tampered content"), 0o644))
+	if _, _, err := c.download(context.Background(), idx.Packages[0]); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("tampered package accepted: %v", err)
+	}
+}
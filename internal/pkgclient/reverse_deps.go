@@ -0,0 +1,82 @@
+package pkgclient
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// reverseDep is an installed package that (transitively) depends on a package being removed.
+// Chain goes from the dependent package down to the removed one, e.g. [curl libpng zlib].
+type reverseDep struct {
+	Name  string
+	Chain []string
+}
+
+func (r reverseDep) String() string {
+	return strings.Join(r.Chain, " -> ")
+}
+
+// reverseDependencies computes the installed packages that depend on any of targets,
+// directly or transitively, using the dependencies recorded at installation time.
+// Targets themselves are never reported.
+func reverseDependencies(installed []Installed, targets []string) []reverseDep {
+	dependents := map[string][]string{}
+	for _, inst := range installed {
+		for _, dep := range inst.Depends {
+			depName := dependencyName(dep)
+			dependents[depName] = append(dependents[depName], inst.Name)
+		}
+	}
+	for name := range dependents {
+		sort.Strings(dependents[name])
+	}
+
+	isTarget := map[string]bool{}
+	for _, t := range targets {
+		isTarget[t] = true
+	}
+
+	// BFS from the targets; the first visit gives the shortest chain
+	chains := map[string][]string{}
+	queue := append([]string(nil), targets...)
+	sort.Strings(queue)
+	for _, t := range queue {
+		chains[t] = []string{t}
+	}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, d := range dependents[cur] {
+			if _, seen := chains[d]; seen {
+				continue
+			}
+			chains[d] = append([]string{d}, chains[cur]...)
+			queue = append(queue, d)
+		}
+	}
+
+	result := []reverseDep{}
+	for name, chain := range chains {
+		if isTarget[name] {
+			continue
+		}
+		result = append(result, reverseDep{Name: name, Chain: chain})
+	}
+	// longest chains first, so that dependents are listed (and removed) before what they use
+	sort.Slice(result, func(i, j int) bool {
+		if len(result[i].Chain) != len(result[j].Chain) {
+			return len(result[i].Chain) > len(result[j].Chain)
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+func formatReverseDeps(rdeps []reverseDep) string {
+	lines := make([]string, 0, len(rdeps))
+	for _, r := range rdeps {
+		lines = append(lines, fmt.Sprintf("  %s", r))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,32 @@
+package pkgclient
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReverseDependenciesReportsChains(t *testing.T) {
+	installed := []Installed{
+		{Name: "zlib", Version: "1.3.1"},
+		{Name: "libpng", Version: "1.6.43", Depends: []string{"zlib>=1.2"}},
+		{Name: "curl", Version: "8.9.0", Depends: []string{"libpng", "openssl"}},
+		{Name: "openssl", Version: "3.3.0"},
+	}
+
+	rdeps := reverseDependencies(installed, []string{"zlib"})
+	got := make([]string, 0, len(rdeps))
+	for _, r := range rdeps {
+		got = append(got, r.String())
+	}
+	want := []string{"curl -> libpng -> zlib", "libpng -> zlib"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("reverseDependencies = %q, want %q", got, want)
+	}
+
+	if rdeps := reverseDependencies(installed, []string{"zlib", "libpng", "curl"}); len(rdeps) != 0 {
+		t.Fatalf("removing the whole chain reported dependents: %v", rdeps)
+	}
+	if rdeps := reverseDependencies(installed, []string{"curl"}); len(rdeps) != 0 {
+		t.Fatalf("leaf package reported dependents: %v", rdeps)
+	}
+}
@@ -0,0 +1,221 @@
+package pkgclient
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/SSRVodka/oh-packager/internal/common"
+)
+
+// values of OHLA_ACTION passed to lifecycle scripts
+const (
+	actionInstall = "install"
+	actionUpgrade = "upgrade"
+	actionRemove  = "remove"
+)
+
+// script policies (--scripts)
+const (
+	ScriptsAsk     = "ask"     // show scripts of untrusted packages and ask before running them
+	ScriptsNever   = "never"   // never run package scripts
+	ScriptsTrusted = "trusted" // run every package script without asking
+)
+
+// ValidateScriptPolicy checks a --scripts value.
+func ValidateScriptPolicy(policy string) error {
+	switch policy {
+	case ScriptsAsk, ScriptsNever, ScriptsTrusted:
+		return nil
+	}
+	return fmt.Errorf("invalid script policy '%s' (expected %s, %s or %s)", policy, ScriptsNever, ScriptsAsk, ScriptsTrusted)
+}
+
+// scriptTarget is the package a lifecycle script runs for.
+type scriptTarget struct {
+	Name    string
+	Version string
+	Arch    string
+	Action  string
+	// sha256 of the package file and name of its repository, used for the trusted scripts allowlist
+	SHA256 string
+	Repo   string
+}
+
+// scriptEnv returns the documented environment of lifecycle scripts:
+// OHLA_PREFIX, OHLA_ARCH, OHLA_API, OHLA_PKG_NAME, OHLA_PKG_VERSION, OHLA_ACTION and OHOS_SDK.
+func (c *Client) scriptEnv(prefix string, target scriptTarget) []string {
+	sdk, api := "", ""
+	if c.Config != nil {
+		sdk = c.Config.OhosSdk
+		if info, err := common.LoadLocalSdkInfo(sdk); err == nil {
+			api = info.ApiVersion
+		}
+	}
+	return []string{
+		"OHLA_PREFIX=" + prefix,
+		"OHLA_ARCH=" + target.Arch,
+		"OHLA_API=" + api,
+		"OHLA_PKG_NAME=" + target.Name,
+		"OHLA_PKG_VERSION=" + target.Version,
+		"OHLA_ACTION=" + target.Action,
+		"OHOS_SDK=" + sdk,
+	}
+}
+
+// scriptTrusted reports whether the scripts of target may run without confirmation: the checksum
+// of its package must be allowlisted for the repository it comes from (root_url for packages installed
+// without resolution). Packages of repositories that are not configured anymore are never trusted.
+func (c *Client) scriptTrusted(target scriptTarget) bool {
+	if c.Config == nil || target.SHA256 == "" {
+		return false
+	}
+	repo := c.findRepo(target.Repo)
+	if target.Repo != "" && repo.Name != target.Repo {
+		return false
+	}
+	for _, trusted := range c.Config.TrustedScripts[repo.URL] {
+		if strings.EqualFold(trusted, target.SHA256) {
+			return true
+		}
+	}
+	return false
+}
+
+// approveScript applies the script policy to a lifecycle script.
+//
+// @return (whether to run the script, error if the installation must stop)
+func (c *Client) approveScript(script, scriptPath string, target scriptTarget) (bool, error) {
+	switch c.ScriptPolicy {
+	case ScriptsNever:
+		return false, nil
+	case ScriptsTrusted:
+		return true, nil
+	}
+	if c.scriptTrusted(target) {
+		return true, nil
+	}
+	content, err := os.ReadFile(scriptPath)
+	if err != nil {
+		return false, err
+	}
+	fmt.Printf("The %s script of %s %s (package sha256 %s) will run with your privileges:\n", script, target.Name, target.Version, target.SHA256)
+	fmt.Println("----------------------------------")
+	fmt.Print(string(content))
+	fmt.Println("\n----------------------------------")
+	ok, err := common.ConfirmAction("Run it? (Y/[n]) ")
+	if err != nil {
+		return false, fmt.Errorf("%v (use --scripts=%s or --scripts=%s for unattended runs)", err, ScriptsNever, ScriptsTrusted)
+	}
+	if !ok {
+		return false, fmt.Errorf("%s script of %s declined (use --scripts=%s to install without running scripts)", script, target.Name, ScriptsNever)
+	}
+	return true, nil
+}
+
+// runPkgScript executes the lifecycle script at scriptPath with the prefix as its only argument,
+// if the script policy allows it. Its output is shown and appended to the transaction log.
+func (c *Client) runPkgScript(txn *transaction, script, scriptPath string, target scriptTarget) error {
+	run, err := c.approveScript(script, scriptPath, target)
+	if err != nil {
+		return err
+	}
+	if !run {
+		c.logf(" - skipping %s script of %s (--scripts=%s)\n", script, target.Name, ScriptsNever)
+		return txn.logf("%s %s %s (%s): skipped", script, target.Name, target.Version, target.Action)
+	}
+
+	opts := common.ScriptOptions{Env: c.scriptEnv(txn.prefix, target)}
+	if c.Config != nil {
+		opts.CleanEnv = c.Config.ScriptCleanEnv
+		opts.Timeout = time.Duration(c.Config.ScriptTimeout) * time.Second
+	}
+	c.logf("Executing %s script of %s (%s)...\n", script, target.Name, target.Action)
+	outStr, exeErr := common.ExecuteScript(scriptPath, opts, txn.prefix)
+	if logErr := txn.logf("%s %s %s (%s):\n%s", script, target.Name, target.Version, target.Action, outStr); logErr != nil {
+		c.logf(" - WARN: %v\n", logErr)
+	}
+	if exeErr != nil {
+		return exeErr
+	}
+	c.logf("##################################\n")
+	if strings.TrimSpace(outStr) == "" {
+		c.logf("(empty output)")
+	} else {
+		c.logf("%s", outStr)
+	}
+	c.logf("\n##################################\n")
+	return nil
+}
+
+// runStagedScript runs a lifecycle script of a staged package, if it ships one.
+func (c *Client) runStagedScript(txn *transaction, step *installStep, script, action string) error {
+	scriptPath, found := common.GetPkgScriptPath(step.stageDir, script)
+	if !found {
+		return nil
+	}
+	target := scriptTarget{Name: step.entry.Name, Version: step.entry.Version, Arch: step.entry.Arch, Action: action, SHA256: step.entry.SHA256, Repo: step.entry.Repo}
+	if err := c.runPkgScript(txn, script, scriptPath, target); err != nil {
+		return fmt.Errorf("%s script of %s failed: %w", script, step.entry.Name, err)
+	}
+	return nil
+}
+
+// runInstalledScript runs a lifecycle script recorded in the DB for an installed package, if any.
+func (c *Client) runInstalledScript(db *DB, txn *transaction, inst *Installed, script, action string) error {
+	scripts, err := db.GetInstalledScripts(inst.Name, txn.prefix)
+	if err != nil {
+		return err
+	}
+	content, ok := scripts[script]
+	if !ok {
+		return nil
+	}
+	scriptPath := filepath.Join(txn.stageDir, "scripts", inst.Name, script)
+	if err := os.MkdirAll(filepath.Dir(scriptPath), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(scriptPath, []byte(content), 0o755); err != nil {
+		return err
+	}
+	target := scriptTarget{Name: inst.Name, Version: inst.Version, Arch: inst.Arch, Action: action, SHA256: inst.SHA256, Repo: inst.Repo}
+	if err := c.runPkgScript(txn, script, scriptPath, target); err != nil {
+		return fmt.Errorf("%s script of %s failed: %w", script, inst.Name, err)
+	}
+	return nil
+}
+
+// stagedScripts reads the lifecycle scripts shipped by a staged package, to be recorded in the DB.
+func stagedScripts(stageDir string) (map[string]string, error) {
+	scripts := map[string]string{}
+	for _, script := range common.GetPkgScripts() {
+		scriptPath, found := common.GetPkgScriptPath(stageDir, script)
+		if !found {
+			continue
+		}
+		content, err := os.ReadFile(scriptPath)
+		if err != nil {
+			return nil, err
+		}
+		scripts[script] = string(content)
+	}
+	return scripts, nil
+}
+
+// removePackage removes an installed package from prefix through txn, running its prerm script
+// before and its postrm script after its files are removed.
+func (c *Client) removePackage(db *DB, txn *transaction, inst *Installed, removing map[string]bool) error {
+	if err := c.runInstalledScript(db, txn, inst, common.ScriptPreRm, actionRemove); err != nil {
+		return err
+	}
+	files, err := db.GetInstalledFiles(inst.Name, txn.prefix)
+	if err != nil {
+		return err
+	}
+	if err := c.removeInstalledFiles(db, txn, inst.Name, txn.prefix, files, removing); err != nil {
+		return err
+	}
+	return c.runInstalledScript(db, txn, inst, common.ScriptPostRm, actionRemove)
+}
@@ -0,0 +1,187 @@
+package pkgclient
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SSRVodka/oh-packager/pkg/config"
+)
+
+func TestUninstallRunsRemovalScripts(t *testing.T) {
+	cfgHome := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", cfgHome)
+	sdk := t.TempDir()
+	writeTestFile(t, sdk, "toolchains/oh-uni-package.json", `{"apiVersion": "12"}`)
+	prefix := t.TempDir()
+	dbPath := filepath.Join(t.TempDir(), "installed.db")
+	trace := filepath.Join(t.TempDir(), "trace")
+
+	db, err := OpenDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	writeTestFile(t, prefix, "lib/libfoo.so", "foo")
+	files, err := collectInstalledFiles(prefix, []string{"lib/libfoo.so"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := func(name string) string {
+		return "#!/bin/sh\n" +
+			`test -e "$OHLA_PREFIX/lib/libfoo.so" && state=present || state=absent` + "\n" +
+			`echo "` + name + ` $OHLA_ACTION $OHLA_PKG_NAME $OHLA_PKG_VERSION $OHLA_ARCH $OHLA_API $1 $state" >> ` + trace + "\n" +
+			`echo "` + name + ` done"` + "\n"
+	}
+	inst := Installed{Name: "foo", Version: "1.0.0", Arch: "aarch64", Prefix: prefix, Path: "foo.pkg",
+		Scripts: map[string]string{"prerm": script("prerm"), "postrm": script("postrm")}}
+	mustDo(t, db.InsertInstalled(inst, files))
+
+	c := &Client{Config: &config.Config{OhosSdk: sdk}, DBPath: dbPath, ScriptPolicy: ScriptsTrusted}
+	if err := c.Uninstall([]string{"foo"}, prefix, false, false); err != nil {
+		t.Fatalf("Uninstall failed: %v", err)
+	}
+
+	b, err := os.ReadFile(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "prerm remove foo 1.0.0 aarch64 12 " + prefix + " present\n" +
+		"postrm remove foo 1.0.0 aarch64 12 " + prefix + " absent\n"
+	if string(b) != want {
+		t.Fatalf("scripts ran as\n%s\nwant\n%s", b, want)
+	}
+	if scripts, err := db.GetInstalledScripts("foo", prefix); err != nil || len(scripts) != 0 {
+		t.Fatalf("scripts of foo still recorded: %v, %v", scripts, err)
+	}
+
+	logs, err := filepath.Glob(filepath.Join(cfgHome, "*", "logs", prefixKey(prefix), "*.log"))
+	if err != nil || len(logs) != 1 {
+		t.Fatalf("transaction logs: %v, %v", logs, err)
+	}
+	log, err := os.ReadFile(logs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(log), "prerm done") || !strings.Contains(string(log), "postrm done") {
+		t.Fatalf("script output missing from transaction log:\n%s", log)
+	}
+}
+
+func TestFailingRemovalScriptRestoresPrefix(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	prefix := t.TempDir()
+	dbPath := filepath.Join(t.TempDir(), "installed.db")
+	db, err := OpenDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	writeTestFile(t, prefix, "lib/libfoo.so", "foo")
+	files, err := collectInstalledFiles(prefix, []string{"lib/libfoo.so"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst := Installed{Name: "foo", Version: "1.0.0", Arch: "aarch64", Prefix: prefix, Path: "foo.pkg",
+		Scripts: map[string]string{"postrm": "#!/bin/sh\nexit 3\n"}}
+	mustDo(t, db.InsertInstalled(inst, files))
+
+	if err := (&Client{DBPath: dbPath, ScriptPolicy: ScriptsTrusted}).Uninstall([]string{"foo"}, prefix, false, false); err == nil {
+		t.Fatalf("expected Uninstall to fail")
+	}
+	assertFileContent(t, prefix, "lib/libfoo.so", "foo")
+	if got, err := db.GetInstalled("foo", prefix); err != nil || got == nil {
+		t.Fatalf("foo not installed anymore: %v", err)
+	}
+}
+
+func TestScriptPolicy(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	prefix := t.TempDir()
+	txn, err := beginTransaction(prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.rollback()
+	trace := filepath.Join(t.TempDir(), "trace")
+	scriptDir := t.TempDir()
+	writeTestFile(t, scriptDir, "postinst", "#!/bin/sh\necho \"$OHLA_PKG_NAME\" >> "+trace+"\n")
+	mustDo(t, os.Chmod(filepath.Join(scriptDir, "postinst"), 0o755))
+	writeTestFile(t, scriptDir, "slow", "#!/bin/sh\nsleep 30\n")
+	mustDo(t, os.Chmod(filepath.Join(scriptDir, "slow"), 0o755))
+	script := filepath.Join(scriptDir, "postinst")
+
+	// nobody answers the confirmation
+	stdin, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	oldStdin := os.Stdin
+	os.Stdin = stdin
+	defer func() { os.Stdin = oldStdin }()
+
+	cfg := &config.Config{RootURL: "https://repo.example.com", TrustedScripts: map[string][]string{
+		"https://repo.example.com": {"aaaa"},
+	}}
+	for _, tc := range []struct {
+		policy, sha string
+		ran, fails  bool
+	}{
+		{policy: ScriptsNever, sha: "aaaa"},
+		{policy: ScriptsAsk, sha: "bbbb", fails: true},
+		{policy: ScriptsAsk, sha: "AAAA", ran: true},
+		{policy: ScriptsTrusted, sha: "bbbb", ran: true},
+	} {
+		_ = os.Remove(trace)
+		c := &Client{Config: cfg, ScriptPolicy: tc.policy}
+		err := c.runPkgScript(txn, "postinst", script, scriptTarget{Name: "foo", Version: "1.0.0", Action: actionInstall, SHA256: tc.sha})
+		if (err != nil) != tc.fails {
+			t.Fatalf("%s/%s: unexpected result %v", tc.policy, tc.sha, err)
+		}
+		if _, statErr := os.Stat(trace); (statErr == nil) != tc.ran {
+			t.Fatalf("%s/%s: script ran = %v, want %v", tc.policy, tc.sha, statErr == nil, tc.ran)
+		}
+	}
+
+	c := &Client{Config: &config.Config{ScriptTimeout: 1}, ScriptPolicy: ScriptsTrusted}
+	start := time.Now()
+	if err := c.runPkgScript(txn, "postinst", filepath.Join(scriptDir, "slow"), scriptTarget{Name: "foo"}); err == nil {
+		t.Fatalf("expected the script to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("script killed after %v", elapsed)
+	}
+}
+
+func TestTrustedScriptsAreScopedToTheirRepository(t *testing.T) {
+	cfg := &config.Config{
+		RootURL: "https://a.example.com",
+		Repos:   []config.RepoConfig{{Name: "b", URL: "https://b.example.com"}},
+		TrustedScripts: map[string][]string{
+			"https://a.example.com": {"aaaa"},
+			"https://b.example.com": {"bbbb"},
+		},
+	}
+	c := &Client{Config: cfg}
+	for _, tc := range []struct {
+		repo, sha string
+		trusted   bool
+	}{
+		{repo: DefaultRepoName, sha: "aaaa", trusted: true},
+		{repo: "b", sha: "bbbb", trusted: true},
+		// hashes approved for one repository don't cover packages of the other
+		{repo: "b", sha: "aaaa"},
+		{repo: DefaultRepoName, sha: "bbbb"},
+		// installed without resolution: checked against root_url
+		{repo: "", sha: "aaaa", trusted: true},
+		// repository removed from the configuration
+		{repo: "gone", sha: "aaaa"},
+	} {
+		if got := c.scriptTrusted(scriptTarget{Name: "foo", SHA256: tc.sha, Repo: tc.repo}); got != tc.trusted {
+			t.Fatalf("%s/%s: trusted = %v, want %v", tc.repo, tc.sha, got, tc.trusted)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package pkgclient
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// id of the snapshot recorded before ohla installed anything into an sdk
+const baselineSnapshotID = "baseline"
+
+// loadSdkBaseline reads the baseline inventory of prefix.
+//
+// @return (nil, nil) if prefix has no baseline (e.g. it is not an OHOS sdk prefix)
+func loadSdkBaseline(prefix string) (*sdkSnapshot, error) {
+	return loadSdkSnapshot(prefix, baselineSnapshotID)
+}
+
+// captureSdkBaseline records the current content of prefix as its baseline inventory.
+// Paths already owned by installed packages (installed before baselines existed) are left out.
+func captureSdkBaseline(db *DB, prefix string) (*sdkSnapshot, error) {
+	files, err := captureInventory(prefix, func(rel string, isDir bool) (bool, error) {
+		if isDir {
+			return false, nil
+		}
+		owners, err := db.FileOwners(prefix, rel)
+		return len(owners) > 0, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record sdk baseline of '%s': %v", prefix, err)
+	}
+	return newSdkSnapshot(prefix, baselineSnapshotID, files), nil
+}
+
+// ensureSdkBaseline returns the baseline inventory of prefix, recording it first if prefix is
+// the OHOS sdk sysroot and no inventory exists yet. It returns nil for other prefixes.
+func (c *Client) ensureSdkBaseline(db *DB, prefix string) (*sdkSnapshot, error) {
+	baseline, err := loadSdkBaseline(prefix)
+	if err != nil || baseline != nil {
+		return baseline, err
+	}
+	if !c.isSdkPrefix(prefix) {
+		return nil, nil
+	}
+	c.logf("Recording the pristine inventory of %s (first installation into this SDK)...\n", prefix)
+	if baseline, err = captureSdkBaseline(db, prefix); err != nil {
+		return nil, err
+	}
+	if err := saveSdkSnapshot(baseline); err != nil {
+		return nil, fmt.Errorf("failed to save sdk baseline: %v", err)
+	}
+	return baseline, nil
+}
+
+// isSdkPrefix reports whether prefix is the sysroot prefix of the configured OHOS sdk.
+func (c *Client) isSdkPrefix(prefix string) bool {
+	if c.Config == nil {
+		return false
+	}
+	sdkPrefix, err := c.sdkPrefix()
+	return err == nil && filepath.Clean(sdkPrefix) == filepath.Clean(prefix)
+}
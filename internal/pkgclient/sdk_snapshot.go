@@ -0,0 +1,570 @@
+package pkgclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SSRVodka/oh-packager/internal/common"
+)
+
+// inventoryEntry is one path of an sdk sysroot.
+type inventoryEntry struct {
+	Path   string      `json:"path"` // relative to the sysroot prefix, slash separated
+	Type   string      `json:"type"` // FileTypeFile, FileTypeSymlink or FileTypeDir
+	Mode   os.FileMode `json:"mode"`
+	SHA256 string      `json:"sha256,omitempty"` // regular files only
+	Target string      `json:"target,omitempty"` // symlinks only
+}
+
+// snapshotPackage is the installed DB record of a package at snapshot time.
+type snapshotPackage struct {
+	Name    string           `json:"name"`
+	Version string           `json:"version"`
+	Arch    string           `json:"arch"`
+	Path    string           `json:"path,omitempty"`
+	Depends []string         `json:"depends,omitempty"`
+	Files   []inventoryEntry `json:"files"`
+	SHA256  string           `json:"sha256,omitempty"`
+	Source  string           `json:"source,omitempty"`
+	Repo    string           `json:"repo,omitempty"`
+	// lifecycle scripts (see Installed.Scripts)
+	Scripts map[string]string `json:"scripts,omitempty"`
+}
+
+// sdkSnapshot is the inventory of a sysroot prefix at some point in time. File contents are
+// not part of it: they are found either in the sysroot itself or in the object store
+// (see storeObject), which only keeps the files that are not on disk anymore.
+type sdkSnapshot struct {
+	ID       string            `json:"id"`
+	Prefix   string            `json:"prefix"`
+	Created  time.Time         `json:"created"`
+	Files    []inventoryEntry  `json:"files"`
+	Packages []snapshotPackage `json:"packages,omitempty"`
+
+	byPath map[string]inventoryEntry
+}
+
+func newSdkSnapshot(prefix, id string, files []inventoryEntry) *sdkSnapshot {
+	return &sdkSnapshot{ID: id, Prefix: prefix, Created: time.Now().UTC(), Files: files}
+}
+
+// sdkStateDir is where per-sdk state (baseline inventory, snapshots, objects) of prefix is kept.
+func sdkStateDir(prefix string) string {
+	return filepath.Join(common.UserConfigDir(), "sdk", prefixKey(prefix))
+}
+
+func sdkSnapshotPath(prefix, id string) string {
+	if id == baselineSnapshotID {
+		return filepath.Join(sdkStateDir(prefix), "baseline.json")
+	}
+	return filepath.Join(sdkStateDir(prefix), "snapshots", id+".json")
+}
+
+func sdkObjectPath(prefix, sha string) string {
+	return filepath.Join(sdkStateDir(prefix), "objects", sha[:2], sha)
+}
+
+// lookup returns the entry of relPath. It is safe to call on a nil snapshot.
+func (s *sdkSnapshot) lookup(relPath string) (inventoryEntry, bool) {
+	if s == nil {
+		return inventoryEntry{}, false
+	}
+	if s.byPath == nil {
+		s.byPath = make(map[string]inventoryEntry, len(s.Files))
+		for _, e := range s.Files {
+			s.byPath[e.Path] = e
+		}
+	}
+	e, ok := s.byPath[relPath]
+	return e, ok
+}
+
+// captureInventory walks prefix (except the transaction directory).
+// Entries for which skip returns true are left out.
+func captureInventory(prefix string, skip func(rel string, isDir bool) (bool, error)) ([]inventoryEntry, error) {
+	var files []inventoryEntry
+	walkErr := filepath.WalkDir(prefix, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == prefix {
+			return nil
+		}
+		if d.IsDir() && d.Name() == txnDirName {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(prefix, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if skip != nil {
+			skipped, err := skip(rel, d.IsDir())
+			if err != nil || skipped {
+				return err
+			}
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		e := inventoryEntry{Path: rel, Mode: info.Mode()}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			e.Type = FileTypeSymlink
+			if e.Target, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case info.IsDir():
+			e.Type = FileTypeDir
+		default:
+			e.Type = FileTypeFile
+			if e.SHA256, err = common.ComputeSHA256(path); err != nil {
+				return err
+			}
+		}
+		files = append(files, e)
+		return nil
+	})
+	return files, walkErr
+}
+
+// loadSdkSnapshot reads snapshot id of prefix.
+//
+// @return (nil, nil) if the snapshot doesn't exist
+func loadSdkSnapshot(prefix, id string) (*sdkSnapshot, error) {
+	path := sdkSnapshotPath(prefix, id)
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s sdkSnapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("corrupted sdk snapshot '%s': %v", path, err)
+	}
+	return &s, nil
+}
+
+func saveSdkSnapshot(s *sdkSnapshot) error {
+	path := sdkSnapshotPath(s.Prefix, s.ID)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// listSdkSnapshots returns the snapshots of prefix, baseline first then oldest first.
+func listSdkSnapshots(prefix string) ([]*sdkSnapshot, error) {
+	var list []*sdkSnapshot
+	baseline, err := loadSdkBaseline(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if baseline != nil {
+		list = append(list, baseline)
+	}
+	entries, err := os.ReadDir(filepath.Join(sdkStateDir(prefix), "snapshots"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	ids := []string{}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".json") {
+			ids = append(ids, strings.TrimSuffix(e.Name(), ".json"))
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		s, err := loadSdkSnapshot(prefix, id)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+// referencedObjects returns the checksums of every file recorded by a snapshot of prefix.
+func referencedObjects(prefix string) (map[string]bool, error) {
+	snapshots, err := listSdkSnapshots(prefix)
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string]bool{}
+	for _, s := range snapshots {
+		for _, e := range s.Files {
+			if e.SHA256 != "" {
+				refs[e.SHA256] = true
+			}
+		}
+	}
+	return refs, nil
+}
+
+// storeObject copies the regular file path into the object store of prefix unless it is already there.
+func storeObject(prefix, path, sha string) error {
+	dst := sdkObjectPath(prefix, sha)
+	if common.IsFileExists(dst) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	if err := common.CopyFile(path, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// preserveSnapshotObjects saves the files a committing transaction overwrote or removed
+// into the object store when a snapshot of the prefix still refers to their content.
+func preserveSnapshotObjects(t *transaction) error {
+	if !common.IsFileExists(sdkSnapshotPath(t.prefix, baselineSnapshotID)) {
+		return nil
+	}
+	refs, err := referencedObjects(t.prefix)
+	if err != nil {
+		return err
+	}
+	for _, op := range t.journal {
+		if op.Backup == "" {
+			continue
+		}
+		info, err := os.Lstat(op.Backup)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		sha, err := common.ComputeSHA256(op.Backup)
+		if err != nil {
+			return err
+		}
+		if !refs[sha] {
+			continue
+		}
+		if err := storeObject(t.prefix, op.Backup, sha); err != nil {
+			return fmt.Errorf("failed to keep '%s' for sdk snapshots: %v", op.Path, err)
+		}
+	}
+	return nil
+}
+
+// SdkSnapshot records the current state of the OHOS sdk sysroot.
+//
+// @return snapshot id
+func (c *Client) SdkSnapshot() (string, error) {
+	prefix, err := c.sdkPrefix()
+	if err != nil {
+		return "", err
+	}
+	db, err := OpenDB(c.DBPath)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	lock, err := lockPrefix(prefix)
+	if err != nil {
+		return "", err
+	}
+	defer unlockPrefix(lock)
+	if err := recoverTransaction(prefix); err != nil {
+		return "", err
+	}
+
+	baseline, err := c.ensureSdkBaseline(db, prefix)
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("Recording the inventory of %s...\n", prefix)
+	files, err := captureInventory(prefix, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to record the inventory of '%s': %v", prefix, err)
+	}
+	id := time.Now().UTC().Format("20060102-150405")
+	for n := 2; common.IsFileExists(sdkSnapshotPath(prefix, id)); n++ {
+		id = time.Now().UTC().Format("20060102-150405") + "-" + strconv.Itoa(n)
+	}
+	snapshot := newSdkSnapshot(prefix, id, files)
+
+	// the baseline content stays on disk until ohla changes it (see preserveSnapshotObjects):
+	// only the files that differ from it are copied
+	stored := 0
+	for _, e := range files {
+		if e.Type != FileTypeFile {
+			continue
+		}
+		if b, ok := baseline.lookup(e.Path); ok && b.SHA256 == e.SHA256 {
+			continue
+		}
+		if common.IsFileExists(sdkObjectPath(prefix, e.SHA256)) {
+			continue
+		}
+		if err := storeObject(prefix, filepath.Join(prefix, filepath.FromSlash(e.Path)), e.SHA256); err != nil {
+			return "", err
+		}
+		stored++
+	}
+
+	installed, err := db.ListInstalled(prefix)
+	if err != nil {
+		return "", err
+	}
+	for _, inst := range installed {
+		pkgFiles, err := db.GetInstalledFiles(inst.Name, prefix)
+		if err != nil {
+			return "", err
+		}
+		scripts, err := db.GetInstalledScripts(inst.Name, prefix)
+		if err != nil {
+			return "", err
+		}
+		p := snapshotPackage{Name: inst.Name, Version: inst.Version, Arch: inst.Arch, Path: inst.Path, Depends: inst.Depends, SHA256: inst.SHA256, Source: inst.Source, Repo: inst.Repo, Scripts: scripts}
+		for _, f := range pkgFiles {
+			p.Files = append(p.Files, inventoryEntry{Path: f.Path, Type: f.Type, Mode: f.Mode, SHA256: f.SHA256})
+		}
+		snapshot.Packages = append(snapshot.Packages, p)
+	}
+	if err := saveSdkSnapshot(snapshot); err != nil {
+		return "", err
+	}
+	fmt.Printf("Snapshot %s: %d entries, %d packages, %d files stored\n", id, len(files), len(installed), stored)
+	return id, nil
+}
+
+// SdkSnapshots prints the snapshots of the OHOS sdk sysroot.
+func (c *Client) SdkSnapshots() error {
+	prefix, err := c.sdkPrefix()
+	if err != nil {
+		return err
+	}
+	list, err := listSdkSnapshots(prefix)
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		fmt.Println("no snapshots: the SDK has not been modified by ohla")
+		return nil
+	}
+	for _, s := range list {
+		names := make([]string, 0, len(s.Packages))
+		for _, p := range s.Packages {
+			names = append(names, p.Name+" "+p.Version)
+		}
+		fmt.Printf("%s\t%s\t%d packages\t%s\n", s.ID, s.Created.Local().Format("2006-01-02 15:04:05"), len(s.Packages), strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// SdkReset restores the OHOS sdk sysroot to its state before the first ohla installation.
+func (c *Client) SdkReset(noConfirm bool) error {
+	return c.SdkRestore(baselineSnapshotID, noConfirm)
+}
+
+// SdkRestore restores the OHOS sdk sysroot (files and installed packages) to snapshot id.
+func (c *Client) SdkRestore(id string, noConfirm bool) error {
+	prefix, err := c.sdkPrefix()
+	if err != nil {
+		return err
+	}
+	snapshot, err := loadSdkSnapshot(prefix, id)
+	if err != nil {
+		return err
+	}
+	if snapshot == nil {
+		if id == baselineSnapshotID {
+			return fmt.Errorf("no baseline recorded for %s: ohla never installed anything into it", prefix)
+		}
+		return fmt.Errorf("snapshot '%s' not found (see 'ohla sdk list')", id)
+	}
+	if !noConfirm {
+		fmt.Printf("We are going to restore %s to snapshot %s (%s, %d packages).\n",
+			prefix, id, snapshot.Created.Local().Format("2006-01-02 15:04:05"), len(snapshot.Packages))
+		ok, confirmErr := common.ConfirmAction("Changes made since then will be lost. (Y/[n]) ")
+		if confirmErr != nil {
+			return confirmErr
+		}
+		if !ok {
+			fmt.Printf("Restore abort.\n")
+			return nil
+		}
+	}
+
+	db, err := OpenDB(c.DBPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	txn, err := beginTransaction(prefix)
+	if err != nil {
+		return err
+	}
+	if err := restoreSnapshot(db, txn, snapshot); err != nil {
+		if rbErr := txn.rollback(); rbErr != nil {
+			return fmt.Errorf("restore failed: %v\n%v", err, rbErr)
+		}
+		return fmt.Errorf("restore failed, %s unchanged: %w", prefix, err)
+	}
+	if err := txn.commit(); err != nil {
+		return err
+	}
+	fmt.Printf("Restored %s to snapshot %s\n", prefix, id)
+	return nil
+}
+
+// restoreSnapshot makes the prefix of txn match snapshot and replaces the installed DB records.
+func restoreSnapshot(db *DB, txn *transaction, snapshot *sdkSnapshot) error {
+	prefix := txn.prefix
+	fmt.Printf("Comparing %s with snapshot %s...\n", prefix, snapshot.ID)
+	current, err := captureInventory(prefix, nil)
+	if err != nil {
+		return err
+	}
+	currentByPath := map[string]inventoryEntry{}
+	onDisk := map[string]string{} // sha256 -> a current path with that content
+	for _, e := range current {
+		currentByPath[e.Path] = e
+		if e.SHA256 != "" {
+			onDisk[e.SHA256] = e.Path
+		}
+	}
+
+	// 1) gather the content of every file to restore before touching anything
+	sources := map[string]string{}
+	unrecoverable := []string{}
+	for _, e := range snapshot.Files {
+		if e.Type != FileTypeFile || sources[e.SHA256] != "" {
+			continue
+		}
+		if cur, ok := currentByPath[e.Path]; ok && cur.Type == FileTypeFile && cur.SHA256 == e.SHA256 {
+			continue
+		}
+		staged := filepath.Join(txn.stageDir, "objects", e.SHA256)
+		var src string
+		if obj := sdkObjectPath(prefix, e.SHA256); common.IsFileExists(obj) {
+			src = obj
+		} else if p, ok := onDisk[e.SHA256]; ok {
+			src = filepath.Join(prefix, filepath.FromSlash(p))
+		} else {
+			unrecoverable = append(unrecoverable, e.Path)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(staged), 0o755); err != nil {
+			return err
+		}
+		if err := common.CopyFile(src, staged); err != nil {
+			return err
+		}
+		sources[e.SHA256] = staged
+	}
+	if len(unrecoverable) > 0 {
+		return fmt.Errorf("content of %d files is not available anymore (modified outside ohla?):\n  %s",
+			len(unrecoverable), strings.Join(unrecoverable, "\n  "))
+	}
+
+	// 2) remove what the snapshot doesn't have
+	dirs := map[string]bool{}
+	for _, e := range current {
+		full := filepath.Join(prefix, filepath.FromSlash(e.Path))
+		want, ok := snapshot.lookup(e.Path)
+		if e.Type == FileTypeDir {
+			if !ok || want.Type != FileTypeDir {
+				dirs[full] = true
+			}
+			continue
+		}
+		if !ok || want.Type == FileTypeDir {
+			if err := txn.remove(full); err != nil {
+				return err
+			}
+		}
+	}
+	if err := pruneEmptyDirs(txn, dirs); err != nil {
+		return err
+	}
+
+	// 3) bring back what differs
+	changed := 0
+	for i, e := range snapshot.Files {
+		full := filepath.Join(prefix, filepath.FromSlash(e.Path))
+		cur, exists := currentByPath[e.Path]
+		switch e.Type {
+		case FileTypeDir:
+			if err := txn.mkdirAll(full); err != nil {
+				return err
+			}
+		case FileTypeSymlink:
+			if exists && cur.Type == FileTypeSymlink && cur.Target == e.Target {
+				continue
+			}
+			link := filepath.Join(txn.stageDir, "links", strconv.Itoa(i))
+			if err := os.MkdirAll(filepath.Dir(link), 0o755); err != nil {
+				return err
+			}
+			if err := os.Symlink(e.Target, link); err != nil {
+				return err
+			}
+			if err := txn.restoreEntry(link, full); err != nil {
+				return err
+			}
+			changed++
+		default:
+			if exists && cur.Type == FileTypeFile && cur.SHA256 == e.SHA256 {
+				if cur.Mode.Perm() != e.Mode.Perm() {
+					if err := txn.preserve(full); err != nil {
+						return err
+					}
+					if err := os.Chmod(full, e.Mode.Perm()); err != nil {
+						return err
+					}
+					changed++
+				}
+				continue
+			}
+			if err := txn.restoreEntry(sources[e.SHA256], full); err != nil {
+				return err
+			}
+			if err := os.Chmod(full, e.Mode.Perm()); err != nil {
+				return err
+			}
+			changed++
+		}
+	}
+	fmt.Printf(" - %d entries restored\n", changed)
+
+	// 4) installed packages
+	installed, err := db.ListInstalled(prefix)
+	if err != nil {
+		return err
+	}
+	removed := make([]string, 0, len(installed))
+	for _, inst := range installed {
+		removed = append(removed, inst.Name)
+	}
+	added := make([]Installed, 0, len(snapshot.Packages))
+	files := map[string][]InstalledFile{}
+	for _, p := range snapshot.Packages {
+		added = append(added, Installed{Name: p.Name, Version: p.Version, Arch: p.Arch, Path: p.Path, Depends: p.Depends, SHA256: p.SHA256, Source: p.Source, Repo: p.Repo, Scripts: p.Scripts})
+		for _, f := range p.Files {
+			files[p.Name] = append(files[p.Name], InstalledFile{Path: f.Path, Type: f.Type, SHA256: f.SHA256, Mode: f.Mode})
+		}
+	}
+	return txn.applyDBChanges(db, removed, added, files)
+}
@@ -0,0 +1,115 @@
+package pkgclient
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SSRVodka/oh-packager/pkg/config"
+)
+
+func TestSdkSnapshotRestoreAndReset(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	sdk := t.TempDir()
+	prefix := filepath.Join(sdk, "native", "sysroot", "usr")
+	dbPath := filepath.Join(t.TempDir(), "installed.db")
+	c := &Client{Config: &config.Config{OhosSdk: sdk}, DBPath: dbPath}
+
+	writeTestFile(t, prefix, "include/stdio.h", "sdk stdio")
+	writeTestFile(t, prefix, "lib/libc.so", "libc")
+	if err := os.Symlink("libc.so", filepath.Join(prefix, "lib", "libc.so.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.SdkSnapshot(); err != nil {
+		t.Fatalf("SdkSnapshot failed: %v", err)
+	}
+	if baseline, err := loadSdkBaseline(prefix); err != nil || baseline == nil {
+		t.Fatalf("baseline not recorded by the first snapshot: %v", err)
+	}
+
+	// install "foo" over an SDK header, as `ohla add --overwrite` would
+	db, err := OpenDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	stage := t.TempDir()
+	writeTestFile(t, stage, "include/stdio.h", "foo stdio")
+	writeTestFile(t, stage, "lib/libfoo.so", "foo")
+	txn, err := beginTransaction(prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rel := range []string{"include/stdio.h", "lib/libfoo.so"} {
+		mustDo(t, txn.installEntry(filepath.Join(stage, rel), filepath.Join(prefix, rel)))
+	}
+	files, err := collectInstalledFiles(prefix, []string{"include/stdio.h", "lib/libfoo.so"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustDo(t, db.ApplyChanges(prefix, nil, []Installed{{Name: "foo", Version: "1.0.0", Arch: "aarch64"}}, map[string][]InstalledFile{"foo": files}))
+	mustDo(t, txn.commit())
+
+	id, err := c.SdkSnapshot()
+	if err != nil {
+		t.Fatalf("SdkSnapshot failed: %v", err)
+	}
+	// changes after the snapshot, one of them outside ohla
+	mustDo(t, os.Remove(filepath.Join(prefix, "lib", "libc.so.1")))
+	writeTestFile(t, prefix, "share/junk.txt", "junk")
+	mustDo(t, os.Chmod(filepath.Join(prefix, "lib", "libc.so"), 0o600))
+
+	if err := c.SdkReset(true); err != nil {
+		t.Fatalf("SdkReset failed: %v", err)
+	}
+	assertFileContent(t, prefix, "include/stdio.h", "sdk stdio")
+	for _, gone := range []string{"lib/libfoo.so", "share"} {
+		if _, err := os.Lstat(filepath.Join(prefix, gone)); !os.IsNotExist(err) {
+			t.Fatalf("%s still exists after reset", gone)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(prefix, "lib", "libc.so.1")); err != nil || target != "libc.so" {
+		t.Fatalf("symlink not restored: %q, %v", target, err)
+	}
+	if info, err := os.Stat(filepath.Join(prefix, "lib", "libc.so")); err != nil || info.Mode().Perm() != 0o644 {
+		t.Fatalf("mode not restored: %v, %v", info.Mode(), err)
+	}
+	if installed, err := db.ListInstalled(prefix); err != nil || len(installed) != 0 {
+		t.Fatalf("installed packages after reset: %#v, %v", installed, err)
+	}
+
+	if err := c.SdkRestore(id, true); err != nil {
+		t.Fatalf("SdkRestore failed: %v", err)
+	}
+	assertFileContent(t, prefix, "include/stdio.h", "foo stdio")
+	assertFileContent(t, prefix, "lib/libfoo.so", "foo")
+	if inst, err := db.GetInstalled("foo", prefix); err != nil || inst == nil || inst.Version != "1.0.0" {
+		t.Fatalf("foo not restored in installed.db: %#v, %v", inst, err)
+	}
+	if owners, err := db.FileOwners(prefix, "lib/libfoo.so"); err != nil || len(owners) != 1 {
+		t.Fatalf("file records of foo not restored: %v, %v", owners, err)
+	}
+}
+
+func TestSdkRestoreRefusesUnrecoverableContent(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	sdk := t.TempDir()
+	prefix := filepath.Join(sdk, "native", "sysroot", "usr")
+	c := &Client{Config: &config.Config{OhosSdk: sdk}, DBPath: filepath.Join(t.TempDir(), "installed.db")}
+
+	writeTestFile(t, prefix, "include/stdio.h", "sdk stdio")
+	writeTestFile(t, prefix, "include/stdlib.h", "sdk stdlib")
+	if _, err := c.SdkSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	// modified outside ohla: the pristine content is gone
+	writeTestFile(t, prefix, "include/stdio.h", "edited")
+	mustDo(t, os.Remove(filepath.Join(prefix, "include", "stdlib.h")))
+
+	if err := c.SdkReset(true); err == nil {
+		t.Fatalf("expected reset to fail")
+	}
+	// nothing was touched
+	assertFileContent(t, prefix, "include/stdio.h", "edited")
+}
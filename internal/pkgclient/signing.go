@@ -0,0 +1,169 @@
+package pkgclient
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/SSRVodka/oh-packager/internal/common"
+	"github.com/SSRVodka/oh-packager/pkg/config"
+)
+
+// Repositories are signed with ed25519 keys (see `ohla-server keygen`): the signature of every
+// index.json and manifest is stored in signatures/<path of the file>.sig. Indexes are verified
+// before they are used, so the package checksums they list can be trusted.
+
+// trustedKeys returns the public keys trusted to sign repo (trusted_keys of the config scoped
+// to repo by key_repos): a key trusted for one repository never validates another one.
+func (c *Client) trustedKeys(repo repository) (map[string]ed25519.PublicKey, error) {
+	keys := map[string]ed25519.PublicKey{}
+	if c.Config == nil {
+		return keys, nil
+	}
+	for id, pemKey := range c.Config.TrustedKeys {
+		if !slices.Contains(c.Config.KeyRepos[id], repo.Name) {
+			continue
+		}
+		pub, err := common.ParsePublicKey([]byte(pemKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted key %s: %v", id, err)
+		}
+		keys[common.KeyID(pub)] = pub
+	}
+	return keys, nil
+}
+
+// verifyRepoFile checks sig, the signature file of the file rel of repo (data).
+// Repositories with allow_unsigned are not checked.
+func (c *Client) verifyRepoFile(repo repository, rel string, data, sig []byte) error {
+	if repo.AllowUnsigned {
+		return nil
+	}
+	if sig == nil {
+		return fmt.Errorf("%s of repository '%s' is not signed", rel, repo.Name)
+	}
+	keys, err := c.trustedKeys(repo)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no trusted key to verify repository '%s': add its public key with `ohla key add --repo %s` (or set allow_unsigned)", repo.Name, repo.Name)
+	}
+	if err := common.VerifySignature(keys, data, sig); err != nil {
+		return fmt.Errorf("%s of repository '%s': %v", rel, repo.Name, err)
+	}
+	return nil
+}
+
+// verifyFetched fetches the signature of the file rel of repo, downloaded from u, and checks it.
+//
+// @return (content of the signature file, nil for repositories with allow_unsigned, error)
+func (c *Client) verifyFetched(repo repository, u, rel string, data []byte) ([]byte, error) {
+	if repo.AllowUnsigned {
+		return nil, nil
+	}
+	sigURL := strings.TrimSuffix(u, rel) + common.SignatureRelPath(rel)
+	sig, err := common.FetchURL(c.HTTP, sigURL)
+	if err != nil {
+		return nil, fmt.Errorf("no signature of %s of repository '%s': %v", rel, repo.Name, err)
+	}
+	return sig, c.verifyRepoFile(repo, rel, data, sig)
+}
+
+// AddTrustedKey trusts the PEM ed25519 public key in file to sign the repository repoName.
+// A key already trusted for other repositories is trusted for repoName too.
+//
+// @return key ID
+func AddTrustedKey(cfg *config.Config, file, repoName string) (string, error) {
+	known := repoName == DefaultRepoName && cfg.RootURL != ""
+	for _, r := range cfg.Repos {
+		known = known || r.Name == repoName
+	}
+	if !known {
+		return "", fmt.Errorf("no repository named '%s'", repoName)
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	pub, err := common.ParsePublicKey(b)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", file, err)
+	}
+	pemKey, err := common.EncodePublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	if cfg.TrustedKeys == nil {
+		cfg.TrustedKeys = map[string]string{}
+	}
+	if cfg.KeyRepos == nil {
+		cfg.KeyRepos = map[string][]string{}
+	}
+	id := common.KeyID(pub)
+	cfg.TrustedKeys[id] = string(pemKey)
+	if !slices.Contains(cfg.KeyRepos[id], repoName) {
+		cfg.KeyRepos[id] = append(cfg.KeyRepos[id], repoName)
+		sort.Strings(cfg.KeyRepos[id])
+	}
+	return id, nil
+}
+
+// RemoveTrustedKey stops trusting the key id for every repository. Indexes signed by it are
+// rejected from now on, including the local copies.
+func RemoveTrustedKey(cfg *config.Config, id string) error {
+	if _, ok := cfg.TrustedKeys[id]; !ok {
+		return errors.New("no trusted key " + id)
+	}
+	delete(cfg.TrustedKeys, id)
+	delete(cfg.KeyRepos, id)
+	return nil
+}
+
+// ForgetRepoKeys stops trusting keys for the removed repository repoName.
+// Keys no longer trusted for any repository are removed.
+func ForgetRepoKeys(cfg *config.Config, repoName string) {
+	for id, repos := range cfg.KeyRepos {
+		kept := []string{}
+		for _, r := range repos {
+			if r != repoName {
+				kept = append(kept, r)
+			}
+		}
+		if len(kept) == 0 {
+			delete(cfg.KeyRepos, id)
+			delete(cfg.TrustedKeys, id)
+		} else {
+			cfg.KeyRepos[id] = kept
+		}
+	}
+}
+
+// PrintTrustedKeys lists the IDs of the trusted keys with the repositories they sign,
+// and the repositories that are not verified.
+func PrintTrustedKeys(cfg *config.Config) {
+	ids := make([]string, 0, len(cfg.TrustedKeys))
+	for id := range cfg.TrustedKeys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if len(ids) == 0 {
+		fmt.Println("no trusted keys")
+	}
+	for _, id := range ids {
+		repos := strings.Join(cfg.KeyRepos[id], ", ")
+		if repos == "" {
+			repos = "no repository (trust it again with `ohla key add --repo <name>`)"
+		}
+		fmt.Printf("%s\t%s\n", id, repos)
+	}
+	for _, r := range (&Client{Config: cfg}).repositories() {
+		if r.AllowUnsigned {
+			fmt.Printf("WARN: repository '%s' is not verified (allow_unsigned)\n", r.Name)
+		}
+	}
+}
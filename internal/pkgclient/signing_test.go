@@ -0,0 +1,187 @@
+package pkgclient
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SSRVodka/oh-packager/internal/common"
+	"github.com/SSRVodka/oh-packager/pkg/config"
+	"github.com/SSRVodka/oh-packager/pkg/meta"
+)
+
+func TestSignedRepository(t *testing.T) {
+	dir := t.TempDir()
+	entry := cacheEntry("zlib", "1.3.1", "zlib content")
+	entry.Manifest = "channels/stable/pkgs/zlib.json"
+	writeJSON := func(rel string, v interface{}) {
+		t.Helper()
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mustDo(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, rel)), 0o755))
+		mustDo(t, os.WriteFile(filepath.Join(dir, rel), b, 0o644))
+	}
+	writeJSON("channels/stable/index.json", meta.Index{Channel: "stable", Packages: []meta.IndexEntry{entry}})
+	writeJSON(entry.Manifest, meta.Manifest{Name: "zlib", Version: "1.3.1", Description: "compression library"})
+
+	keys := t.TempDir()
+	pub, err := common.GenerateSigningKey(filepath.Join(keys, "repo.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPath, err := common.AddRepoPublicKey(dir, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := common.LoadSigningKey(filepath.Join(keys, "repo.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := common.SignRepo(dir, nil); err == nil {
+		t.Fatalf("repository with public keys signed without a key")
+	}
+	if n, err := common.SignRepo(dir, priv); err != nil || n != 2 {
+		t.Fatalf("signed %d files, %v", n, err)
+	}
+
+	rootURL, err := common.FileURL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{RootURL: rootURL, Channel: "stable"}
+	c := &Client{Config: cfg, IndexDir: t.TempDir(), HTTP: newHTTPClient(cfg)}
+	if _, err := c.loadIndex(); err == nil || !strings.Contains(err.Error(), "ohla key add") {
+		t.Fatalf("index accepted without trusted keys: %v", err)
+	}
+	id, err := AddTrustedKey(cfg, pubPath, DefaultRepoName)
+	if err != nil || id != common.KeyID(pub) {
+		t.Fatalf("trusted key %s, %v", id, err)
+	}
+	mustDo(t, c.Update())
+	m, err := c.fetchManifest(indexEntry(t, c, "zlib"))
+	if err != nil || m.Description != "compression library" {
+		t.Fatalf("signed manifest: %+v, %v", m, err)
+	}
+
+	// tampered files are rejected
+	writeJSON(entry.Manifest, meta.Manifest{Name: "zlib", Version: "1.3.1", Description: "tampered"})
+	if _, err := c.fetchManifest(indexEntry(t, c, "zlib")); err == nil {
+		t.Fatalf("tampered manifest accepted")
+	}
+	evil := entry
+	evil.SHA256 = strings.Repeat("0", 64)
+	writeJSON("channels/stable/index.json", meta.Index{Channel: "stable", Packages: []meta.IndexEntry{evil}})
+	// Last-Modified has a one second resolution
+	later := time.Now().Add(time.Minute)
+	mustDo(t, os.Chtimes(filepath.Join(dir, "channels", "stable", "index.json"), later, later))
+	if err := c.Update(); err == nil {
+		t.Fatalf("tampered index accepted")
+	}
+	mustDo(t, os.Remove(filepath.Join(dir, "signatures", "channels", "stable", "index.json.sig")))
+	if err := c.Update(); err == nil {
+		t.Fatalf("unsigned index accepted")
+	}
+
+	// the local index is verified again when the key is no longer trusted
+	if _, err := c.loadIndex(); err != nil {
+		t.Fatalf("local index: %v", err)
+	}
+	mustDo(t, RemoveTrustedKey(cfg, id))
+	if _, err := c.loadIndex(); err == nil {
+		t.Fatalf("index signed by a removed key accepted")
+	}
+
+	cfg.AllowUnsigned = true
+	mustDo(t, c.Update())
+	idx, err := c.loadIndex()
+	if err != nil || idx.Packages[0].SHA256 != evil.SHA256 {
+		t.Fatalf("unsigned repository: %v", err)
+	}
+}
+
+func TestTrustedKeysAreScopedToTheirRepository(t *testing.T) {
+	// a repository signed by its own key, and another one signed by a key trusted for it
+	signed := func() (string, string) {
+		dir := t.TempDir()
+		b, err := json.Marshal(meta.Index{Channel: "stable", Packages: []meta.IndexEntry{cacheEntry("zlib", "1.3.1", "zlib")}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mustDo(t, os.MkdirAll(filepath.Join(dir, "channels", "stable"), 0o755))
+		mustDo(t, os.WriteFile(filepath.Join(dir, "channels", "stable", "index.json"), b, 0o644))
+		keyPath := filepath.Join(t.TempDir(), "repo.key")
+		pub, err := common.GenerateSigningKey(keyPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubPath, err := common.AddRepoPublicKey(dir, pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		priv, err := common.LoadSigningKey(keyPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := common.SignRepo(dir, priv); err != nil {
+			t.Fatal(err)
+		}
+		u, err := common.FileURL(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u, pubPath
+	}
+	mainURL, mainKey := signed()
+	evilURL, evilKey := signed()
+	cfg := &config.Config{RootURL: mainURL, Channel: "stable", Repos: []config.RepoConfig{{Name: "evil", URL: evilURL, Channel: "stable"}}}
+	c := &Client{Config: cfg, IndexDir: t.TempDir(), HTTP: newHTTPClient(cfg)}
+
+	if _, err := AddTrustedKey(cfg, mainKey, "missing"); err == nil {
+		t.Fatalf("key trusted for an unknown repository")
+	}
+	if _, err := AddTrustedKey(cfg, mainKey, DefaultRepoName); err != nil {
+		t.Fatal(err)
+	}
+	evilID, err := AddTrustedKey(cfg, evilKey, "evil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustDo(t, c.Update())
+
+	// each key only validates the repository it is trusted for
+	cfg.Repos[0].URL = mainURL
+	if _, _, err := c.updateRepoIndex(c.findRepo("evil")); err == nil {
+		t.Fatalf("index signed by the key of the default repository accepted for evil")
+	}
+	cfg.RootURL = evilURL
+	if _, _, err := c.updateRepoIndex(c.findRepo(DefaultRepoName)); err == nil {
+		t.Fatalf("index signed by the key of evil accepted for the default repository")
+	}
+
+	// removing a repository forgets its keys
+	ForgetRepoKeys(cfg, "evil")
+	if _, ok := cfg.TrustedKeys[evilID]; ok {
+		t.Fatalf("key of the removed repository still trusted")
+	}
+}
+
+// indexEntry returns the entry of name in the index of c.
+func indexEntry(t *testing.T, c *Client, name string) meta.IndexEntry {
+	t.Helper()
+	idx, err := c.loadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range idx.Packages {
+		if e.Name == name {
+			return e
+		}
+	}
+	t.Fatalf("%s not in the index", name)
+	return meta.IndexEntry{}
+}
@@ -0,0 +1,569 @@
+package pkgclient
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/SSRVodka/oh-packager/internal/common"
+)
+
+// name of the transaction directory created inside the install prefix while a
+// transaction is running. It holds the journal, the backups and the staged packages.
+const txnDirName = ".ohla-txn"
+
+// journal operations
+const (
+	opCreate  = "create"  // path did not exist and was created
+	opReplace = "replace" // path existed, was moved to backup and rewritten
+	opModify  = "modify"  // path was modified in place, a copy was saved to backup
+	opRemove  = "remove"  // path was moved to backup
+	opMkdir   = "mkdir"   // directory was created
+	opRmdir   = "rmdir"   // empty directory was removed
+	opDB      = "db"      // installed.db records of the prefix were changed, the previous ones were saved to backup
+)
+
+type journalOp struct {
+	Op     string      `json:"op"`
+	Path   string      `json:"path"`
+	Backup string      `json:"backup,omitempty"`
+	Mode   os.FileMode `json:"mode,omitempty"`
+}
+
+// transaction applies changes to an install prefix so that they can be undone.
+//
+// Every change is appended to an on-disk journal before it is made. On failure
+// (or when an interrupted transaction is found by the next run) the journal is
+// replayed backwards to restore the prefix.
+type transaction struct {
+	prefix    string
+	dir       string
+	stageDir  string
+	backupDir string
+
+	journal     []journalOp
+	journalFile *os.File
+	lock        *os.File
+	touched     map[string]bool
+	done        bool
+
+	// transaction log (script output), kept after the transaction ends
+	logPath string
+}
+
+// beginTransaction locks prefix, rolls back any interrupted transaction and starts a new one.
+func beginTransaction(prefix string) (*transaction, error) {
+	lock, err := lockPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if err := recoverTransaction(prefix); err != nil {
+		unlockPrefix(lock)
+		return nil, err
+	}
+
+	t := &transaction{
+		prefix:    prefix,
+		dir:       filepath.Join(prefix, txnDirName),
+		stageDir:  filepath.Join(prefix, txnDirName, "stage"),
+		backupDir: filepath.Join(prefix, txnDirName, "backup"),
+		lock:      lock,
+		touched:   map[string]bool{},
+		logPath:   filepath.Join(common.UserConfigDir(), "logs", prefixKey(prefix), time.Now().UTC().Format("20060102T150405.000000")+".log"),
+	}
+	for _, d := range []string{t.stageDir, t.backupDir} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			t.cleanup()
+			return nil, err
+		}
+	}
+	t.journalFile, err = os.OpenFile(filepath.Join(t.dir, "journal"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.cleanup()
+		return nil, err
+	}
+	return t, nil
+}
+
+// recoverTransaction rolls back a transaction left behind by a crashed or killed run.
+// A transaction directory without journal belongs to a committed transaction and is just removed.
+func recoverTransaction(prefix string) error {
+	dir := filepath.Join(prefix, txnDirName)
+	if !common.IsDirExists(dir) {
+		return nil
+	}
+	journal, err := readJournal(filepath.Join(dir, "journal"))
+	if err != nil {
+		return fmt.Errorf("failed to read journal of interrupted transaction in '%s': %v", dir, err)
+	}
+	if len(journal) > 0 {
+		fmt.Printf("Found an interrupted transaction in %s, rolling it back...\n", prefix)
+	}
+	t := &transaction{prefix: prefix, dir: dir, journal: journal}
+	if err := t.undo(); err != nil {
+		return fmt.Errorf("failed to roll back interrupted transaction (backups kept in '%s'): %v", dir, err)
+	}
+	return os.RemoveAll(dir)
+}
+
+func readJournal(path string) ([]journalOp, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ops []journalOp
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var op journalOp
+		if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
+			// a torn last line means the operation was never started
+			break
+		}
+		ops = append(ops, op)
+	}
+	return ops, scanner.Err()
+}
+
+func (t *transaction) record(op journalOp) error {
+	b, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	if _, err := t.journalFile.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("failed to write transaction journal: %v", err)
+	}
+	// the entry must be on disk before the change it describes
+	if err := t.journalFile.Sync(); err != nil {
+		return fmt.Errorf("failed to write transaction journal: %v", err)
+	}
+	t.journal = append(t.journal, op)
+	t.touched[op.Path] = true
+	return nil
+}
+
+// logf appends a message to the transaction log.
+func (t *transaction) logf(format string, args ...any) error {
+	if err := os.MkdirAll(filepath.Dir(t.logPath), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(t.logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write transaction log: %v", err)
+	}
+	defer f.Close()
+	msg := fmt.Sprintf(format, args...)
+	_, err = fmt.Fprintf(f, "[%s] %s\n", time.Now().Format(time.RFC3339), strings.TrimRight(msg, "\n"))
+	return err
+}
+
+func (t *transaction) nextBackupPath() string {
+	return filepath.Join(t.backupDir, strconv.Itoa(len(t.journal)))
+}
+
+// mkdirAll creates dir and its missing parents, journaling every created directory.
+// dir must stay within the prefix once its symlinks are resolved.
+func (t *transaction) mkdirAll(dir string) error {
+	if err := common.CheckResolvedWithinDir(t.prefix, dir); err != nil {
+		return fmt.Errorf("unsafe entry '%s': %v", dir, err)
+	}
+	info, err := os.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("cannot create directory '%s': a file is in the way", dir)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := t.mkdirAll(parent); err != nil {
+			return err
+		}
+	}
+	if err := t.record(journalOp{Op: opMkdir, Path: dir}); err != nil {
+		return err
+	}
+	return os.Mkdir(dir, 0o755)
+}
+
+// installEntry copies the file or symlink src of a package to dst, backing up whatever is at dst.
+// See checkEntry for the entries refused.
+func (t *transaction) installEntry(src, dst string) error {
+	srcInfo, err := t.checkEntry(src, dst)
+	if err != nil {
+		return err
+	}
+	if err := t.prepareEntry(dst); err != nil {
+		return err
+	}
+	return copyEntry(src, dst, srcInfo)
+}
+
+// restoreEntry is installEntry for entries recorded from the prefix itself, like the SDK baseline:
+// they are restored as they were.
+func (t *transaction) restoreEntry(src, dst string) error {
+	srcInfo, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if err := t.prepareEntry(dst); err != nil {
+		return err
+	}
+	return copyEntry(src, dst, srcInfo)
+}
+
+// checkEntry refuses to install src at dst if it is a symlink resolving outside of the prefix,
+// a device node or other special file, or a setuid/setgid file.
+func (t *transaction) checkEntry(src, dst string) (os.FileInfo, error) {
+	srcInfo, err := os.Lstat(src)
+	if err != nil {
+		return nil, err
+	}
+	mode := srcInfo.Mode()
+	switch {
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read symlink %s: %w", src, err)
+		}
+		if err := common.CheckSymlinkTarget(t.prefix, dst, target); err != nil {
+			return nil, fmt.Errorf("unsafe entry '%s': %v", dst, err)
+		}
+	case !mode.IsRegular():
+		return nil, fmt.Errorf("unsafe entry '%s': not a regular file (%v)", dst, mode.Type())
+	case mode&(os.ModeSetuid|os.ModeSetgid) != 0:
+		return nil, fmt.Errorf("unsafe entry '%s': setuid/setgid bit set", dst)
+	}
+	return srcInfo, nil
+}
+
+func copyEntry(src, dst string, srcInfo os.FileInfo) error {
+	if srcInfo.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			return fmt.Errorf("failed to read symlink %s: %w", src, err)
+		}
+		if err := os.Symlink(target, dst); err != nil {
+			return fmt.Errorf("failed to create symlink %s: %w", dst, err)
+		}
+		return nil
+	}
+	if err := common.CopyFile(src, dst); err != nil {
+		return fmt.Errorf("failed to copy file %s: %w", src, err)
+	}
+	return nil
+}
+
+// moveEntry moves the staged file or symlink src to dst, backing up whatever is at dst.
+// The staging area lives in the prefix, so this is a rename unless src is on another filesystem.
+func (t *transaction) moveEntry(src, dst string) error {
+	srcInfo, err := t.checkEntry(src, dst)
+	if err != nil {
+		return err
+	}
+	if err := t.prepareEntry(dst); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return copyEntry(src, dst, srcInfo)
+	}
+	return nil
+}
+
+// prepareEntry makes room for a new entry at dst and journals it.
+// The directory of dst is checked by mkdirAll: nothing is written through a symlink leading out of the prefix.
+func (t *transaction) prepareEntry(dst string) error {
+	if err := t.mkdirAll(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	if dstInfo, err := os.Lstat(dst); err == nil {
+		if dstInfo.IsDir() {
+			return fmt.Errorf("cannot replace directory '%s' with a file", dst)
+		}
+		backup := t.nextBackupPath()
+		if err := t.record(journalOp{Op: opReplace, Path: dst, Backup: backup}); err != nil {
+			return err
+		}
+		if err := os.Rename(dst, backup); err != nil {
+			return fmt.Errorf("failed to back up '%s': %v", dst, err)
+		}
+	} else if os.IsNotExist(err) {
+		if err := t.record(journalOp{Op: opCreate, Path: dst}); err != nil {
+			return err
+		}
+	} else {
+		return err
+	}
+	return nil
+}
+
+// preserve saves a copy of an existing file before it is modified in place.
+// Files already touched by this transaction are restored through their own journal entry.
+func (t *transaction) preserve(path string) error {
+	if t.touched[path] {
+		return nil
+	}
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) || (err == nil && !info.Mode().IsRegular()) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// copy first: a journaled backup must always be complete
+	backup := t.nextBackupPath()
+	if err := common.CopyFile(path, backup); err != nil {
+		return err
+	}
+	return t.record(journalOp{Op: opModify, Path: path, Backup: backup})
+}
+
+// dbRecords are the installed.db records of some packages of a prefix, saved by applyDBChanges.
+type dbRecords struct {
+	// every package changed, including those that were not installed
+	Names    []string                   `json:"names"`
+	Packages []Installed                `json:"packages"`
+	Files    map[string][]InstalledFile `json:"files"`
+}
+
+// applyDBChanges is db.ApplyChanges for the prefix of t. The current records of the packages it changes are
+// saved and journaled first, so that a rollback (or the recovery of a crashed run) restores them with the files.
+func (t *transaction) applyDBChanges(db *DB, removed []string, added []Installed, files map[string][]InstalledFile) error {
+	saved := dbRecords{Names: []string{}, Packages: []Installed{}, Files: map[string][]InstalledFile{}}
+	seen := map[string]bool{}
+	names := append([]string(nil), removed...)
+	for _, inst := range added {
+		names = append(names, inst.Name)
+	}
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		saved.Names = append(saved.Names, name)
+		inst, err := db.GetInstalled(name, t.prefix)
+		if err != nil {
+			return err
+		}
+		if inst == nil {
+			continue
+		}
+		if inst.Scripts, err = db.GetInstalledScripts(name, t.prefix); err != nil {
+			return err
+		}
+		if saved.Files[name], err = db.GetInstalledFiles(name, t.prefix); err != nil {
+			return err
+		}
+		saved.Packages = append(saved.Packages, *inst)
+	}
+	b, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	// write first: a journaled backup must always be complete
+	backup := t.nextBackupPath()
+	if err := os.WriteFile(backup, b, 0o644); err != nil {
+		return err
+	}
+	if err := t.record(journalOp{Op: opDB, Path: db.path, Backup: backup}); err != nil {
+		return err
+	}
+	return db.ApplyChanges(t.prefix, removed, added, files)
+}
+
+// restoreDBRecords undoes applyDBChanges: the saved records replace those of the changed packages.
+func restoreDBRecords(prefix string, op journalOp) error {
+	b, err := os.ReadFile(op.Backup)
+	if os.IsNotExist(err) {
+		// the change never happened
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved dbRecords
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return fmt.Errorf("invalid saved records of '%s': %v", op.Path, err)
+	}
+	db, err := OpenDB(op.Path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.ApplyChanges(prefix, saved.Names, saved.Packages, saved.Files)
+}
+
+// remove moves a file or symlink out of the prefix into the backup area.
+func (t *transaction) remove(path string) error {
+	if _, err := os.Lstat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	backup := t.nextBackupPath()
+	if err := t.record(journalOp{Op: opRemove, Path: path, Backup: backup}); err != nil {
+		return err
+	}
+	return os.Rename(path, backup)
+}
+
+// removeDirIfEmpty removes dir when it has no entries left.
+func (t *transaction) removeDirIfEmpty(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil || !info.IsDir() {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) > 0 {
+		return nil
+	}
+	if err := t.record(journalOp{Op: opRmdir, Path: dir, Mode: info.Mode().Perm()}); err != nil {
+		return err
+	}
+	return os.Remove(dir)
+}
+
+// commit makes the changes permanent and drops the backups
+// (except the content sdk snapshots still refer to).
+func (t *transaction) commit() error {
+	if t.done {
+		return nil
+	}
+	t.done = true
+	if err := t.seal(); err != nil {
+		unlockPrefix(t.lock)
+		return fmt.Errorf("failed to commit transaction (it will be rolled back by the next run): %v", err)
+	}
+	if err := preserveSnapshotObjects(t); err != nil {
+		fmt.Printf("WARN: %v\n", err)
+	}
+	t.cleanup()
+	return nil
+}
+
+// seal removes the journal so that the transaction can no longer be undone,
+// before anything else (e.g. the backups) is deleted from the transaction directory.
+func (t *transaction) seal() error {
+	journalPath := t.journalFile.Name()
+	if err := t.journalFile.Sync(); err != nil {
+		t.journalFile.Close()
+		return err
+	}
+	t.journalFile.Close()
+	if err := os.Remove(journalPath); err != nil {
+		return err
+	}
+	dir, err := os.Open(t.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// rollback undoes every journaled change. It is a no-op after commit.
+func (t *transaction) rollback() error {
+	if t.done {
+		return nil
+	}
+	t.done = true
+	t.journalFile.Close()
+	fmt.Println("Rolling back changes...")
+	if err := t.undo(); err != nil {
+		unlockPrefix(t.lock)
+		return fmt.Errorf("rollback incomplete, backups kept in '%s': %v", t.dir, err)
+	}
+	t.cleanup()
+	return nil
+}
+
+func (t *transaction) undo() error {
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for i := len(t.journal) - 1; i >= 0; i-- {
+		op := t.journal[i]
+		switch op.Op {
+		case opCreate:
+			if err := os.Remove(op.Path); err != nil && !os.IsNotExist(err) {
+				keep(err)
+			}
+		case opReplace, opRemove, opModify:
+			if _, err := os.Lstat(op.Backup); err != nil {
+				// the change never happened
+				continue
+			}
+			if err := os.Remove(op.Path); err != nil && !os.IsNotExist(err) {
+				keep(err)
+				continue
+			}
+			keep(os.Rename(op.Backup, op.Path))
+		case opMkdir:
+			if err := os.Remove(op.Path); err != nil && !os.IsNotExist(err) {
+				keep(err)
+			}
+		case opRmdir:
+			if err := os.Mkdir(op.Path, op.Mode); err != nil && !os.IsExist(err) {
+				keep(err)
+			}
+		case opDB:
+			keep(restoreDBRecords(t.prefix, op))
+		}
+	}
+	return firstErr
+}
+
+func (t *transaction) cleanup() {
+	if err := os.RemoveAll(t.dir); err != nil {
+		fmt.Printf("WARN: failed to remove transaction directory '%s': %v\n", t.dir, err)
+	}
+	unlockPrefix(t.lock)
+}
+
+// prefixKey is a short stable identifier of an install prefix, used for per-prefix state.
+func prefixKey(prefix string) string {
+	sum := sha256.Sum256([]byte(filepath.Clean(prefix)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// lockPrefix makes sure only one transaction runs on prefix at a time.
+func lockPrefix(prefix string) (*os.File, error) {
+	dir := filepath.Join(common.UserConfigDir(), "locks")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, prefixKey(prefix)+".lock"), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("another ohla process is modifying '%s'", prefix)
+	}
+	return f, nil
+}
+
+func unlockPrefix(f *os.File) {
+	if f == nil {
+		return
+	}
+	_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	f.Close()
+}
@@ -0,0 +1,237 @@
+package pkgclient
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTransactionRollbackRestoresPrefix(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	prefix := t.TempDir()
+	stage := t.TempDir()
+	writeTestFile(t, prefix, "lib/libz.so", "old libz")
+	writeTestFile(t, prefix, "lib/libz.la", "libdir='/old'")
+	writeTestFile(t, prefix, "include/zlib.h", "old header")
+	writeTestFile(t, stage, "lib/libz.so", "new libz")
+	writeTestFile(t, stage, "lib/cmake/z/zConfig.cmake", "new config")
+
+	txn, err := beginTransaction(prefix)
+	if err != nil {
+		t.Fatalf("beginTransaction failed: %v", err)
+	}
+	mustDo(t, txn.installEntry(filepath.Join(stage, "lib/libz.so"), filepath.Join(prefix, "lib/libz.so")))
+	mustDo(t, txn.installEntry(filepath.Join(stage, "lib/cmake/z/zConfig.cmake"), filepath.Join(prefix, "lib/cmake/z/zConfig.cmake")))
+	mustDo(t, txn.preserve(filepath.Join(prefix, "lib/libz.la")))
+	mustDo(t, os.WriteFile(filepath.Join(prefix, "lib/libz.la"), []byte("libdir='/new'"), 0o644))
+	mustDo(t, txn.remove(filepath.Join(prefix, "include/zlib.h")))
+	mustDo(t, txn.removeDirIfEmpty(filepath.Join(prefix, "include")))
+
+	if err := txn.rollback(); err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+	assertFileContent(t, prefix, "lib/libz.so", "old libz")
+	assertFileContent(t, prefix, "lib/libz.la", "libdir='/old'")
+	assertFileContent(t, prefix, "include/zlib.h", "old header")
+	for _, gone := range []string{"lib/cmake", txnDirName} {
+		if _, err := os.Lstat(filepath.Join(prefix, gone)); !os.IsNotExist(err) {
+			t.Fatalf("%s still exists after rollback", gone)
+		}
+	}
+}
+
+func TestInterruptedTransactionIsRecovered(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	prefix := t.TempDir()
+	stage := t.TempDir()
+	writeTestFile(t, prefix, "lib/libz.so", "old libz")
+	writeTestFile(t, stage, "lib/libz.so", "new libz")
+
+	txn, err := beginTransaction(prefix)
+	if err != nil {
+		t.Fatalf("beginTransaction failed: %v", err)
+	}
+	mustDo(t, txn.installEntry(filepath.Join(stage, "lib/libz.so"), filepath.Join(prefix, "lib/libz.so")))
+	// simulate a killed process: journal stays behind, lock is released by the OS
+	txn.journalFile.Close()
+	unlockPrefix(txn.lock)
+
+	next, err := beginTransaction(prefix)
+	if err != nil {
+		t.Fatalf("beginTransaction after crash failed: %v", err)
+	}
+	defer next.rollback()
+	assertFileContent(t, prefix, "lib/libz.so", "old libz")
+}
+
+func TestCommittedTransactionIsNotUndone(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	prefix := t.TempDir()
+	stage := t.TempDir()
+	writeTestFile(t, prefix, "lib/libz.so", "old libz")
+	writeTestFile(t, stage, "lib/libz.so", "new libz")
+	writeTestFile(t, stage, "include/zlib.h", "new header")
+
+	txn, err := beginTransaction(prefix)
+	if err != nil {
+		t.Fatalf("beginTransaction failed: %v", err)
+	}
+	mustDo(t, txn.installEntry(filepath.Join(stage, "lib/libz.so"), filepath.Join(prefix, "lib/libz.so")))
+	mustDo(t, txn.installEntry(filepath.Join(stage, "include/zlib.h"), filepath.Join(prefix, "include/zlib.h")))
+	// simulate a process killed while commit was deleting the backups
+	mustDo(t, txn.seal())
+	mustDo(t, os.RemoveAll(txn.backupDir))
+	unlockPrefix(txn.lock)
+
+	next, err := beginTransaction(prefix)
+	if err != nil {
+		t.Fatalf("beginTransaction after crash failed: %v", err)
+	}
+	defer next.rollback()
+	assertFileContent(t, prefix, "lib/libz.so", "new libz")
+	assertFileContent(t, prefix, "include/zlib.h", "new header")
+}
+
+func TestPrefixLockRejectsConcurrentTransactions(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	prefix := t.TempDir()
+	txn, err := beginTransaction(prefix)
+	if err != nil {
+		t.Fatalf("beginTransaction failed: %v", err)
+	}
+	defer txn.rollback()
+	if _, err := beginTransaction(prefix); err == nil {
+		t.Fatal("second transaction on the same prefix unexpectedly started")
+	}
+}
+
+func mustDo(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertFileContent(t *testing.T, root, rel, want string) {
+	t.Helper()
+	got, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(rel)))
+	if err != nil {
+		t.Fatalf("read %s: %v", rel, err)
+	}
+	if string(got) != want {
+		t.Fatalf("%s = %q, want %q", rel, got, want)
+	}
+}
+
+func TestInstallEntryRejectsEscapingSymlinks(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	prefix := t.TempDir()
+	stage := t.TempDir()
+	mustDo(t, os.MkdirAll(filepath.Join(stage, "lib"), 0o755))
+	mustDo(t, os.Symlink("../../../etc/passwd", filepath.Join(stage, "lib/passwd")))
+	mustDo(t, os.Symlink("/etc", filepath.Join(stage, "lib/etc")))
+	mustDo(t, os.Symlink("../include", filepath.Join(stage, "lib/include")))
+
+	txn, err := beginTransaction(prefix)
+	if err != nil {
+		t.Fatalf("beginTransaction failed: %v", err)
+	}
+	defer txn.rollback()
+	for _, rel := range []string{"lib/passwd", "lib/etc"} {
+		if err := txn.moveEntry(filepath.Join(stage, rel), filepath.Join(prefix, rel)); err == nil {
+			t.Fatalf("symlink %s installed", rel)
+		}
+		if _, err := os.Lstat(filepath.Join(prefix, rel)); !os.IsNotExist(err) {
+			t.Fatalf("symlink %s created", rel)
+		}
+	}
+	mustDo(t, txn.installEntry(filepath.Join(stage, "lib/include"), filepath.Join(prefix, "lib/include")))
+}
+
+func TestInstallEntryRejectsChainedEscapingSymlinks(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	root := t.TempDir()
+	prefix := filepath.Join(root, "prefix")
+	stage := t.TempDir()
+	mustDo(t, os.MkdirAll(filepath.Join(stage, "include/sub"), 0o755))
+	mustDo(t, os.Symlink("..", filepath.Join(stage, "include/sub/l")))
+	mustDo(t, os.Symlink("sub/l/../..", filepath.Join(stage, "include/m")))
+	writeTestFile(t, stage, "include/m2/x", "evil")
+
+	txn, err := beginTransaction(prefix)
+	if err != nil {
+		t.Fatalf("beginTransaction failed: %v", err)
+	}
+	defer txn.rollback()
+	mustDo(t, txn.installEntry(filepath.Join(stage, "include/sub/l"), filepath.Join(prefix, "include/sub/l")))
+	if err := txn.installEntry(filepath.Join(stage, "include/m"), filepath.Join(prefix, "include/m")); err == nil {
+		t.Fatalf("symlink include/m resolving outside of the prefix installed")
+	}
+
+	// a symlink leading out of the prefix that is already there is never written through
+	mustDo(t, os.Symlink("sub/l/../..", filepath.Join(prefix, "include/m2")))
+	if err := txn.moveEntry(filepath.Join(stage, "include/m2/x"), filepath.Join(prefix, "include/m2/x")); err == nil {
+		t.Fatalf("file installed through a symlink leading out of the prefix")
+	}
+	if _, err := os.Lstat(filepath.Join(root, "x")); !os.IsNotExist(err) {
+		t.Fatalf("file written outside of the prefix")
+	}
+}
+
+func TestInterruptedTransactionRestoresDBRecords(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	prefix := t.TempDir()
+	stage := t.TempDir()
+	db, err := OpenDB(filepath.Join(t.TempDir(), "installed.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	writeTestFile(t, prefix, "lib/libz.so", "old libz")
+	oldFiles, err := collectInstalledFiles(prefix, []string{"lib/libz.so"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustDo(t, db.InsertInstalled(Installed{Name: "zlib", Version: "1.2.13", Arch: "aarch64", Prefix: prefix,
+		Scripts: map[string]string{"postrm": "#!/bin/sh\n"}}, oldFiles))
+	writeTestFile(t, stage, "lib/libz.so", "new libz")
+	writeTestFile(t, stage, "include/curl.h", "curl")
+
+	txn, err := beginTransaction(prefix)
+	if err != nil {
+		t.Fatalf("beginTransaction failed: %v", err)
+	}
+	mustDo(t, txn.installEntry(filepath.Join(stage, "lib/libz.so"), filepath.Join(prefix, "lib/libz.so")))
+	mustDo(t, txn.installEntry(filepath.Join(stage, "include/curl.h"), filepath.Join(prefix, "include/curl.h")))
+	newFiles, err := collectInstalledFiles(prefix, []string{"lib/libz.so", "include/curl.h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustDo(t, txn.applyDBChanges(db, []string{"zlib"}, []Installed{
+		{Name: "zlib", Version: "1.3.1", Arch: "aarch64"},
+		{Name: "curl", Version: "8.9.0", Arch: "aarch64"},
+	}, map[string][]InstalledFile{"zlib": newFiles[:1], "curl": newFiles[1:]}))
+	// simulate a process killed after the DB commit, before the journal is sealed
+	txn.journalFile.Close()
+	unlockPrefix(txn.lock)
+
+	next, err := beginTransaction(prefix)
+	if err != nil {
+		t.Fatalf("beginTransaction after crash failed: %v", err)
+	}
+	defer next.rollback()
+	assertFileContent(t, prefix, "lib/libz.so", "old libz")
+	if inst, err := db.GetInstalled("curl", prefix); err != nil || inst != nil {
+		t.Fatalf("curl still recorded after recovery: %+v, %v", inst, err)
+	}
+	inst, err := db.GetInstalled("zlib", prefix)
+	if err != nil || inst == nil || inst.Version != "1.2.13" {
+		t.Fatalf("zlib recorded as %+v after recovery, %v", inst, err)
+	}
+	if scripts, err := db.GetInstalledScripts("zlib", prefix); err != nil || scripts["postrm"] == "" {
+		t.Fatalf("scripts of zlib not restored: %v, %v", scripts, err)
+	}
+	if files, err := db.GetInstalledFiles("zlib", prefix); err != nil || len(files) != 1 || files[0].SHA256 != oldFiles[0].SHA256 {
+		t.Fatalf("files of zlib not restored: %+v, %v", files, err)
+	}
+}
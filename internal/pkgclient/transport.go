@@ -0,0 +1,110 @@
+package pkgclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/SSRVodka/oh-packager/internal/common"
+	"github.com/SSRVodka/oh-packager/pkg/config"
+)
+
+const defaultConnectTimeout = 30 * time.Second
+
+// newHTTPClient returns the HTTP client used to talk to the repositories of cfg,
+// with its TLS, proxy, timeout and credentials settings.
+// Invalid settings make every request fail with the configuration error.
+func newHTTPClient(cfg *config.Config) *http.Client {
+	base, err := newTransport(cfg)
+	if err != nil {
+		return &http.Client{Transport: errTransport{err: err}}
+	}
+	return &http.Client{Transport: &authTransport{cfg: cfg, base: base}, CheckRedirect: checkRedirect}
+}
+
+// checkRedirect refuses redirects to another scheme (except from http to https), so that a remote
+// repository cannot redirect requests to local files. It keeps the default limit of 10 redirects.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after 10 redirects")
+	}
+	from, to := via[len(via)-1].URL.Scheme, req.URL.Scheme
+	if from != to && !(from == "http" && to == "https") {
+		return fmt.Errorf("refusing redirect from %s to %s", common.RedactURL(via[len(via)-1].URL.String()), common.RedactURL(req.URL.String()))
+	}
+	return nil
+}
+
+func newTransport(cfg *config.Config) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// local repositories: file:// URLs are read from disk (with Range support for resumed copies)
+	transport.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	if cfg == nil {
+		return transport, nil
+	}
+
+	connectTimeout := defaultConnectTimeout
+	if cfg.ConnectTimeout > 0 {
+		connectTimeout = time.Duration(cfg.ConnectTimeout) * time.Second
+	}
+	transport.DialContext = (&net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = connectTimeout
+	transport.ResponseHeaderTimeout = time.Duration(cfg.ResponseTimeout) * time.Second
+
+	if cfg.Proxy != "" {
+		proxyURL, err := url.Parse(cfg.Proxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL '%s' in config", common.RedactURL(cfg.Proxy))
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CACert != "" {
+		pem, err := os.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA bundle: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificate found in the CA bundle '%s'", cfg.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.ClientCert != "" || cfg.ClientKey != "" {
+		if cfg.ClientCert == "" || cfg.ClientKey == "" {
+			return nil, fmt.Errorf("client_cert and client_key must be configured together")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.InsecureSkipVerify {
+		fmt.Fprintln(os.Stderr, " - WARN: TLS certificate verification is disabled (insecure_skip_verify)")
+		tlsConfig.InsecureSkipVerify = true
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// errTransport fails every request with the error of the HTTP configuration.
+type errTransport struct {
+	err error
+}
+
+func (t errTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	return nil, fmt.Errorf("invalid HTTP configuration: %w", t.err)
+}
@@ -0,0 +1,112 @@
+package pkgclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SSRVodka/oh-packager/internal/common"
+	"github.com/SSRVodka/oh-packager/pkg/config"
+)
+
+func TestHTTPClientTLSSettings(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%d client certificates", len(r.TLS.PeerCertificates))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	// the server certificate doubles as CA and client certificate
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "ca.pem")
+	mustDo(t, os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o644))
+	keyDER, err := x509.MarshalPKCS8PrivateKey(srv.TLS.Certificates[0].PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "client.key")
+	mustDo(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	fetch := func(cfg *config.Config) (string, error) {
+		b, err := common.FetchURL(newHTTPClient(cfg), srv.URL)
+		return string(b), err
+	}
+	if _, err := fetch(&config.Config{}); err == nil {
+		t.Fatalf("untrusted server certificate accepted")
+	}
+	if got, err := fetch(&config.Config{CACert: caPath}); err != nil || got != "0 client certificates" {
+		t.Fatalf("with CA bundle: %q, %v", got, err)
+	}
+	if got, err := fetch(&config.Config{CACert: caPath, ClientCert: caPath, ClientKey: keyPath}); err != nil || got != "1 client certificates" {
+		t.Fatalf("with client certificate: %q, %v", got, err)
+	}
+	if got, err := fetch(&config.Config{InsecureSkipVerify: true}); err != nil || got != "0 client certificates" {
+		t.Fatalf("with insecure_skip_verify: %q, %v", got, err)
+	}
+
+	// configuration and certificate errors are reported at once, without retries
+	start := time.Now()
+	dest := filepath.Join(dir, "foo.pkg")
+	for _, cfg := range []*config.Config{{CACert: filepath.Join(dir, "missing.pem")}, {ClientCert: caPath}, {}} {
+		if err := common.DownloadToFile(context.Background(), newHTTPClient(cfg), srv.URL, dest); err == nil {
+			t.Fatalf("download with %+v succeeded", cfg)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("permanent errors retried for %v", elapsed)
+	}
+}
+
+func TestHTTPClientProxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "proxied "+r.URL.String())
+	}))
+	defer proxy.Close()
+
+	b, err := common.FetchURL(newHTTPClient(&config.Config{Proxy: proxy.URL}), "http://repo.invalid/index.json")
+	if err != nil || string(b) != "proxied http://repo.invalid/index.json" {
+		t.Fatalf("request not sent through the proxy: %q, %v", b, err)
+	}
+	if _, err := common.FetchURL(newHTTPClient(&config.Config{Proxy: "://bad"}), "http://repo.invalid/"); err == nil || !strings.Contains(err.Error(), "invalid proxy URL") {
+		t.Fatalf("invalid proxy not reported: %v", err)
+	}
+}
+
+func TestHTTPClientRefusesRedirectsToLocalFiles(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	mustDo(t, os.WriteFile(secret, []byte("secret"), 0o600))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/moved" {
+			http.Redirect(w, r, "/index.json", http.StatusFound)
+			return
+		}
+		if r.URL.Path == "/index.json" {
+			fmt.Fprint(w, "index")
+			return
+		}
+		http.Redirect(w, r, "file://"+secret, http.StatusFound)
+	}))
+	defer srv.Close()
+
+	client := newHTTPClient(&config.Config{})
+	if b, err := common.FetchURL(client, srv.URL+"/moved"); err != nil || string(b) != "index" {
+		t.Fatalf("redirect within the repository: %q, %v", b, err)
+	}
+	if b, err := common.FetchURL(client, srv.URL+"/steal"); err == nil || strings.Contains(string(b), "secret") {
+		t.Fatalf("redirect to a local file followed: %q, %v", b, err)
+	}
+	// file:// repositories still work
+	if b, err := common.FetchURL(client, "file://"+secret); err != nil || string(b) != "secret" {
+		t.Fatalf("file:// URL: %q, %v", b, err)
+	}
+}
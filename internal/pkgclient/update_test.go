@@ -0,0 +1,124 @@
+package pkgclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/SSRVodka/oh-packager/pkg/config"
+	"github.com/SSRVodka/oh-packager/pkg/meta"
+)
+
+func TestUpdateKeepsLocalIndexes(t *testing.T) {
+	version := 1
+	requests := map[string]int{}
+	full := 0
+	// a deployment with channels under repo/
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		if r.URL.Path != "/repo/channels/stable/index.json" {
+			http.NotFound(w, r)
+			return
+		}
+		etag := fmt.Sprintf(`"v%d"`, version)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		b, _ := json.Marshal(meta.Index{Channel: "stable", Packages: []meta.IndexEntry{cacheEntry("zlib", fmt.Sprintf("1.%d.0", version), "")}})
+		w.Header().Set("ETag", etag)
+		full++
+		w.Write(b)
+	}))
+	defer srv.Close()
+
+	cfg := &config.Config{RootURL: srv.URL, Channel: "stable", AllowUnsigned: true}
+	c := &Client{Config: cfg, IndexDir: t.TempDir(), HTTP: srv.Client()}
+	repo := c.findRepo(DefaultRepoName)
+	mustDo(t, c.Update())
+	mustDo(t, c.Update())
+	if full != 1 || requests["/channels/stable/index.json"] != 1 {
+		t.Fatalf("%d full downloads, requests %v; want the unchanged index and the layout probed once", full, requests)
+	}
+
+	// resolution uses the local index without any request
+	idx, err := c.loadIndex()
+	if err != nil || idx.Packages[0].Version != "1.1.0" {
+		t.Fatalf("local index: %+v, %v", idx, err)
+	}
+	if requests["/repo/channels/stable/index.json"] != 2 {
+		t.Fatalf("index fetched again: %v", requests)
+	}
+
+	version = 2
+	mustDo(t, c.Update())
+	if idx, err = c.loadIndex(); err != nil || idx.Packages[0].Version != "1.2.0" {
+		t.Fatalf("updated index: %+v, %v", idx, err)
+	}
+
+	_, state, err := c.storedRepoIndex(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Checked = time.Now().Add(-3 * 24 * time.Hour)
+	mustDo(t, c.writeIndexState(repo, state))
+	if age := indexAge(state); age != "3 days ago" {
+		t.Fatalf("index age %q", age)
+	}
+
+	srv.Close()
+	c.Offline = true
+	if err := c.Update(); err == nil {
+		t.Fatalf("update ran offline")
+	}
+	if _, err := c.loadIndex(); err != nil {
+		t.Fatalf("offline resolution failed: %v", err)
+	}
+}
+
+func TestUpdateRejectsIndexesOfAnotherOrigin(t *testing.T) {
+	generated := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	served := meta.Index{Repo: "repo", Channel: "stable", Generated: generated, Packages: []meta.IndexEntry{cacheEntry("zlib", "1.3.1", "")}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := json.Marshal(served)
+		w.Write(b)
+	}))
+	defer srv.Close()
+
+	cfg := &config.Config{RootURL: srv.URL, Channel: "stable", AllowUnsigned: true}
+	c := &Client{Config: cfg, IndexDir: t.TempDir(), HTTP: srv.Client()}
+	repo := c.findRepo(DefaultRepoName)
+	if _, _, err := c.updateRepoIndex(repo); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	accepted := served
+	for _, tc := range []struct {
+		name string
+		edit func(idx *meta.Index)
+	}{
+		{"another channel", func(idx *meta.Index) { idx.Channel = "testing" }},
+		{"another repository", func(idx *meta.Index) { idx.Repo = "other" }},
+		{"an older index", func(idx *meta.Index) { idx.Generated = generated.Add(-time.Hour) }},
+	} {
+		served = accepted
+		served.Packages = []meta.IndexEntry{cacheEntry("zlib", "1.2.13", "")}
+		tc.edit(&served)
+		if _, _, err := c.updateRepoIndex(repo); err == nil {
+			t.Fatalf("index of %s accepted", tc.name)
+		}
+		if idx, _, err := c.storedRepoIndex(repo); err != nil || idx.Packages[0].Version != "1.3.1" {
+			t.Fatalf("local index replaced by the index of %s: %+v, %v", tc.name, idx, err)
+		}
+	}
+
+	served = accepted
+	served.Generated = generated.Add(time.Hour)
+	served.Packages = []meta.IndexEntry{cacheEntry("zlib", "1.3.2", "")}
+	if idx, _, err := c.updateRepoIndex(repo); err != nil || idx.Packages[0].Version != "1.3.2" {
+		t.Fatalf("newer index: %+v, %v", idx, err)
+	}
+}
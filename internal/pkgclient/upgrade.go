@@ -0,0 +1,154 @@
+package pkgclient
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/SSRVodka/oh-packager/internal/common"
+	"github.com/SSRVodka/oh-packager/pkg/meta"
+)
+
+// UpgradeSdk upgrades packages installed in OHOS sdk.
+func (c *Client) UpgradeSdk(pkgNames []string, noConfirm bool) error {
+	prefix, err := c.sdkPrefix()
+	if err != nil {
+		return err
+	}
+	return c.Upgrade(pkgNames, prefix, noConfirm)
+}
+
+// Upgrade moves installed packages of prefix to the newest versions available in the channel index.
+// Empty pkgNames upgrades everything. Other installed packages are kept at their versions unless
+// the new set of packages requires otherwise.
+//
+// @note prefix must be an absolute path
+func (c *Client) Upgrade(pkgNames []string, prefix string, noConfirm bool) error {
+	if err := c.checkRepos(); err != nil {
+		return err
+	}
+	if err := validateOverwriteGlobs(c.Overwrite); err != nil {
+		return err
+	}
+	db, err := OpenDB(c.DBPath)
+	if err != nil {
+		return err
+	}
+	installed, err := db.ListInstalled(prefix)
+	db.Close()
+	if err != nil {
+		return err
+	}
+	if len(installed) == 0 {
+		fmt.Printf("no packages installed in %s\n", prefix)
+		return nil
+	}
+
+	byName := map[string]Installed{}
+	arch := ""
+	for _, inst := range installed {
+		byName[inst.Name] = inst
+		if arch == "" {
+			arch = inst.Arch
+		} else if inst.Arch != arch {
+			return fmt.Errorf("different archs installed in one prefix: '%s' vs '%s'", inst.Arch, arch)
+		}
+	}
+	selected := map[string]bool{}
+	for _, name := range pkgNames {
+		if _, ok := byName[name]; !ok {
+			return fmt.Errorf("%s not installed in %s", name, prefix)
+		}
+		selected[name] = true
+	}
+	upgradeAll := len(pkgNames) == 0
+
+	idx, err := c.loadIndex()
+	if err != nil {
+		return err
+	}
+	inIndex := map[string]bool{}
+	for _, e := range idx.Packages {
+		if e.Arch == arch {
+			inIndex[e.Name] = true
+		}
+	}
+
+	// resolve the whole installed set again so that the result stays consistent,
+	// preferring the installed versions of packages the user didn't ask to upgrade
+	requested := []string{}
+	preferred := map[string]string{}
+	for _, inst := range installed {
+		if !inIndex[inst.Name] {
+			fmt.Printf("WARN: %s is not available in the repository, keeping %s\n", inst.Name, inst.Version)
+			continue
+		}
+		requested = append(requested, inst.Name)
+		if !upgradeAll && !selected[inst.Name] {
+			preferred[inst.Name] = inst.Version
+		}
+	}
+
+	fmt.Printf("Resolving dependencies...\n")
+	chosen, err := c.resolveDependencies(idx, requested, arch, preferred)
+	if err != nil {
+		return err
+	}
+
+	changes := map[string]meta.IndexEntry{}
+	// the resolution is only consistent if every package gets its resolved version
+	downgrades := []string{}
+	for name, entry := range chosen {
+		inst, ok := byName[name]
+		if !ok {
+			changes[name] = entry
+			continue
+		}
+		if entry.Version == inst.Version {
+			continue
+		}
+		if compareVersions(entry.Version, inst.Version) < 0 {
+			downgrades = append(downgrades, fmt.Sprintf("  %s: %s installed, %s resolved", name, inst.Version, entry.Version))
+			continue
+		}
+		changes[name] = entry
+	}
+	if len(downgrades) > 0 {
+		sort.Strings(downgrades)
+		return fmt.Errorf("installed packages are newer than the versions the upgrade resolved to:\n%s\n"+
+			"remove them with `ohla del` or install the resolved versions with `ohla add` first", strings.Join(downgrades, "\n"))
+	}
+	if len(changes) == 0 {
+		fmt.Println("All packages are up to date.")
+		return nil
+	}
+
+	names := make([]string, 0, len(changes))
+	for name := range changes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if !noConfirm {
+		fmt.Printf("We are going to upgrade (%s): \n", arch)
+		for _, name := range names {
+			if inst, ok := byName[name]; ok {
+				fmt.Printf(" - %s (%s -> %s)\n", name, inst.Version, changes[name].Version)
+			} else {
+				fmt.Printf(" - %s (%s, new dependency)\n", name, changes[name].Version)
+			}
+		}
+		fmt.Printf("--------------------------\n")
+		fmt.Printf("Install Prefix: %s\n", prefix)
+		fmt.Printf("--------------------------\n")
+		ok, confirmErr := common.ConfirmAction("Proceed with the upgrade? (Y/[n]) ")
+		if confirmErr != nil {
+			return confirmErr
+		}
+		if !ok {
+			fmt.Printf("Upgrade abort.\n")
+			return nil
+		}
+	}
+
+	return c.installChosen(changes, map[string]string{}, nil, prefix)
+}
@@ -0,0 +1,73 @@
+package pkgclient
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/SSRVodka/oh-packager/pkg/config"
+	"github.com/SSRVodka/oh-packager/pkg/meta"
+)
+
+func TestResolveDependenciesDropsConflictingPreferredVersions(t *testing.T) {
+	sdk := t.TempDir()
+	writeTestFile(t, sdk, "toolchains/oh-uni-package.json", `{"apiVersion": "12"}`)
+	c := &Client{Config: &config.Config{OhosSdk: sdk}}
+	idx := &meta.Index{Packages: []meta.IndexEntry{
+		{Name: "ares", Version: "1.0.0", Arch: "aarch64", OhosApi: "12"},
+		{Name: "ares", Version: "2.0.0", Arch: "aarch64", OhosApi: "12"},
+		{Name: "png", Version: "1.0.0", Arch: "aarch64", OhosApi: "12", Depends: []string{"ares >= 1.0.0"}},
+		{Name: "png", Version: "2.0.0", Arch: "aarch64", OhosApi: "12", Depends: []string{"ares >= 2.0.0"}},
+	}}
+
+	// upgrading png only: ares (not selected, sorted first) is pinned to 1.0.0 but the new png needs ares 2
+	chosen, err := c.resolveDependencies(idx, []string{"ares", "png"}, "aarch64", map[string]string{"ares": "1.0.0"})
+	if err != nil {
+		t.Fatalf("resolveDependencies failed: %v", err)
+	}
+	if chosen["png"].Version != "2.0.0" || chosen["ares"].Version != "2.0.0" {
+		t.Fatalf("got png %s, ares %s; want both 2.0.0", chosen["png"].Version, chosen["ares"].Version)
+	}
+
+	// pins that don't conflict are kept
+	chosen, err = c.resolveDependencies(idx, []string{"ares", "png"}, "aarch64", map[string]string{"ares": "1.0.0", "png": "1.0.0"})
+	if err != nil {
+		t.Fatalf("resolveDependencies failed: %v", err)
+	}
+	if chosen["png"].Version != "1.0.0" || chosen["ares"].Version != "1.0.0" {
+		t.Fatalf("got png %s, ares %s; want both kept at 1.0.0", chosen["png"].Version, chosen["ares"].Version)
+	}
+
+	// without pins, a real conflict is still reported
+	if _, err := c.resolveDependencies(idx, []string{"ares == 1.0.0", "png >= 2.0.0"}, "aarch64", nil); err == nil {
+		t.Fatalf("expected a conflict for ares == 1.0.0 with png 2")
+	}
+}
+
+func TestUpgradeRefusesToKeepNewerInstalledVersions(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	srv := serveIndex(t, "stable",
+		meta.IndexEntry{Name: "zlib", Version: "1.2.13", Arch: "aarch64", OhosApi: "12", URL: "packages/zlib-1.2.13.pkg"},
+		meta.IndexEntry{Name: "libpng", Version: "1.6.43", Arch: "aarch64", OhosApi: "12", URL: "packages/libpng-1.6.43.pkg", Depends: []string{"zlib < 1.3"}})
+	sdk := t.TempDir()
+	writeTestFile(t, sdk, "toolchains/oh-uni-package.json", `{"apiVersion": "12"}`)
+	prefix := t.TempDir()
+	dbPath := filepath.Join(t.TempDir(), "installed.db")
+	db, err := OpenDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// zlib 1.3.1 was built locally; libpng 1.6.43 needs zlib < 1.3
+	mustDo(t, db.InsertInstalled(Installed{Name: "zlib", Version: "1.3.1", Arch: "aarch64", Prefix: prefix}, nil))
+	mustDo(t, db.InsertInstalled(Installed{Name: "libpng", Version: "1.6.40", Arch: "aarch64", Prefix: prefix, Depends: []string{"zlib"}}, nil))
+
+	c := &Client{Config: &config.Config{OhosSdk: sdk, RootURL: srv.URL, Channel: "stable", AllowUnsigned: true}, DBPath: dbPath, HTTP: srv.Client()}
+	err = c.Upgrade(nil, prefix, true)
+	if err == nil || !strings.Contains(err.Error(), "zlib: 1.3.1 installed, 1.2.13 resolved") {
+		t.Fatalf("expected the upgrade to fail on zlib, got %v", err)
+	}
+	if inst, err := db.GetInstalled("libpng", prefix); err != nil || inst.Version != "1.6.40" {
+		t.Fatalf("libpng changed: %+v, %v", inst, err)
+	}
+}
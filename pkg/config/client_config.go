@@ -10,4 +10,67 @@ type Config struct {
 
 	// absolute path for xcompile
 	PkgSrcRepo string `json:"pkg_src_repo"`
+
+	// repositories used in addition to RootURL (which is the repository "default", priority 0)
+	Repos []RepoConfig `json:"repos,omitempty"`
+	// package name -> name of the only repository it is installed from
+	Pins map[string]string `json:"pins,omitempty"`
+	// base URLs serving the same content as RootURL, tried when it fails
+	Mirrors []string `json:"mirrors,omitempty"`
+	// order in which mirrors are tried: "order" (as configured, the default) or "latency"
+	MirrorSelection string `json:"mirror_selection,omitempty"`
+	// don't verify the signatures of RootURL (unsigned repositories)
+	AllowUnsigned bool `json:"allow_unsigned,omitempty"`
+	// key ID -> PEM ed25519 public key trusted to sign repositories
+	TrustedKeys map[string]string `json:"trusted_keys,omitempty"`
+	// key ID -> names of the repositories the key is trusted to sign
+	KeyRepos map[string][]string `json:"key_repos,omitempty"`
+
+	// maximum number of concurrent package downloads (0: default)
+	DownloadJobs int `json:"download_jobs,omitempty"`
+
+	// seconds before a package lifecycle script is killed (0: no limit)
+	ScriptTimeout int `json:"script_timeout,omitempty"`
+	// run package lifecycle scripts with a minimal environment
+	ScriptCleanEnv bool `json:"script_clean_env,omitempty"`
+	// repo root URL -> sha256 of packages whose scripts run without confirmation
+	TrustedScripts map[string][]string `json:"trusted_scripts,omitempty"`
+
+	// repo URL prefix -> credentials sent with the requests below it
+	Auth map[string]RepoAuth `json:"auth,omitempty"`
+
+	// PEM bundle of CAs trusted in addition to the system ones
+	CACert string `json:"ca_cert,omitempty"`
+	// PEM client certificate and key for mutual TLS
+	ClientCert string `json:"client_cert,omitempty"`
+	ClientKey  string `json:"client_key,omitempty"`
+	// don't verify server certificates (lab servers only)
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+	// proxy URL for every request (empty: HTTP_PROXY, HTTPS_PROXY and NO_PROXY)
+	Proxy string `json:"proxy,omitempty"`
+	// seconds to establish a connection (0: 30s)
+	ConnectTimeout int `json:"connect_timeout,omitempty"`
+	// seconds to wait for the response headers of a request (0: no limit)
+	ResponseTimeout int `json:"response_timeout,omitempty"`
+}
+
+// RepoConfig describes an additional package repository.
+type RepoConfig struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// channel of the repository (empty: Config.Channel)
+	Channel string `json:"channel,omitempty"`
+	// for the same package name, repositories with a higher priority are preferred
+	Priority int `json:"priority,omitempty"`
+	// base URLs serving the same content as URL, tried when it fails
+	Mirrors []string `json:"mirrors,omitempty"`
+	// don't verify the signatures of the repository
+	AllowUnsigned bool `json:"allow_unsigned,omitempty"`
+}
+
+// RepoAuth holds the credentials of a package repository: a bearer token or a basic auth user.
+type RepoAuth struct {
+	Token    string `json:"token,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
 }
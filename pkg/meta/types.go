@@ -46,10 +46,12 @@ type Manifest struct {
 
 // Index contains package entries for a channel.
 type Index struct {
-	Repo      string       `json:"repo,omitempty"`
-	Channel   string       `json:"channel,omitempty"`
-	Generated time.Time    `json:"generated"`
-	Packages  []IndexEntry `json:"packages"`
+	Repo      string    `json:"repo,omitempty"`
+	Channel   string    `json:"channel,omitempty"`
+	Generated time.Time `json:"generated"`
+	// base URLs of mirrors serving the same repository
+	Mirrors  []string     `json:"mirrors,omitempty"`
+	Packages []IndexEntry `json:"packages"`
 }
 
 type IndexEntry struct {
@@ -62,6 +64,9 @@ type IndexEntry struct {
 	Size     int64    `json:"size"`
 	Manifest string   `json:"manifest,omitempty"`
 	Depends  []string `json:"depends,omitempty"`
+
+	// name of the repository the client loaded the entry from (not published by servers)
+	Repo string `json:"repo,omitempty"`
 }
 
 type OhosSdkInfo struct {
@@ -83,3 +88,12 @@ type PackageInfo struct {
 	BuildType    string   `json:"build_type,omitempty"`
 	PatchFiles   []string `json:"patch_files,omitempty"`
 }
+
+// Signature is the ed25519 signature of a repository file (index.json or a manifest),
+// stored as signatures/<path of the file>.sig in the repository.
+type Signature struct {
+	// identifies the public key (see common.KeyID)
+	KeyID string `json:"key_id"`
+	// base64 encoded ed25519 signature of the file content
+	Signature string `json:"signature"`
+}